@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrBreakerOpen is returned by the calls rejected by an open circuit breaker
+	ErrBreakerOpen = status.Error(codes.Unavailable, "circuit breaker is open")
+
+	defaultBreakerWindow      = 10 * time.Second
+	defaultBreakerMinRequests = 20
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerOpenTimeout = 5 * time.Second
+	defaultBreakerProbes      = 1
+
+	breakerBuckets = 10
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int32
+
+const (
+	// BreakerClosed lets every call through and measures their outcome
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects every call with ErrBreakerOpen until OpenTimeout is over
+	BreakerOpen
+	// BreakerHalfOpen lets HalfOpenRequests calls through, the breaker closes if they all succeed
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerConfig configures the circuit breakers, the zero values take the defaults
+type BreakerConfig struct {
+	// PerMethod keeps a breaker per full method instead of per service
+	PerMethod bool
+	// Window is the sliding window the error and slow call rates are measured over
+	Window time.Duration
+	// MinRequests is the number of calls in the window before the breaker may open
+	MinRequests int
+	// ErrorRate in (0, 1] of failed calls opens the breaker
+	ErrorRate float64
+	// SlowCall is the latency above which a call counts as slow, 0 disables the latency threshold
+	SlowCall time.Duration
+	// SlowCallRate in (0, 1] of slow calls opens the breaker, it defaults to ErrorRate
+	SlowCallRate float64
+	// OpenTimeout is how long the breaker stays open before letting probe calls through
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probe calls which must succeed to close the breaker
+	HalfOpenRequests int
+	// IsFailure tells the errors counted as failures, by default Unavailable, DeadlineExceeded,
+	// Internal and ResourceExhausted
+	IsFailure func(err error) bool
+	// OnStateChange is called on every transition of a breaker, name is its service or method,
+	// it runs with the breaker locked so it must not block
+	OnStateChange func(name string, from, to BreakerState)
+}
+
+// Breakers holds a circuit breaker per service or per method
+type Breakers struct {
+	config   BreakerConfig
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func NewBreakers(config BreakerConfig) *Breakers {
+	if config.Window <= 0 {
+		config.Window = defaultBreakerWindow
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = defaultBreakerMinRequests
+	}
+	if config.ErrorRate <= 0 {
+		config.ErrorRate = defaultBreakerErrorRate
+	}
+	if config.SlowCallRate <= 0 {
+		config.SlowCallRate = config.ErrorRate
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = defaultBreakerProbes
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = isBreakerFailure
+	}
+	return &Breakers{config: config, breakers: make(map[string]*breaker)}
+}
+
+// isBreakerFailure counts the errors telling the server is down or overloaded
+func isBreakerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// State gets the state of the breaker of a service, or of a full method with PerMethod
+func (b *Breakers) State(name string) BreakerState {
+	b.mu.Lock()
+	br, ok := b.breakers[name]
+	b.mu.Unlock()
+	if !ok {
+		return BreakerClosed
+	}
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	return br.current(time.Now())
+}
+
+// UnaryClientInterceptor rejects the calls while the breaker of their service or method is open
+func (b *Breakers) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if IsHealthProbe(ctx) || isHedged(ctx) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		br := b.get(method)
+		if !br.allow() {
+			return ErrBreakerOpen
+		}
+		start := time.Now()
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		br.record(err, time.Since(start))
+		return err
+	}
+}
+
+// StreamClientInterceptor rejects the streams while the breaker of their service or method is open,
+// a stream counts as a call ending with its last message and its latency is not measured
+func (b *Breakers) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		br := b.get(method)
+		if !br.allow() {
+			return nil, ErrBreakerOpen
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			br.record(err, 0)
+			return nil, err
+		}
+		return newTrackedStream(ctx, cs, desc, func(err error) {
+			br.record(err, 0)
+		}), nil
+	}
+}
+
+func (b *Breakers) get(method string) *breaker {
+	name := method
+	if !b.config.PerMethod {
+		name = serviceOf(method)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.breakers[name]
+	if !ok {
+		br = &breaker{name: name, config: &b.config, buckets: make([]breakerBucket, breakerBuckets)}
+		b.breakers[name] = br
+	}
+	return br
+}
+
+// serviceOf gets the service of a full method like "/package.Service/Method"
+func serviceOf(fullMethod string) string {
+	name := strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+type breaker struct {
+	name   string
+	config *BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	openedAt time.Time
+	// half-open, the probe calls let through and those which succeeded
+	probes    int
+	successes int
+	// closed, the outcomes over the window
+	buckets []breakerBucket
+}
+
+// breakerBucket counts the outcomes of a slice of the window
+type breakerBucket struct {
+	slot     int64
+	total    int
+	failures int
+	slow     int
+}
+
+// current gets the state at now, an open breaker turns half-open after OpenTimeout
+func (br *breaker) current(now time.Time) BreakerState {
+	if br.state == BreakerOpen && now.Sub(br.openedAt) >= br.config.OpenTimeout {
+		br.transition(BreakerHalfOpen, now)
+	}
+	return br.state
+}
+
+// allow tells whether a call may go through
+func (br *breaker) allow() bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	switch br.current(time.Now()) {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if br.probes >= br.config.HalfOpenRequests {
+			return false
+		}
+		br.probes++
+	}
+	return true
+}
+
+// record counts the outcome of a call let through by allow, canceled calls are not counted
+func (br *breaker) record(err error, latency time.Duration) {
+	if status.Code(err) == codes.Canceled {
+		br.mu.Lock()
+		if br.state == BreakerHalfOpen && br.probes > 0 {
+			br.probes--
+		}
+		br.mu.Unlock()
+		return
+	}
+	failed := err != nil && br.config.IsFailure(err)
+	slow := br.config.SlowCall > 0 && latency >= br.config.SlowCall
+	now := time.Now()
+
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	switch br.state {
+	case BreakerHalfOpen:
+		if failed || slow {
+			br.transition(BreakerOpen, now)
+			return
+		}
+		br.successes++
+		if br.successes >= br.config.HalfOpenRequests {
+			br.transition(BreakerClosed, now)
+		}
+	case BreakerClosed:
+		b := br.bucket(now)
+		b.total++
+		if failed {
+			b.failures++
+		}
+		if slow {
+			b.slow++
+		}
+		if br.trips(now) {
+			br.transition(BreakerOpen, now)
+		}
+	}
+}
+
+// bucket gets the bucket of now, resetting it if it held an older slot
+func (br *breaker) bucket(now time.Time) *breakerBucket {
+	slot := now.UnixNano() / int64(br.config.Window/time.Duration(len(br.buckets)))
+	b := &br.buckets[slot%int64(len(br.buckets))]
+	if b.slot != slot {
+		*b = breakerBucket{slot: slot}
+	}
+	return b
+}
+
+// trips tells whether the outcomes over the window exceed a threshold
+func (br *breaker) trips(now time.Time) bool {
+	n := int64(len(br.buckets))
+	slot := now.UnixNano() / int64(br.config.Window/time.Duration(n))
+	var total, failures, slow int
+	for _, b := range br.buckets {
+		if b.slot > slot-n {
+			total += b.total
+			failures += b.failures
+			slow += b.slow
+		}
+	}
+	if total < br.config.MinRequests {
+		return false
+	}
+	return float64(failures) >= br.config.ErrorRate*float64(total) ||
+		(br.config.SlowCall > 0 && float64(slow) >= br.config.SlowCallRate*float64(total))
+}
+
+// transition moves the breaker to a state and resets its counters, it is called with mu held
+func (br *breaker) transition(to BreakerState, now time.Time) {
+	from := br.state
+	br.state = to
+	br.probes, br.successes = 0, 0
+	switch to {
+	case BreakerOpen:
+		br.openedAt = now
+	case BreakerClosed:
+		for i := range br.buckets {
+			br.buckets[i] = breakerBucket{}
+		}
+	}
+	if br.config.OnStateChange != nil {
+		br.config.OnStateChange(br.name, from, to)
+	}
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testMethod = "/test.Service/Get"
+
+// invokerOf gets an invoker failing with err after sleeping for latency
+func invokerOf(err error, latency time.Duration) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		time.Sleep(latency)
+		return err
+	}
+}
+
+func TestBreakerTransitions(t *testing.T) {
+	var changes []BreakerState
+	b := NewBreakers(BreakerConfig{
+		MinRequests:      4,
+		ErrorRate:        0.5,
+		OpenTimeout:      50 * time.Millisecond,
+		HalfOpenRequests: 2,
+		OnStateChange: func(name string, from, to BreakerState) {
+			assert.Equal(t, "test.Service", name)
+			changes = append(changes, to)
+		},
+	})
+	call := b.UnaryClientInterceptor()
+	unavailable := status.Error(codes.Unavailable, "down")
+
+	// under MinRequests the failures do not trip the breaker
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, unavailable, call(context.Background(), testMethod, nil, nil, nil, invokerOf(unavailable, 0)))
+	}
+	assert.Equal(t, BreakerClosed, b.State("test.Service"))
+	// errors which are not failures are counted in the total only
+	assert.Error(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(status.Error(codes.NotFound, ""), 0)))
+	assert.Equal(t, BreakerOpen, b.State("test.Service"))
+
+	invoked := false
+	err := call(context.Background(), testMethod, nil, nil, nil, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		invoked = true
+		return nil
+	})
+	assert.Equal(t, ErrBreakerOpen, err)
+	assert.False(t, invoked)
+
+	// a failed probe opens it again
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, b.State("test.Service"))
+	assert.Equal(t, unavailable, call(context.Background(), testMethod, nil, nil, nil, invokerOf(unavailable, 0)))
+	assert.Equal(t, BreakerOpen, b.State("test.Service"))
+
+	// it closes after HalfOpenRequests successful probes
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.Equal(t, BreakerHalfOpen, b.State("test.Service"))
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.Equal(t, BreakerClosed, b.State("test.Service"))
+
+	assert.Equal(t, []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}, changes)
+}
+
+func TestBreakerHalfOpenProbes(t *testing.T) {
+	b := NewBreakers(BreakerConfig{MinRequests: 1, OpenTimeout: 10 * time.Millisecond})
+	br := b.get(testMethod)
+	assert.True(t, br.allow())
+	br.record(status.Error(codes.Internal, ""), 0)
+	time.Sleep(20 * time.Millisecond)
+
+	// a single probe is let through at once
+	assert.True(t, br.allow())
+	assert.False(t, br.allow())
+	// a canceled probe frees its turn
+	br.record(status.Error(codes.Canceled, ""), 0)
+	assert.True(t, br.allow())
+	br.record(nil, 0)
+	assert.Equal(t, BreakerClosed, b.State("test.Service"))
+}
+
+func TestBreakerSlowCalls(t *testing.T) {
+	b := NewBreakers(BreakerConfig{MinRequests: 2, SlowCall: 10 * time.Millisecond, SlowCallRate: 1})
+	call := b.UnaryClientInterceptor()
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 15*time.Millisecond)))
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.Equal(t, BreakerClosed, b.State("test.Service"))
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 15*time.Millisecond)))
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 15*time.Millisecond)))
+	assert.Equal(t, BreakerClosed, b.State("test.Service"))
+
+	b = NewBreakers(BreakerConfig{MinRequests: 2, SlowCall: 10 * time.Millisecond, SlowCallRate: 1})
+	call = b.UnaryClientInterceptor()
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 15*time.Millisecond)))
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 15*time.Millisecond)))
+	assert.Equal(t, BreakerOpen, b.State("test.Service"))
+}
+
+func TestBreakerPerMethodAndBypass(t *testing.T) {
+	b := NewBreakers(BreakerConfig{PerMethod: true, MinRequests: 1})
+	call := b.UnaryClientInterceptor()
+	unavailable := status.Error(codes.Unavailable, "down")
+	assert.Equal(t, unavailable, call(context.Background(), testMethod, nil, nil, nil, invokerOf(unavailable, 0)))
+	assert.Equal(t, BreakerOpen, b.State(testMethod))
+	assert.NoError(t, call(context.Background(), "/test.Service/Put", nil, nil, nil, invokerOf(nil, 0)))
+
+	// health probes and hedged duplicates are not rejected nor counted
+	assert.NoError(t, call(context.WithValue(context.Background(), probeKey{}, true), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.NoError(t, call(context.WithValue(context.Background(), hedgeKey{}, true), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.Equal(t, BreakerOpen, b.State(testMethod))
+}
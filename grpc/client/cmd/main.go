@@ -0,0 +1,230 @@
+// Command grpcall lists, describes and calls the services of a gRPC server with server reflection,
+// the requests and replies are JSON:
+//
+//	go run ./client/cmd -addr 127.0.0.1:6868 list
+//	go run ./client/cmd -addr 127.0.0.1:6868 describe hello.HelloServer
+//	go run ./client/cmd -addr 127.0.0.1:6868 -H "x-user: ops" -d '{"name": "a"}' invoke hello.HelloServer/SayHello
+//
+// -d @ reads the requests from stdin, a client streaming method takes several JSON objects in a row
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"grpc/client"
+)
+
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headerFlag) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return fmt.Errorf("header %q is not key: value", s)
+	}
+	h[strings.TrimSpace(s[:i])] = strings.TrimSpace(s[i+1:])
+	return nil
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:6868", "address of the server")
+	data := flag.String("d", "{}", "JSON request, @ reads the requests from stdin")
+	timeout := flag.Duration("timeout", 10*time.Second, "timeout of the command")
+	key := flag.String("key", "", "client key for mutual TLS")
+	cert := flag.String("cert", "", "client certificate for mutual TLS")
+	ca := flag.String("ca", "", "CA certificate for mutual TLS")
+	serverName := flag.String("servername", "", "server name for mutual TLS")
+	headers := headerFlag{}
+	flag.Var(headers, "H", "request header as \"key: value\", may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] list | describe [symbol] | invoke method\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cmd, symbol := flag.Arg(0), flag.Arg(1)
+	if cmd == "" || cmd == "invoke" && symbol == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sc := client.NewServiceClientPool(&client.Option{PoolSize: 1})
+	if *ca != "" {
+		sc.SetTLS(*key, *cert, *ca, *serverName)
+	}
+	// list and describe only talk to the reflection service, a symbol is not always a service
+	services := []string{client.ReflectionService}
+	if cmd == "invoke" {
+		services = append(services, serviceOf(symbol))
+	}
+	sc.SetServices(*addr, services...)
+	if err := sc.Start(); err != nil {
+		fail(err)
+	}
+	defer sc.CloseAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	dc := client.NewDynamicClient(sc)
+	var err error
+	switch cmd {
+	case "list":
+		err = list(ctx, dc)
+	case "describe":
+		err = describe(ctx, dc, symbol)
+	case "invoke":
+		err = invoke(ctx, dc, symbol, headers, *data)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// serviceOf gets the service of a symbol, the symbol itself when it is not a method
+func serviceOf(symbol string) string {
+	symbol = strings.TrimPrefix(symbol, "/")
+	if i := strings.IndexByte(symbol, '/'); i >= 0 {
+		return symbol[:i]
+	}
+	return symbol
+}
+
+func list(ctx context.Context, dc *client.DynamicClient) error {
+	services, err := dc.ListServices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range services {
+		fmt.Println(s)
+	}
+	return nil
+}
+
+func describe(ctx context.Context, dc *client.DynamicClient, symbol string) error {
+	symbols := []string{strings.Replace(strings.TrimPrefix(symbol, "/"), "/", ".", 1)}
+	if symbol == "" {
+		services, err := dc.ListServices(ctx)
+		if err != nil {
+			return err
+		}
+		symbols = services
+	}
+	for i, s := range symbols {
+		desc, err := dc.Describe(ctx, s)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Print(format(desc))
+	}
+	return nil
+}
+
+func invoke(ctx context.Context, dc *client.DynamicClient, method string, headers map[string]string, data string) error {
+	var in io.Reader = strings.NewReader(data)
+	if data == "@" {
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		in = bytes.NewReader(b)
+	}
+	var requests [][]byte
+	dec := json.NewDecoder(in)
+	for {
+		var msg json.RawMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("parse requests: %w", err)
+		}
+		requests = append(requests, msg)
+	}
+	return dc.Call(ctx, method, headers, requests, func(reply []byte) error {
+		_, err := fmt.Printf("%s\n", reply)
+		return err
+	})
+}
+
+// format renders a descriptor the way it is declared in a .proto file
+func format(desc protoreflect.Descriptor) string {
+	var b strings.Builder
+	switch d := desc.(type) {
+	case protoreflect.ServiceDescriptor:
+		fmt.Fprintf(&b, "service %s {\n", d.FullName())
+		for i := 0; i < d.Methods().Len(); i++ {
+			fmt.Fprintf(&b, "  %s\n", formatMethod(d.Methods().Get(i)))
+		}
+		b.WriteString("}\n")
+	case protoreflect.MethodDescriptor:
+		fmt.Fprintf(&b, "%s\n", formatMethod(d))
+	case protoreflect.MessageDescriptor:
+		fmt.Fprintf(&b, "message %s {\n", d.FullName())
+		for i := 0; i < d.Fields().Len(); i++ {
+			f := d.Fields().Get(i)
+			fmt.Fprintf(&b, "  %s %s = %d;\n", formatType(f), f.Name(), f.Number())
+		}
+		b.WriteString("}\n")
+	case protoreflect.EnumDescriptor:
+		fmt.Fprintf(&b, "enum %s {\n", d.FullName())
+		for i := 0; i < d.Values().Len(); i++ {
+			v := d.Values().Get(i)
+			fmt.Fprintf(&b, "  %s = %d;\n", v.Name(), v.Number())
+		}
+		b.WriteString("}\n")
+	default:
+		fmt.Fprintf(&b, "%s\n", desc.FullName())
+	}
+	return b.String()
+}
+
+func formatMethod(m protoreflect.MethodDescriptor) string {
+	in, out := "", ""
+	if m.IsStreamingClient() {
+		in = "stream "
+	}
+	if m.IsStreamingServer() {
+		out = "stream "
+	}
+	return fmt.Sprintf("rpc %s(%s.%s) returns (%s.%s);", m.Name(), in, m.Input().FullName(), out, m.Output().FullName())
+}
+
+func formatType(f protoreflect.FieldDescriptor) string {
+	if f.IsMap() {
+		return fmt.Sprintf("map<%s, %s>", formatType(f.MapKey()), formatType(f.MapValue()))
+	}
+	name := f.Kind().String()
+	switch f.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		name = "." + string(f.Message().FullName())
+	case protoreflect.EnumKind:
+		name = "." + string(f.Enum().FullName())
+	}
+	if f.Cardinality() == protoreflect.Repeated {
+		return "repeated " + name
+	}
+	return name
+}
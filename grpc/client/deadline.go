@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrDeadlineBudget is returned by the calls whose remaining deadline is too short to be worth sending
+var ErrDeadlineBudget = status.Error(codes.DeadlineExceeded, "deadline budget exhausted")
+
+// DeadlineConfig sets the deadlines of the outgoing calls. A call without a deadline gets the timeout
+// of its method, of its service or the default one. A call with a deadline, typically made with the
+// context of an incoming call, gets Ratio of the remaining budget minus Reserve, so every hop keeps
+// time to handle the failure of the next one
+type DeadlineConfig struct {
+	// Default timeout of the calls without deadline, 0 leaves them without one
+	Default time.Duration
+	// Reserve is kept from the remaining budget for the caller
+	Reserve time.Duration
+	// Ratio in (0, 1] of the remaining budget given to the call, 1 by default
+	Ratio float64
+	// MinBudget fails the calls left with less time at once with ErrDeadlineBudget
+	MinBudget time.Duration
+}
+
+// Deadlines sets the deadlines of the outgoing calls:
+//
+//	deadlines := client.NewDeadlines(client.DeadlineConfig{Default: time.Second, Reserve: 10 * time.Millisecond})
+//	deadlines.SetTimeout("/package.Service/Report", 5*time.Second)
+//	sc.SetUnaryInterceptors(deadlines.UnaryClientInterceptor(), hedger.UnaryClientInterceptor())
+type Deadlines struct {
+	config   DeadlineConfig
+	mu       sync.RWMutex
+	timeouts map[string]time.Duration
+}
+
+func NewDeadlines(config DeadlineConfig) *Deadlines {
+	if config.Ratio <= 0 || config.Ratio > 1 {
+		config.Ratio = 1
+	}
+	return &Deadlines{config: config, timeouts: make(map[string]time.Duration)}
+}
+
+// SetTimeout sets the timeout of a service like "package.Service" or of a full method like
+// "/package.Service/Method", it caps the remaining budget too
+func (d *Deadlines) SetTimeout(name string, timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.timeouts[name] = timeout
+}
+
+func (d *Deadlines) timeout(method string) (time.Duration, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if t, ok := d.timeouts[method]; ok {
+		return t, true
+	}
+	t, ok := d.timeouts[serviceOf(method)]
+	return t, ok
+}
+
+// withDeadline derives the context of an outgoing call, cancel is nil when ctx is kept
+func (d *Deadlines) withDeadline(ctx context.Context, method string) (context.Context, context.CancelFunc, error) {
+	timeout, set := d.timeout(method)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		if !set {
+			timeout = d.config.Default
+		}
+		if timeout <= 0 {
+			return ctx, nil, nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		return ctx, cancel, nil
+	}
+
+	budget := time.Duration(float64(time.Until(deadline))*d.config.Ratio) - d.config.Reserve
+	if set && timeout > 0 && timeout < budget {
+		budget = timeout
+	}
+	if budget <= 0 || budget < d.config.MinBudget {
+		return nil, nil, ErrDeadlineBudget
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	return ctx, cancel, nil
+}
+
+// UnaryClientInterceptor sets the deadline of the unary calls
+func (d *Deadlines) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if IsHealthProbe(ctx) || isHedged(ctx) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		ctx, cancel, err := d.withDeadline(ctx, method)
+		if err != nil {
+			return err
+		}
+		if cancel != nil {
+			defer cancel()
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor shrinks the deadline of the streams made with one, the default timeouts
+// only apply to the streams of a method or service set with SetTimeout
+func (d *Deadlines) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			if _, set := d.timeout(method); !set {
+				return streamer(ctx, desc, cc, method, opts...)
+			}
+		}
+		ctx, cancel, err := d.withDeadline(ctx, method)
+		if err != nil {
+			return nil, err
+		}
+		if cancel == nil {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		return newTrackedStream(ctx, cs, desc, func(error) { cancel() }), nil
+	}
+}
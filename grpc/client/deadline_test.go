@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// remaining gets the time left before the deadline of ctx
+func remaining(t *testing.T, ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	return time.Until(deadline)
+}
+
+func TestDeadlineWithoutOne(t *testing.T) {
+	d := NewDeadlines(DeadlineConfig{})
+	ctx, cancel, err := d.withDeadline(context.Background(), testMethod)
+	assert.NoError(t, err)
+	assert.Nil(t, cancel)
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+
+	d = NewDeadlines(DeadlineConfig{Default: time.Second})
+	d.SetTimeout("test.Service", 2*time.Second)
+	d.SetTimeout(testMethod, 3*time.Second)
+	for method, want := range map[string]time.Duration{
+		testMethod:             3 * time.Second,
+		"/test.Service/Put":    2 * time.Second,
+		"/other.Service/Query": time.Second,
+	} {
+		ctx, cancel, err := d.withDeadline(context.Background(), method)
+		assert.NoError(t, err)
+		assert.InDelta(t, want, remaining(t, ctx), float64(50*time.Millisecond), method)
+		cancel()
+	}
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	d := NewDeadlines(DeadlineConfig{Ratio: 0.5, Reserve: 100 * time.Millisecond})
+	parent, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// half of the second left, minus the reserve
+	ctx, cancelCall, err := d.withDeadline(parent, testMethod)
+	assert.NoError(t, err)
+	assert.InDelta(t, 400*time.Millisecond, remaining(t, ctx), float64(50*time.Millisecond))
+	cancelCall()
+
+	// a shorter timeout caps the budget, a longer one does not extend it
+	d.SetTimeout(testMethod, 200*time.Millisecond)
+	ctx, cancelCall, err = d.withDeadline(parent, testMethod)
+	assert.NoError(t, err)
+	assert.InDelta(t, 200*time.Millisecond, remaining(t, ctx), float64(50*time.Millisecond))
+	cancelCall()
+	d.SetTimeout(testMethod, time.Minute)
+	ctx, cancelCall, err = d.withDeadline(parent, testMethod)
+	assert.NoError(t, err)
+	assert.InDelta(t, 400*time.Millisecond, remaining(t, ctx), float64(50*time.Millisecond))
+	cancelCall()
+
+	// an invalid ratio takes the whole budget
+	assert.Equal(t, 1.0, NewDeadlines(DeadlineConfig{Ratio: 2}).config.Ratio)
+}
+
+func TestDeadlineBudgetExhausted(t *testing.T) {
+	d := NewDeadlines(DeadlineConfig{Reserve: 100 * time.Millisecond})
+	parent, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, _, err := d.withDeadline(parent, testMethod)
+	assert.Equal(t, ErrDeadlineBudget, err)
+
+	d = NewDeadlines(DeadlineConfig{MinBudget: 100 * time.Millisecond})
+	invoked := false
+	err = d.UnaryClientInterceptor()(parent, testMethod, nil, nil, nil, func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, ...grpc.CallOption) error {
+		invoked = true
+		return nil
+	})
+	assert.Equal(t, ErrDeadlineBudget, err)
+	assert.False(t, invoked)
+}
+
+func TestDeadlineInterceptor(t *testing.T) {
+	d := NewDeadlines(DeadlineConfig{Default: time.Second})
+	var left time.Duration
+	err := d.UnaryClientInterceptor()(context.Background(), testMethod, nil, nil, nil, func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		left = remaining(t, ctx)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Second, left, float64(50*time.Millisecond))
+
+	// the hedged duplicates keep the deadline of the call they duplicate
+	err = d.UnaryClientInterceptor()(context.WithValue(context.Background(), hedgeKey{}, true), testMethod, nil, nil, nil, func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		_, ok := ctx.Deadline()
+		assert.False(t, ok)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// the streams get a default deadline only from SetTimeout
+	_, err = d.StreamClientInterceptor()(context.Background(), &grpc.StreamDesc{}, nil, testMethod, func(ctx context.Context, _ *grpc.StreamDesc, _ *grpc.ClientConn, _ string, _ ...grpc.CallOption) (grpc.ClientStream, error) {
+		_, ok := ctx.Deadline()
+		assert.False(t, ok)
+		return nil, nil
+	})
+	assert.NoError(t, err)
+}
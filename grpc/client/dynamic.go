@@ -0,0 +1,287 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ReflectionService is the name of the server reflection service
+const ReflectionService = "grpc.reflection.v1alpha.ServerReflection"
+
+var (
+	ErrNotFoundSymbol = errors.New("symbol not found by server reflection")
+	ErrNotMethod      = errors.New("symbol is not a method")
+)
+
+// DynamicClient calls any method with JSON messages, the descriptors are fetched with server reflection.
+// ReflectionService must be mapped to the endpoint like the services called:
+//
+//	sc.SetServices("10.0.0.1:9000", client.ReflectionService, "package.Service")
+//	reply, err := client.NewDynamicClient(sc).Invoke(ctx, "package.Service/Method", nil, []byte(`{"id": 1}`))
+type DynamicClient struct {
+	sc    *ServiceClientPool
+	mu    sync.Mutex
+	files *protoregistry.Files
+}
+
+func NewDynamicClient(sc *ServiceClientPool) *DynamicClient {
+	return &DynamicClient{sc: sc, files: new(protoregistry.Files)}
+}
+
+// ListServices lists the services of the server, sorted by name
+func (d *DynamicClient) ListServices(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := d.reflect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := roundTrip(stream, &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		list = append(list, s.GetName())
+	}
+	sort.Strings(list)
+	return list, nil
+}
+
+// Describe gets the descriptor of a service, method, message or enum by its full name
+func (d *DynamicClient) Describe(ctx context.Context, symbol string) (protoreflect.Descriptor, error) {
+	symbol = strings.TrimPrefix(symbol, ".")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if desc, err := d.files.FindDescriptorByName(protoreflect.FullName(symbol)); err == nil {
+		return desc, nil
+	}
+
+	// a method is not a symbol of its own for the reflection service, fetch its service
+	parent := symbol
+	if i := strings.LastIndexByte(symbol, '.'); i > 0 {
+		parent = symbol[:i]
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := d.reflect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.load(stream, symbol); err != nil && parent != symbol {
+		err = d.load(stream, parent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	desc, err := d.files.FindDescriptorByName(protoreflect.FullName(symbol))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNotFoundSymbol, symbol)
+	}
+	return desc, nil
+}
+
+// Method gets the descriptor of a method like "package.Service/Method", "/package.Service/Method"
+// or "package.Service.Method"
+func (d *DynamicClient) Method(ctx context.Context, method string) (protoreflect.MethodDescriptor, error) {
+	name := strings.Replace(strings.TrimPrefix(method, "/"), "/", ".", 1)
+	desc, err := d.Describe(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	md, ok := desc.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotMethod, method)
+	}
+	return md, nil
+}
+
+// Invoke calls a unary method with a JSON request and returns the JSON reply
+func (d *DynamicClient) Invoke(ctx context.Context, method string, headers map[string]string, request []byte) ([]byte, error) {
+	var reply []byte
+	err := d.Call(ctx, method, headers, [][]byte{request}, func(b []byte) error {
+		reply = b
+		return nil
+	})
+	return reply, err
+}
+
+// Call calls a method of any kind with JSON requests, the client streaming methods get all of them,
+// the others exactly one. onReply is called with every JSON reply in order
+func (d *DynamicClient) Call(ctx context.Context, method string, headers map[string]string, requests [][]byte, onReply func([]byte) error) error {
+	md, err := d.Method(ctx, method)
+	if err != nil {
+		return err
+	}
+	if !md.IsStreamingClient() && len(requests) != 1 {
+		return fmt.Errorf("method %s takes a single request, got %d", md.FullName(), len(requests))
+	}
+	ins := make([]proto.Message, 0, len(requests))
+	for i, b := range requests {
+		in := dynamicpb.NewMessage(md.Input())
+		if err = protojson.Unmarshal(b, in); err != nil {
+			return fmt.Errorf("request %d as %s: %w", i, md.Input().FullName(), err)
+		}
+		ins = append(ins, in)
+	}
+	fullMethod := fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name())
+	marshal := protojson.MarshalOptions{Multiline: true}
+
+	if !md.IsStreamingClient() && !md.IsStreamingServer() {
+		out := dynamicpb.NewMessage(md.Output())
+		if err = d.sc.Invoke(ctx, fullMethod, headers, ins[0], out); err != nil {
+			return err
+		}
+		b, err := marshal.Marshal(out)
+		if err != nil {
+			return err
+		}
+		return onReply(b)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	desc := &grpc.StreamDesc{StreamName: string(md.Name()), ServerStreams: md.IsStreamingServer(), ClientStreams: md.IsStreamingClient()}
+	stream, err := d.sc.NewStream(ctx, fullMethod, headers, desc)
+	if err != nil {
+		return err
+	}
+	for _, in := range ins {
+		if err = stream.SendMsg(in); err != nil {
+			break
+		}
+	}
+	// io.EOF from SendMsg means the stream failed, its status comes with RecvMsg
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err = stream.CloseSend(); err != nil {
+		return err
+	}
+	for {
+		out := dynamicpb.NewMessage(md.Output())
+		if err = stream.RecvMsg(out); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b, err := marshal.Marshal(out)
+		if err != nil {
+			return err
+		}
+		if err = onReply(b); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *DynamicClient) reflect(ctx context.Context) (rpb.ServerReflection_ServerReflectionInfoClient, error) {
+	cc, err := d.sc.GetClient(ReflectionService)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ReflectionService, err)
+	}
+	return rpb.NewServerReflectionClient(cc).ServerReflectionInfo(ctx)
+}
+
+// load fetches the file defining a symbol and its dependencies, it is called with mu held
+func (d *DynamicClient) load(stream rpb.ServerReflection_ServerReflectionInfoClient, symbol string) error {
+	resp, err := roundTrip(stream, &rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: symbol},
+	})
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrNotFoundSymbol, symbol, err)
+	}
+	fetched, err := parseFiles(resp)
+	if err != nil {
+		return err
+	}
+	for _, fdp := range fetched {
+		if err = d.register(stream, fdp.GetName(), fetched); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// register builds a file after its dependencies, fetching those the server did not send yet
+func (d *DynamicClient) register(stream rpb.ServerReflection_ServerReflectionInfoClient, name string, fetched map[string]*descriptorpb.FileDescriptorProto) error {
+	if _, err := d.files.FindFileByPath(name); err == nil {
+		return nil
+	}
+	fdp, ok := fetched[name]
+	if !ok {
+		resp, err := roundTrip(stream, &rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+		})
+		if err != nil {
+			// well known types may be left out by the server
+			if fd, gerr := protoregistry.GlobalFiles.FindFileByPath(name); gerr == nil {
+				return d.files.RegisterFile(fd)
+			}
+			return fmt.Errorf("fetch %s: %w", name, err)
+		}
+		more, err := parseFiles(resp)
+		if err != nil {
+			return err
+		}
+		for n, f := range more {
+			fetched[n] = f
+		}
+		if fdp, ok = fetched[name]; !ok {
+			return fmt.Errorf("fetch %s: not in the reply", name)
+		}
+	}
+	for _, dep := range fdp.GetDependency() {
+		if err := d.register(stream, dep, fetched); err != nil {
+			return err
+		}
+	}
+	fd, err := protodesc.NewFile(fdp, d.files)
+	if err != nil {
+		return fmt.Errorf("build %s: %w", name, err)
+	}
+	return d.files.RegisterFile(fd)
+}
+
+func roundTrip(stream rpb.ServerReflection_ServerReflectionInfoClient, req *rpb.ServerReflectionRequest) (*rpb.ServerReflectionResponse, error) {
+	if err := stream.Send(req); err != nil {
+		return nil, err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, fmt.Errorf("reflection error %d: %s", e.GetErrorCode(), e.GetErrorMessage())
+	}
+	return resp, nil
+}
+
+func parseFiles(resp *rpb.ServerReflectionResponse) (map[string]*descriptorpb.FileDescriptorProto, error) {
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+		fdp := new(descriptorpb.FileDescriptorProto)
+		if err := proto.Unmarshal(b, fdp); err != nil {
+			return nil, fmt.Errorf("parse file descriptor: %w", err)
+		}
+		files[fdp.GetName()] = fdp
+	}
+	return files, nil
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// reflectedHealth answers Check with SERVING and streams Watch like countingHealth
+type reflectedHealth struct {
+	*countingHealth
+}
+
+func (reflectedHealth) Check(context.Context, *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+// newDynamicClient serves the health service with server reflection over bufconn
+func newDynamicClient(t *testing.T) *DynamicClient {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, reflectedHealth{&countingHealth{total: 3}})
+	reflection.Register(srv)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	sc := NewServiceClientPool(&Option{
+		DialOptions: []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		},
+	})
+	sc.SetServices("bufnet", ReflectionService, grpc_health_v1.Health_ServiceDesc.ServiceName)
+	assert.NoError(t, sc.Start())
+	t.Cleanup(sc.CloseAll)
+	return NewDynamicClient(sc)
+}
+
+func TestDynamicDescribe(t *testing.T) {
+	d := newDynamicClient(t)
+	ctx := context.Background()
+
+	list, err := d.ListServices(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"grpc.health.v1.Health", ReflectionService}, list)
+
+	for _, name := range []string{"grpc.health.v1.Health/Check", "/grpc.health.v1.Health/Check", "grpc.health.v1.Health.Check"} {
+		md, err := d.Method(ctx, name)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, protoreflect.FullName("grpc.health.v1.Health.Check"), md.FullName())
+			assert.Equal(t, protoreflect.FullName("grpc.health.v1.HealthCheckRequest"), md.Input().FullName())
+		}
+	}
+	md, err := d.Method(ctx, "grpc.health.v1.Health/Watch")
+	assert.NoError(t, err)
+	assert.True(t, md.IsStreamingServer())
+
+	desc, err := d.Describe(ctx, ".grpc.health.v1.HealthCheckResponse")
+	assert.NoError(t, err)
+	_, ok := desc.(protoreflect.MessageDescriptor)
+	assert.True(t, ok)
+	_, err = d.Method(ctx, "grpc.health.v1.HealthCheckResponse")
+	assert.True(t, errors.Is(err, ErrNotMethod))
+	_, err = d.Method(ctx, "grpc.health.v1.Health/Reset")
+	assert.True(t, errors.Is(err, ErrNotFoundSymbol))
+	_, err = d.Describe(ctx, "unknown.Service")
+	assert.True(t, errors.Is(err, ErrNotFoundSymbol))
+}
+
+func TestDynamicInvoke(t *testing.T) {
+	d := newDynamicClient(t)
+	ctx := context.Background()
+
+	reply, err := d.Invoke(ctx, "grpc.health.v1.Health/Check", nil, []byte(`{"service": "orders"}`))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"status": "SERVING"}`, string(reply))
+
+	// the server streams deliver every reply in order
+	var replies []string
+	err = d.Call(ctx, "grpc.health.v1.Health/Watch", nil, [][]byte{[]byte(`{"service": "1"}`)}, func(b []byte) error {
+		replies = append(replies, string(b))
+		return nil
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, replies, 2) {
+		assert.JSONEq(t, `{"status": "SERVING"}`, replies[0])
+		assert.JSONEq(t, `{"status": "NOT_SERVING"}`, replies[1])
+	}
+	stop := errors.New("stop")
+	err = d.Call(ctx, "grpc.health.v1.Health/Watch", nil, [][]byte{[]byte(`{"service": "0"}`)}, func([]byte) error { return stop })
+	assert.Equal(t, stop, err)
+
+	err = d.Call(ctx, "grpc.health.v1.Health/Watch", nil, [][]byte{[]byte(`{"service": "x"}`)}, func([]byte) error { return nil })
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = d.Invoke(ctx, "grpc.health.v1.Health/Check", nil, []byte(`{"name": "orders"}`))
+	assert.Error(t, err)
+	err = d.Call(ctx, "grpc.health.v1.Health/Check", nil, [][]byte{[]byte(`{}`), []byte(`{}`)}, func([]byte) error { return nil })
+	assert.Error(t, err)
+}
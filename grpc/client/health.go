@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultEjectAfter          = 3
+	defaultEjectDuration       = 30 * time.Second
+)
+
+// probeKey marks the health probes so they are not counted as calls
+type probeKey struct{}
+
+// IsHealthProbe reports whether the call is a health probe of the pool, the interceptors of this package
+// let the probes through untouched and custom ones should do the same, a probe is neither a call to
+// log, limit nor count in a breaker
+func IsHealthProbe(ctx context.Context) bool {
+	return ctx.Value(probeKey{}) != nil
+}
+
+// poolConn is a connection of the pool with its load and health
+type poolConn struct {
+	pool     *Pool
+	cc       *grpc.ClientConn
+	inflight int64
+	failures int32
+	ejected  int64
+}
+
+// load counts the calls in flight
+func (pc *poolConn) load() int64 {
+	return atomic.LoadInt64(&pc.inflight)
+}
+
+func (pc *poolConn) isEjected(now int64) bool {
+	return atomic.LoadInt64(&pc.ejected) > now
+}
+
+// succeed resets the failures and brings an ejected connection back
+func (pc *poolConn) succeed() {
+	atomic.StoreInt32(&pc.failures, 0)
+	atomic.StoreInt64(&pc.ejected, 0)
+}
+
+// fail counts a failure, the connection is ejected after EjectAfter of them in a row
+func (pc *poolConn) fail() {
+	opt := pc.pool.option
+	if atomic.AddInt32(&pc.failures, 1) < int32(opt.EjectAfter) {
+		return
+	}
+	atomic.StoreInt32(&pc.failures, 0)
+	atomic.StoreInt64(&pc.ejected, time.Now().Add(opt.EjectDuration).UnixNano())
+	log.Printf("eject grpc connection to %s for %v", pc.pool.endpoint, opt.EjectDuration)
+}
+
+// observe counts the outcome of a call, only an unavailable server counts as a failure
+func (pc *poolConn) observe(err error) {
+	switch status.Code(err) {
+	case codes.OK:
+		atomic.StoreInt32(&pc.failures, 0)
+	case codes.Unavailable:
+		pc.fail()
+	}
+}
+
+// trackUnary counts the unary calls in flight and their failures
+func (pc *poolConn) trackUnary(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if IsHealthProbe(ctx) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	atomic.AddInt64(&pc.inflight, 1)
+	defer atomic.AddInt64(&pc.inflight, -1)
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	pc.observe(err)
+	return err
+}
+
+// trackStream counts the streams in flight until their last message is received, their final status
+// counts towards the ejection like the one of a unary call
+func (pc *poolConn) trackStream(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	atomic.AddInt64(&pc.inflight, 1)
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		atomic.AddInt64(&pc.inflight, -1)
+		pc.observe(err)
+		return nil, err
+	}
+	return newTrackedStream(ctx, cs, desc, func(err error) {
+		atomic.AddInt64(&pc.inflight, -1)
+		pc.observe(err)
+	}), nil
+}
+
+// trackedStream calls done once with the final error of the stream, nil when it ends with io.EOF
+// or with its only reply, or the status of the context error when it is abandoned
+type trackedStream struct {
+	grpc.ClientStream
+	serverStreams bool
+	once          sync.Once
+	finished      chan struct{}
+	done          func(err error)
+}
+
+func newTrackedStream(ctx context.Context, cs grpc.ClientStream, desc *grpc.StreamDesc, done func(err error)) *trackedStream {
+	ts := &trackedStream{ClientStream: cs, serverStreams: desc.ServerStreams, finished: make(chan struct{}), done: done}
+	go func() {
+		select {
+		case <-ctx.Done():
+			ts.finish(status.FromContextError(ctx.Err()).Err())
+		case <-ts.finished:
+		}
+	}()
+	return ts
+}
+
+func (s *trackedStream) finish(err error) {
+	s.once.Do(func() {
+		s.done(err)
+		close(s.finished)
+	})
+}
+
+func (s *trackedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == io.EOF {
+		s.finish(nil)
+	} else if err != nil || !s.serverStreams {
+		s.finish(err)
+	}
+	return err
+}
+
+// healthCheck probes the connections of the pool until it is closed
+func (p *Pool) healthCheck() {
+	ticker := time.NewTicker(p.option.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.exit:
+			return
+		case <-ticker.C:
+		}
+
+		p.RLock()
+		conns := append([]*poolConn(nil), p.conns...)
+		p.RUnlock()
+		var wg sync.WaitGroup
+		for _, pc := range conns {
+			if pc == nil || pc.cc.GetState() == connectivity.Shutdown {
+				continue
+			}
+			wg.Add(1)
+			go func(pc *poolConn) {
+				defer wg.Done()
+				p.probe(pc)
+			}(pc)
+		}
+		wg.Wait()
+	}
+}
+
+// probe checks a connection with the grpc.health.v1 service, a server without it counts as healthy
+func (p *Pool) probe(pc *poolConn) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeKey{}, true), p.option.HealthCheckInterval)
+	defer cancel()
+	resp, err := grpc_health_v1.NewHealthClient(pc.cc).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: p.healthService})
+	switch {
+	case status.Code(err) == codes.Unimplemented:
+		pc.succeed()
+	case err != nil || resp.GetStatus() != grpc_health_v1.HealthCheckResponse_SERVING:
+		pc.fail()
+	default:
+		pc.succeed()
+	}
+}
@@ -0,0 +1,232 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// newTestPool creates a pool whose slots are filled with idle connections, nil loads leave a slot free
+func newTestPool(t *testing.T, option *Option, loads ...*int64) *Pool {
+	option.DialOptions = append(option.DialOptions, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	option.PoolSize = len(loads)
+	p := newClientPoolWithOption("passthrough:///test", option, "", "")
+	t.Cleanup(p.Close)
+	for i, load := range loads {
+		if load == nil {
+			continue
+		}
+		cc, err := grpc.Dial("passthrough:///test", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		assert.NoError(t, err)
+		p.conns[i] = &poolConn{pool: p, cc: cc, inflight: *load}
+	}
+	return p
+}
+
+func load(n int64) *int64 {
+	return &n
+}
+
+func TestPoolConnEjection(t *testing.T) {
+	p := newTestPool(t, &Option{EjectAfter: 2, EjectDuration: time.Minute}, load(0))
+	pc := p.conns[0]
+	now := time.Now().UnixNano()
+
+	pc.fail()
+	assert.False(t, pc.isEjected(now))
+	// a success in between resets the count
+	pc.observe(nil)
+	pc.fail()
+	assert.False(t, pc.isEjected(now))
+	// only an unavailable server counts
+	pc.observe(status.Error(codes.InvalidArgument, "bad"))
+	pc.observe(status.Error(codes.Unavailable, "down"))
+	assert.True(t, pc.isEjected(now))
+	assert.False(t, pc.isEjected(time.Now().Add(2*time.Minute).UnixNano()))
+
+	pc.succeed()
+	assert.False(t, pc.isEjected(now))
+}
+
+func TestPoolPickLeastLoaded(t *testing.T) {
+	p := newTestPool(t, &Option{EjectAfter: 1, EjectDuration: time.Minute}, load(2), load(1), load(3))
+	for i := 0; i < 3; i++ {
+		pc, err := p.pick(nil)
+		assert.NoError(t, err)
+		assert.Same(t, p.conns[1], pc)
+	}
+
+	// the ejected and excluded connections are skipped while others are left
+	p.conns[1].fail()
+	pc, _ := p.pick(nil)
+	assert.Same(t, p.conns[0], pc)
+	pc, _ = p.pick(p.conns[0].cc)
+	assert.Same(t, p.conns[2], pc)
+
+	// all ejected, the least loaded is still used
+	p.conns[0].fail()
+	p.conns[2].fail()
+	pc, _ = p.pick(nil)
+	assert.Same(t, p.conns[1], pc)
+}
+
+func TestPoolPickDialsWhenBusy(t *testing.T) {
+	p := newTestPool(t, &Option{}, load(1), nil)
+	pc, err := p.pick(nil)
+	assert.NoError(t, err)
+	assert.NotSame(t, p.conns[0], pc)
+	assert.Same(t, p.conns[1], pc)
+
+	// an idle connection is used before dialing
+	p = newTestPool(t, &Option{}, load(0), nil)
+	pc, err = p.pick(nil)
+	assert.NoError(t, err)
+	assert.Same(t, p.conns[0], pc)
+	assert.Nil(t, p.conns[1])
+
+	// a draining pool no longer dials
+	p = newTestPool(t, &Option{}, load(1), nil)
+	atomic.StoreInt32(&p.closing, 1)
+	pc, err = p.pick(nil)
+	assert.NoError(t, err)
+	assert.Same(t, p.conns[0], pc)
+	assert.Nil(t, p.conns[1])
+}
+
+func TestTrackUnarySkipsProbes(t *testing.T) {
+	p := newTestPool(t, &Option{EjectAfter: 1, EjectDuration: time.Minute}, load(0))
+	pc := p.conns[0]
+	unavailable := func(ctx context.Context, _ string, _, _ interface{}, _ *grpc.ClientConn, _ ...grpc.CallOption) error {
+		if IsHealthProbe(ctx) {
+			assert.Equal(t, int64(0), pc.load())
+		} else {
+			assert.Equal(t, int64(1), pc.load())
+		}
+		return status.Error(codes.Unavailable, "down")
+	}
+
+	probe := context.WithValue(context.Background(), probeKey{}, true)
+	assert.Error(t, pc.trackUnary(probe, healthCheck, nil, nil, nil, unavailable))
+	assert.False(t, pc.isEjected(time.Now().UnixNano()))
+
+	assert.Error(t, pc.trackUnary(context.Background(), healthCheck, nil, nil, nil, unavailable))
+	assert.Equal(t, int64(0), pc.load())
+	assert.True(t, pc.isEjected(time.Now().UnixNano()))
+}
+
+// testStream is a client stream receiving the errors in order
+type testStream struct {
+	grpc.ClientStream
+	errs []error
+}
+
+func (s *testStream) RecvMsg(m interface{}) error {
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func TestTrackStream(t *testing.T) {
+	p := newTestPool(t, &Option{EjectAfter: 1, EjectDuration: time.Minute}, load(0))
+	pc := p.conns[0]
+	streamer := func(errs ...error) grpc.Streamer {
+		return func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+			return &testStream{errs: errs}, nil
+		}
+	}
+	serverStreams := &grpc.StreamDesc{ServerStreams: true}
+
+	// a server stream is in flight until its end
+	cs, err := pc.trackStream(context.Background(), serverStreams, nil, healthCheck, streamer(nil, nil, io.EOF))
+	assert.NoError(t, err)
+	assert.NoError(t, cs.RecvMsg(nil))
+	assert.NoError(t, cs.RecvMsg(nil))
+	assert.Equal(t, int64(1), pc.load())
+	assert.Equal(t, io.EOF, cs.RecvMsg(nil))
+	assert.Equal(t, int64(0), pc.load())
+
+	// a client stream ends with its only reply
+	cs, err = pc.trackStream(context.Background(), &grpc.StreamDesc{ClientStreams: true}, nil, healthCheck, streamer(nil))
+	assert.NoError(t, err)
+	assert.NoError(t, cs.RecvMsg(nil))
+	assert.Equal(t, int64(0), pc.load())
+
+	// an abandoned stream ends with its context, which is not a failure of the server
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = pc.trackStream(ctx, serverStreams, nil, healthCheck, streamer())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), pc.load())
+	cancel()
+	assert.Eventually(t, func() bool { return pc.load() == 0 }, time.Second, 5*time.Millisecond)
+	assert.False(t, pc.isEjected(time.Now().UnixNano()))
+
+	// the final status counts like the one of a unary call
+	cs, err = pc.trackStream(context.Background(), serverStreams, nil, healthCheck, streamer(status.Error(codes.Unavailable, "down")))
+	assert.NoError(t, err)
+	assert.Error(t, cs.RecvMsg(nil))
+	assert.Equal(t, int64(0), pc.load())
+	assert.True(t, pc.isEjected(time.Now().UnixNano()))
+	pc.succeed()
+
+	_, err = pc.trackStream(context.Background(), serverStreams, nil, healthCheck, func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, ...grpc.CallOption) (grpc.ClientStream, error) {
+		return nil, status.Error(codes.Unavailable, "down")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, int64(0), pc.load())
+	assert.True(t, pc.isEjected(time.Now().UnixNano()))
+}
+
+func TestPoolHealthProbes(t *testing.T) {
+	var serving int32 = 1
+	h := &testHealth{check: func(int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		if atomic.LoadInt32(&serving) == 1 {
+			return reply(grpc_health_v1.HealthCheckResponse_SERVING, codes.OK, 0)
+		}
+		return reply(grpc_health_v1.HealthCheckResponse_NOT_SERVING, codes.OK, 0)
+	}}
+	l := serveHealth(t, h)
+	var calls int32
+	option := &Option{
+		PoolSize:            1,
+		HealthCheckInterval: 10 * time.Millisecond,
+		EjectAfter:          2,
+		EjectDuration:       time.Minute,
+		DialOptions: []grpc.DialOption{
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+			grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+				if !IsHealthProbe(ctx) {
+					atomic.AddInt32(&calls, 1)
+				}
+				return invoker(ctx, method, req, reply, cc, opts...)
+			}),
+		},
+	}
+	p := newClientPoolWithOption("bufnet", option, "", "orders")
+	defer p.Close()
+	pc, err := p.pick(nil)
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&h.calls) >= 2 }, time.Second, 5*time.Millisecond)
+	assert.False(t, pc.isEjected(time.Now().UnixNano()))
+
+	// NOT_SERVING ejects the connection, SERVING brings it back
+	atomic.StoreInt32(&serving, 0)
+	assert.Eventually(t, func() bool { return pc.isEjected(time.Now().UnixNano()) }, time.Second, 5*time.Millisecond)
+	atomic.StoreInt32(&serving, 1)
+	assert.Eventually(t, func() bool { return !pc.isEjected(time.Now().UnixNano()) }, time.Second, 5*time.Millisecond)
+
+	// the probes are neither in flight nor seen as calls
+	assert.Equal(t, int64(0), pc.load())
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,342 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+var (
+	defaultHedgeAttempts = 2
+	// hedgeSamples is the number of latencies the percentile is computed over
+	hedgeSamples = 512
+	// hedgeMinSamples are needed before the percentile is trusted
+	hedgeMinSamples = 20
+)
+
+// hedgeKey marks the duplicates of a hedged call so they are not hedged again, nor limited, counted
+// by a breaker or given a shorter deadline by the interceptors of this package
+type hedgeKey struct{}
+
+// isHedged reports whether the call is a duplicate sent by a Hedger
+func isHedged(ctx context.Context) bool {
+	return ctx.Value(hedgeKey{}) != nil
+}
+
+// HedgePolicy sends duplicates of a slow call and takes the first success. Only the methods declared
+// idempotent in their proto, with the idempotency_level option set to IDEMPOTENT or NO_SIDE_EFFECTS,
+// are hedged unless AssumeIdempotent is set
+type HedgePolicy struct {
+	// Delay before every duplicate, it is the fallback of Percentile until enough calls are observed
+	Delay time.Duration
+	// Percentile in (0, 1) of the latencies of the method used as delay, e.g. 0.95
+	Percentile float64
+	// MaxAttempts counts the original call, 2 by default
+	MaxAttempts int
+	// NonFatalCodes let the other attempts go on, another error ends the call. Unavailable by default
+	NonFatalCodes []codes.Code
+	// AssumeIdempotent hedges the methods whose descriptor is not registered or has no idempotency level,
+	// the caller vouches they can run more than once
+	AssumeIdempotent bool
+}
+
+// Hedger hedges the unary calls of the services and methods with a policy. A duplicate goes to
+// another connection of the service's pool, or to the same one when the pool has a single
+// connection, its balancer then picks the next endpoint of a resolved target:
+//
+//	hedger := client.NewHedger(sc)
+//	hedger.SetPolicy("/package.Service/Get", client.HedgePolicy{Percentile: 0.95})
+//	sc.SetUnaryInterceptors(deadlines.UnaryClientInterceptor(), breakers.UnaryClientInterceptor(), hedger.UnaryClientInterceptor())
+//
+// A duplicate is a call of its own on the other connection, it runs its whole interceptor chain again.
+// The Deadlines, Breakers and Limiters of this package let the duplicates through, so with the hedger
+// last in the chain they see the call once with the outcome of the winning attempt. Other interceptors
+// run for every attempt, e.g. a logging one logs each of them
+type Hedger struct {
+	sc         *ServiceClientPool
+	mu         sync.RWMutex
+	policies   map[string]HedgePolicy
+	latencies  map[string]*latencyWindow
+	idempotent map[string]bool
+}
+
+func NewHedger(sc *ServiceClientPool) *Hedger {
+	return &Hedger{
+		sc:         sc,
+		policies:   make(map[string]HedgePolicy),
+		latencies:  make(map[string]*latencyWindow),
+		idempotent: make(map[string]bool),
+	}
+}
+
+// SetPolicy hedges a service like "package.Service" or a full method like "/package.Service/Method",
+// the policy of a method takes precedence
+func (h *Hedger) SetPolicy(name string, policy HedgePolicy) {
+	if policy.MaxAttempts < 2 {
+		policy.MaxAttempts = defaultHedgeAttempts
+	}
+	if len(policy.NonFatalCodes) == 0 {
+		policy.NonFatalCodes = []codes.Code{codes.Unavailable}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.policies[name] = policy
+}
+
+// policy gets the policy of a method which may be hedged
+func (h *Hedger) policy(method string) (HedgePolicy, *latencyWindow, bool) {
+	h.mu.RLock()
+	p, ok := h.policies[method]
+	if !ok {
+		p, ok = h.policies[serviceOf(method)]
+	}
+	lw := h.latencies[method]
+	idempotent := h.idempotent[method]
+	h.mu.RUnlock()
+	if !ok {
+		return p, nil, false
+	}
+	if lw == nil {
+		idempotent = isIdempotent(method)
+		h.mu.Lock()
+		if lw = h.latencies[method]; lw == nil {
+			lw = &latencyWindow{samples: make([]time.Duration, 0, hedgeSamples)}
+			h.latencies[method] = lw
+			h.idempotent[method] = idempotent
+		}
+		h.mu.Unlock()
+	}
+	return p, lw, idempotent || p.AssumeIdempotent
+}
+
+// isIdempotent reports whether the registered descriptor of a method like "/package.Service/Method"
+// declares it idempotent
+func isIdempotent(method string) bool {
+	name := strings.Replace(strings.TrimPrefix(method, "/"), "/", ".", 1)
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return false
+	}
+	md, ok := desc.(protoreflect.MethodDescriptor)
+	if !ok {
+		return false
+	}
+	opts, ok := md.Options().(*descriptorpb.MethodOptions)
+	if !ok {
+		return false
+	}
+	switch opts.GetIdempotencyLevel() {
+	case descriptorpb.MethodOptions_IDEMPOTENT, descriptorpb.MethodOptions_NO_SIDE_EFFECTS:
+		return true
+	}
+	return false
+}
+
+type hedgeResult struct {
+	reply   proto.Message
+	outputs *callOutputs
+	err     error
+}
+
+// callOutputs are what an attempt reports through the grpc.Header, grpc.Trailer and grpc.Peer options,
+// the attempts run concurrently so each gets its own and only the returned one is handed to the caller
+type callOutputs struct {
+	header  metadata.MD
+	trailer metadata.MD
+	peer    peer.Peer
+}
+
+// splitOutputs separates the output options of the caller from the others
+func splitOutputs(opts []grpc.CallOption) (rest, outputs []grpc.CallOption) {
+	for _, o := range opts {
+		switch o.(type) {
+		case grpc.HeaderCallOption, grpc.TrailerCallOption, grpc.PeerCallOption:
+			outputs = append(outputs, o)
+		default:
+			rest = append(rest, o)
+		}
+	}
+	return rest, outputs
+}
+
+// options gets the options of an attempt writing into o
+func (o *callOutputs) options(rest []grpc.CallOption) []grpc.CallOption {
+	return append(rest[:len(rest):len(rest)], grpc.Header(&o.header), grpc.Trailer(&o.trailer), grpc.Peer(&o.peer))
+}
+
+// copyTo sets the values asked for by the output options of the caller
+func (o *callOutputs) copyTo(outputs []grpc.CallOption) {
+	for _, opt := range outputs {
+		switch opt := opt.(type) {
+		case grpc.HeaderCallOption:
+			*opt.HeaderAddr = o.header
+		case grpc.TrailerCallOption:
+			*opt.TrailerAddr = o.trailer
+		case grpc.PeerCallOption:
+			*opt.PeerAddr = o.peer
+		}
+	}
+}
+
+// UnaryClientInterceptor hedges the calls with a policy and a protobuf reply, the others go through
+func (h *Hedger) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		p, lw, ok := h.policy(method)
+		msg, isProto := reply.(proto.Message)
+		if !ok || !isProto || isHedged(ctx) || IsHealthProbe(ctx) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		delay := lw.delay(p)
+		if delay <= 0 {
+			start := time.Now()
+			err := invoker(ctx, method, req, reply, cc, opts...)
+			if err == nil {
+				lw.add(time.Since(start))
+			}
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		rest, outputs := splitOutputs(opts)
+		results := make(chan hedgeResult, p.MaxAttempts)
+		attempt := func(call func(reply proto.Message, opts []grpc.CallOption) error) {
+			r := proto.Clone(msg)
+			proto.Reset(r)
+			out := &callOutputs{}
+			start := time.Now()
+			err := call(r, out.options(rest))
+			if err == nil {
+				lw.add(time.Since(start))
+			}
+			results <- hedgeResult{reply: r, outputs: out, err: err}
+		}
+		go attempt(func(r proto.Message, opts []grpc.CallOption) error {
+			return invoker(ctx, method, req, r, cc, opts...)
+		})
+		launched, pending := 1, 1
+		hedge := func() {
+			other, err := h.sc.otherConn(method, cc)
+			if err != nil {
+				return
+			}
+			launched++
+			pending++
+			go attempt(func(r proto.Message, opts []grpc.CallOption) error {
+				return other.Invoke(context.WithValue(ctx, hedgeKey{}, true), method, req, r, opts...)
+			})
+		}
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		var err error
+		var failed *callOutputs
+		for pending > 0 {
+			select {
+			case res := <-results:
+				pending--
+				if res.err == nil {
+					proto.Reset(msg)
+					proto.Merge(msg, res.reply)
+					res.outputs.copyTo(outputs)
+					return nil
+				}
+				err, failed = res.err, res.outputs
+				if !nonFatal(p.NonFatalCodes, err) {
+					failed.copyTo(outputs)
+					return err
+				}
+				// an attempt failed fast, the next one need not wait
+				if launched < p.MaxAttempts {
+					hedge()
+				}
+			case <-timer.C:
+				if launched < p.MaxAttempts {
+					hedge()
+					timer.Reset(delay)
+				}
+			}
+		}
+		failed.copyTo(outputs)
+		return err
+	}
+}
+
+func nonFatal(list []codes.Code, err error) bool {
+	c := status.Code(err)
+	for _, code := range list {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// otherConn gets a connection of the pool of the method other than cc, cc when it is the only one
+func (sc *ServiceClientPool) otherConn(method string, cc *grpc.ClientConn) (*grpc.ClientConn, error) {
+	sc.mu.RLock()
+	p, ok := sc.clients[serviceOf(method)]
+	sc.mu.RUnlock()
+	if !ok {
+		return cc, nil
+	}
+	pc, err := p.pick(cc)
+	if err != nil {
+		return nil, err
+	}
+	return pc.cc, nil
+}
+
+// latencyWindow keeps the latest latencies of the successful calls of a method
+type latencyWindow struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+	// cached percentile, recomputed every hedgeMinSamples calls
+	percentile float64
+	value      time.Duration
+	stale      int
+}
+
+func (lw *latencyWindow) add(d time.Duration) {
+	lw.Lock()
+	defer lw.Unlock()
+	if len(lw.samples) < cap(lw.samples) {
+		lw.samples = append(lw.samples, d)
+	} else {
+		lw.samples[lw.next] = d
+		lw.next = (lw.next + 1) % len(lw.samples)
+	}
+	lw.stale++
+}
+
+// delay gets the hedging delay of the policy, 0 does not hedge
+func (lw *latencyWindow) delay(p HedgePolicy) time.Duration {
+	if p.Percentile <= 0 || p.Percentile >= 1 {
+		return p.Delay
+	}
+	lw.Lock()
+	defer lw.Unlock()
+	if len(lw.samples) < hedgeMinSamples {
+		return p.Delay
+	}
+	if lw.value == 0 || lw.percentile != p.Percentile || lw.stale >= hedgeMinSamples {
+		sorted := append([]time.Duration(nil), lw.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		lw.value = sorted[int(p.Percentile*float64(len(sorted)-1))]
+		lw.percentile, lw.stale = p.Percentile, 0
+	}
+	return lw.value
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const healthCheck = "/grpc.health.v1.Health/Check"
+
+// testHealth answers the nth call, from 1, with check, n is sent in the "attempt" header and trailer
+type testHealth struct {
+	grpc_health_v1.UnimplementedHealthServer
+	calls int32
+	check func(n int32) (*grpc_health_v1.HealthCheckResponse, error)
+}
+
+func (h *testHealth) Check(ctx context.Context, _ *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	n := atomic.AddInt32(&h.calls, 1)
+	md := metadata.Pairs("attempt", strconv.Itoa(int(n)))
+	grpc.SetHeader(ctx, md)
+	grpc.SetTrailer(ctx, md)
+	return h.check(n)
+}
+
+// reply answers with status after delay, or fails with code
+func reply(s grpc_health_v1.HealthCheckResponse_ServingStatus, c codes.Code, delay time.Duration) (*grpc_health_v1.HealthCheckResponse, error) {
+	time.Sleep(delay)
+	if c != codes.OK {
+		return nil, status.Error(c, c.String())
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: s}, nil
+}
+
+// newHedgedHealth serves h over bufconn and gets a client hedging its calls with policy
+func newHedgedHealth(t *testing.T, h *testHealth, policy HedgePolicy) grpc_health_v1.HealthClient {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, h)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	hedger := NewHedger(NewServiceClientPool(&Option{}))
+	hedger.SetPolicy("grpc.health.v1.Health", policy)
+	cc, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(hedger.UnaryClientInterceptor()))
+	assert.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+	return grpc_health_v1.NewHealthClient(cc)
+}
+
+func TestHedgeFirstSuccessWins(t *testing.T) {
+	h := &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		if n == 1 {
+			return reply(grpc_health_v1.HealthCheckResponse_SERVING, codes.OK, 300*time.Millisecond)
+		}
+		return reply(grpc_health_v1.HealthCheckResponse_NOT_SERVING, codes.OK, 0)
+	}}
+	client := newHedgedHealth(t, h, HedgePolicy{Delay: 20 * time.Millisecond, AssumeIdempotent: true})
+
+	start := time.Now()
+	resp, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, resp.Status)
+	assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&h.calls))
+}
+
+func TestHedgeCallOutputs(t *testing.T) {
+	h := &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		if n == 1 {
+			return reply(grpc_health_v1.HealthCheckResponse_SERVING, codes.OK, 200*time.Millisecond)
+		}
+		return reply(grpc_health_v1.HealthCheckResponse_NOT_SERVING, codes.OK, 0)
+	}}
+	client := newHedgedHealth(t, h, HedgePolicy{Delay: 20 * time.Millisecond, AssumeIdempotent: true})
+
+	// the caller gets the header, trailer and peer of the winning attempt only
+	var header, trailer metadata.MD
+	var p peer.Peer
+	_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&header), grpc.Trailer(&trailer), grpc.Peer(&p))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2"}, header.Get("attempt"))
+	assert.Equal(t, []string{"2"}, trailer.Get("attempt"))
+	assert.NotNil(t, p.Addr)
+	// the losing attempt ends meanwhile without writing into them
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, []string{"2"}, header.Get("attempt"))
+
+	// a failed call reports the outputs of the attempt it returns
+	h = &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		return reply(0, codes.InvalidArgument, 0)
+	}}
+	client = newHedgedHealth(t, h, HedgePolicy{Delay: 50 * time.Millisecond, AssumeIdempotent: true})
+	_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Equal(t, []string{"1"}, trailer.Get("attempt"))
+}
+
+func TestHedgeMaxAttempts(t *testing.T) {
+	h := &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		return reply(grpc_health_v1.HealthCheckResponse_SERVING, codes.OK, 100*time.Millisecond)
+	}}
+	client := newHedgedHealth(t, h, HedgePolicy{Delay: 10 * time.Millisecond, MaxAttempts: 3, AssumeIdempotent: true})
+	_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&h.calls))
+}
+
+func TestHedgeNonFatalCode(t *testing.T) {
+	h := &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		if n == 1 {
+			return reply(0, codes.Unavailable, 0)
+		}
+		return reply(grpc_health_v1.HealthCheckResponse_SERVING, codes.OK, 0)
+	}}
+	client := newHedgedHealth(t, h, HedgePolicy{Delay: time.Second, AssumeIdempotent: true})
+
+	// the failed attempt launches the next one without waiting for the delay
+	start := time.Now()
+	resp, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+	assert.Less(t, int64(time.Since(start)), int64(500*time.Millisecond))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&h.calls))
+}
+
+func TestHedgeFatalCode(t *testing.T) {
+	h := &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		return reply(0, codes.InvalidArgument, 0)
+	}}
+	client := newHedgedHealth(t, h, HedgePolicy{Delay: 50 * time.Millisecond, AssumeIdempotent: true})
+
+	_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&h.calls))
+}
+
+func TestHedgeAllAttemptsFail(t *testing.T) {
+	h := &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		return reply(0, codes.Unavailable, 0)
+	}}
+	client := newHedgedHealth(t, h, HedgePolicy{Delay: time.Second, MaxAttempts: 3, AssumeIdempotent: true})
+
+	_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&h.calls))
+}
+
+func TestHedgeOnlyIdempotent(t *testing.T) {
+	h := &testHealth{check: func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		return reply(grpc_health_v1.HealthCheckResponse_SERVING, codes.OK, 50*time.Millisecond)
+	}}
+	// Check has no idempotency level in its proto
+	assert.False(t, isIdempotent(healthCheck))
+	client := newHedgedHealth(t, h, HedgePolicy{Delay: 10 * time.Millisecond})
+
+	_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&h.calls))
+}
+
+func TestHedgeLatencyPercentile(t *testing.T) {
+	lw := &latencyWindow{samples: make([]time.Duration, 0, hedgeSamples)}
+	p := HedgePolicy{Delay: time.Second, Percentile: 0.9}
+	for i := 1; i < hedgeMinSamples; i++ {
+		lw.add(time.Duration(i) * time.Millisecond)
+	}
+	// the delay is the fallback until enough calls are observed
+	assert.Equal(t, time.Second, lw.delay(p))
+	lw.add(time.Duration(hedgeMinSamples) * time.Millisecond)
+	assert.Equal(t, 18*time.Millisecond, lw.delay(p))
+	assert.Equal(t, 10*time.Millisecond, lw.delay(HedgePolicy{Percentile: 0.5}))
+	assert.Equal(t, time.Second, lw.delay(HedgePolicy{Delay: time.Second}))
+}
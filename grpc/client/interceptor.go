@@ -13,6 +13,9 @@ import (
 )
 
 func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if IsHealthProbe(ctx) {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
 	traceID := uuid.New().String()
 	log.Printf("before invoker. method: %+v, request:%+v, trace_id: %v", method, req, traceID)
 	var header, trailer metadata.MD
@@ -0,0 +1,323 @@
+package client
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrRateLimited is returned by the calls over the QPS limit
+	ErrRateLimited = status.Error(codes.ResourceExhausted, "client rate limit exceeded")
+	// ErrConcurrencyLimited is returned by the calls over the in-flight limit
+	ErrConcurrencyLimited = status.Error(codes.ResourceExhausted, "client concurrency limit exceeded")
+
+	defaultAdaptiveMinLimit     = 1
+	defaultAdaptiveInitialLimit = 20
+	defaultAdaptiveMaxLimit     = 1000
+	defaultAdaptiveTolerance    = 2.0
+	defaultAdaptiveBackoff      = 0.9
+	defaultAdaptiveWindow       = 10 * time.Second
+)
+
+// Limit bounds the calls of a service or of a method, the zero values are unlimited
+type Limit struct {
+	// QPS is the rate of the token bucket
+	QPS float64
+	// Burst is the size of the token bucket, at least 1 and QPS by default
+	Burst int
+	// MaxInFlight is the number of calls running at once, the upper bound of an adaptive limit
+	MaxInFlight int
+	// Adaptive adjusts the in-flight limit from the observed latency, nil keeps it at MaxInFlight
+	Adaptive *AdaptiveLimit
+	// Wait makes the calls over the limit wait for their turn until their deadline instead of failing
+	Wait bool
+}
+
+// AdaptiveLimit is an AIMD concurrency limit: it grows by one every limit calls while the latency
+// stays under Tolerance times the lowest latency of the last Window, and shrinks by Backoff when it
+// goes over or when a call fails with Unavailable, DeadlineExceeded or ResourceExhausted
+type AdaptiveLimit struct {
+	MinLimit     int
+	InitialLimit int
+	// MaxLimit defaults to Limit.MaxInFlight, or to 1000 without it
+	MaxLimit  int
+	Tolerance float64
+	Backoff   float64
+	Window    time.Duration
+}
+
+// Limiters holds the limits of the services and methods, a call goes through the limit of its
+// method and the one of its service. Set them along the other interceptors:
+//
+//	sc.SetUnaryInterceptors(breakers.UnaryClientInterceptor(), limiters.UnaryClientInterceptor())
+type Limiters struct {
+	mu       sync.RWMutex
+	limiters map[string]*limiter
+}
+
+func NewLimiters() *Limiters {
+	return &Limiters{limiters: make(map[string]*limiter)}
+}
+
+// SetServiceLimit limits the calls of a service like "package.Service", it resets its state
+func (l *Limiters) SetServiceLimit(service string, limit Limit) {
+	l.set(service, limit)
+}
+
+// SetMethodLimit limits the calls of a full method like "/package.Service/Method", it resets its state
+func (l *Limiters) SetMethodLimit(fullMethod string, limit Limit) {
+	l.set(fullMethod, limit)
+}
+
+func (l *Limiters) set(name string, limit Limit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limiters[name] = newLimiter(limit)
+}
+
+// ConcurrencyLimit gets the in-flight limit of a service or of a full method, 0 is unlimited
+func (l *Limiters) ConcurrencyLimit(name string) int {
+	l.mu.RLock()
+	lim, ok := l.limiters[name]
+	l.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	return lim.capacity()
+}
+
+// UnaryClientInterceptor applies the limits to the unary calls, their latency feeds the adaptive limits
+func (l *Limiters) UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if IsHealthProbe(ctx) || isHedged(ctx) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		release, err := l.acquire(ctx, method)
+		if err != nil {
+			return err
+		}
+		start := time.Now()
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		release(err, time.Since(start))
+		return err
+	}
+}
+
+// StreamClientInterceptor applies the limits to the streams, a stream is in flight until its last message
+func (l *Limiters) StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		release, err := l.acquire(ctx, method)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			release(err, 0)
+			return nil, err
+		}
+		return newTrackedStream(ctx, cs, desc, func(err error) {
+			release(err, 0)
+		}), nil
+	}
+}
+
+// acquire takes a turn from the limiters of the method and of its service
+func (l *Limiters) acquire(ctx context.Context, method string) (release func(err error, latency time.Duration), err error) {
+	l.mu.RLock()
+	byMethod := l.limiters[method]
+	byService := l.limiters[serviceOf(method)]
+	l.mu.RUnlock()
+
+	var taken []*limiter
+	for _, lim := range []*limiter{byMethod, byService} {
+		if lim == nil {
+			continue
+		}
+		if err = lim.acquire(ctx); err != nil {
+			for _, t := range taken {
+				t.release(nil, 0, false)
+			}
+			return nil, err
+		}
+		taken = append(taken, lim)
+	}
+	return func(err error, latency time.Duration) {
+		for _, t := range taken {
+			t.release(err, latency, latency > 0)
+		}
+	}, nil
+}
+
+type limiter struct {
+	limit Limit
+
+	mu sync.Mutex
+	// token bucket
+	tokens float64
+	last   time.Time
+	// in flight, changed is closed and replaced every time a call is released
+	inflight int
+	changed  chan struct{}
+	// adaptive limit and its latency baseline
+	adaptive  float64
+	baseline  time.Duration
+	windowMin time.Duration
+	windowEnd time.Time
+}
+
+func newLimiter(limit Limit) *limiter {
+	if limit.QPS > 0 && limit.Burst <= 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.QPS)))
+	}
+	lim := &limiter{changed: make(chan struct{}), last: time.Now()}
+	if a := limit.Adaptive; a != nil {
+		cfg := *a
+		if cfg.MinLimit <= 0 {
+			cfg.MinLimit = defaultAdaptiveMinLimit
+		}
+		if cfg.MaxLimit <= 0 {
+			cfg.MaxLimit = limit.MaxInFlight
+		}
+		if cfg.MaxLimit <= 0 {
+			cfg.MaxLimit = defaultAdaptiveMaxLimit
+		}
+		if cfg.InitialLimit <= 0 {
+			cfg.InitialLimit = defaultAdaptiveInitialLimit
+		}
+		if cfg.Tolerance <= 1 {
+			cfg.Tolerance = defaultAdaptiveTolerance
+		}
+		if cfg.Backoff <= 0 || cfg.Backoff >= 1 {
+			cfg.Backoff = defaultAdaptiveBackoff
+		}
+		if cfg.Window <= 0 {
+			cfg.Window = defaultAdaptiveWindow
+		}
+		limit.Adaptive = &cfg
+		lim.adaptive = math.Min(math.Max(float64(cfg.InitialLimit), float64(cfg.MinLimit)), float64(cfg.MaxLimit))
+	}
+	lim.limit = limit
+	lim.tokens = float64(limit.Burst)
+	return lim
+}
+
+// capacity gets the current in-flight limit, 0 is unlimited
+func (lim *limiter) capacity() int {
+	if lim.limit.Adaptive != nil {
+		return int(lim.adaptive)
+	}
+	return lim.limit.MaxInFlight
+}
+
+// acquire takes a token and an in-flight slot
+func (lim *limiter) acquire(ctx context.Context) error {
+	if err := lim.take(ctx); err != nil {
+		return err
+	}
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	for {
+		if c := lim.capacity(); c <= 0 || lim.inflight < c {
+			lim.inflight++
+			return nil
+		}
+		if !lim.limit.Wait {
+			return ErrConcurrencyLimited
+		}
+		changed := lim.changed
+		lim.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			lim.mu.Lock()
+			return status.FromContextError(ctx.Err()).Err()
+		case <-changed:
+		}
+		lim.mu.Lock()
+	}
+}
+
+// take takes a token from the bucket, waiting for it with Wait if the deadline leaves time
+func (lim *limiter) take(ctx context.Context) error {
+	if lim.limit.QPS <= 0 {
+		return nil
+	}
+	lim.mu.Lock()
+	now := time.Now()
+	lim.tokens = math.Min(float64(lim.limit.Burst), lim.tokens+now.Sub(lim.last).Seconds()*lim.limit.QPS)
+	lim.last = now
+	if lim.tokens >= 1 {
+		lim.tokens--
+		lim.mu.Unlock()
+		return nil
+	}
+	delay := time.Duration((1 - lim.tokens) / lim.limit.QPS * float64(time.Second))
+	if deadline, ok := ctx.Deadline(); !lim.limit.Wait || ok && deadline.Before(now.Add(delay)) {
+		lim.mu.Unlock()
+		return ErrRateLimited
+	}
+	// reserve the token now so the waiting calls queue up in order
+	lim.tokens--
+	lim.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		lim.mu.Lock()
+		lim.tokens++
+		lim.mu.Unlock()
+		return status.FromContextError(ctx.Err()).Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// release frees the in-flight slot of a call, sample feeds its outcome to the adaptive limit
+func (lim *limiter) release(err error, latency time.Duration, sample bool) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	inflight := lim.inflight
+	lim.inflight--
+	close(lim.changed)
+	lim.changed = make(chan struct{})
+	if sample && lim.limit.Adaptive != nil && status.Code(err) != codes.Canceled {
+		lim.observe(err, latency, inflight)
+	}
+}
+
+// observe adjusts the adaptive limit from the outcome of a call, inflight counts it
+func (lim *limiter) observe(err error, latency time.Duration, inflight int) {
+	cfg := lim.limit.Adaptive
+	now := time.Now()
+	if lim.windowMin == 0 || latency < lim.windowMin {
+		lim.windowMin = latency
+	}
+	if lim.baseline == 0 || latency < lim.baseline {
+		lim.baseline = latency
+	}
+	if now.After(lim.windowEnd) {
+		// let the baseline rise again when the downstream got slower for good
+		lim.baseline, lim.windowMin, lim.windowEnd = lim.windowMin, 0, now.Add(cfg.Window)
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		lim.adaptive *= cfg.Backoff
+	default:
+		if float64(latency) > cfg.Tolerance*float64(lim.baseline) {
+			lim.adaptive *= cfg.Backoff
+		} else if float64(inflight)*2 >= lim.adaptive {
+			// only grow while the limit is used, an idle client says nothing about the downstream
+			lim.adaptive += 1 / lim.adaptive
+		}
+	}
+	lim.adaptive = math.Min(math.Max(lim.adaptive, float64(cfg.MinLimit)), float64(cfg.MaxLimit))
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLimiterTokenBucket(t *testing.T) {
+	l := NewLimiters()
+	l.SetMethodLimit(testMethod, Limit{QPS: 20, Burst: 2})
+	call := l.UnaryClientInterceptor()
+
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.Equal(t, ErrRateLimited, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	// the other methods of the service are not limited
+	assert.NoError(t, call(context.Background(), "/test.Service/Put", nil, nil, nil, invokerOf(nil, 0)))
+
+	// a token comes back every 50ms
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+	assert.Equal(t, ErrRateLimited, call(context.Background(), testMethod, nil, nil, nil, invokerOf(nil, 0)))
+}
+
+func TestLimiterTokenBucketWait(t *testing.T) {
+	lim := newLimiter(Limit{QPS: 20, Wait: true})
+	assert.Equal(t, 20, lim.limit.Burst)
+	empty := func() {
+		lim.tokens, lim.last = 0, time.Now()
+	}
+
+	empty()
+	start := time.Now()
+	assert.NoError(t, lim.take(context.Background()))
+	// the timer may fire late on a busy machine, never early
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(45*time.Millisecond))
+	assert.Less(t, int64(time.Since(start)), int64(250*time.Millisecond))
+
+	// a deadline shorter than the wait fails at once
+	empty()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	assert.Equal(t, ErrRateLimited, lim.take(ctx))
+	assert.Less(t, int64(time.Since(start)), int64(10*time.Millisecond))
+
+	// a canceled wait gives its token back
+	empty()
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, codes.Canceled, status.Code(lim.take(ctx)))
+	assert.InDelta(t, 0, lim.tokens, 0.5)
+}
+
+func TestLimiterInFlight(t *testing.T) {
+	l := NewLimiters()
+	l.SetServiceLimit("test.Service", Limit{MaxInFlight: 1})
+	release, err := l.acquire(context.Background(), testMethod)
+	assert.NoError(t, err)
+	_, err = l.acquire(context.Background(), "/test.Service/Put")
+	assert.Equal(t, ErrConcurrencyLimited, err)
+	release(nil, 0)
+	release, err = l.acquire(context.Background(), "/test.Service/Put")
+	assert.NoError(t, err)
+	release(nil, 0)
+	assert.Equal(t, 1, l.ConcurrencyLimit("test.Service"))
+	assert.Equal(t, 0, l.ConcurrencyLimit(testMethod))
+}
+
+func TestLimiterInFlightWait(t *testing.T) {
+	lim := newLimiter(Limit{MaxInFlight: 1, Wait: true})
+	assert.NoError(t, lim.acquire(context.Background()))
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- lim.acquire(context.Background())
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	lim.release(nil, 0, false)
+	assert.NoError(t, <-acquired)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(lim.acquire(ctx)))
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	assert.Equal(t, 1, lim.inflight)
+}
+
+func TestLimiterAdaptive(t *testing.T) {
+	lim := newLimiter(Limit{MaxInFlight: 4, Adaptive: &AdaptiveLimit{InitialLimit: 2, Backoff: 0.5}})
+	assert.Equal(t, 2, lim.capacity())
+	assert.Equal(t, 4, lim.limit.Adaptive.MaxLimit)
+
+	// it grows additively while it is used and the latency stays near the baseline
+	lim.observe(nil, 10*time.Millisecond, 2)
+	assert.InDelta(t, 2.5, lim.adaptive, 0.01)
+	lim.observe(nil, 15*time.Millisecond, 2)
+	assert.InDelta(t, 2.9, lim.adaptive, 0.01)
+	// an idle client says nothing about the downstream
+	lim.observe(nil, 10*time.Millisecond, 1)
+	assert.InDelta(t, 2.9, lim.adaptive, 0.01)
+
+	// it shrinks multiplicatively on a latency over the tolerance or on an overload error
+	lim.observe(nil, 30*time.Millisecond, 2)
+	assert.InDelta(t, 1.45, lim.adaptive, 0.01)
+	lim.observe(status.Error(codes.ResourceExhausted, ""), time.Millisecond, 1)
+	assert.InDelta(t, 1, lim.adaptive, 0.01)
+	// not under MinLimit
+	lim.observe(status.Error(codes.Unavailable, ""), time.Millisecond, 1)
+	assert.Equal(t, 1, lim.capacity())
+
+	// nor over MaxLimit
+	for i := 0; i < 100; i++ {
+		lim.observe(nil, time.Millisecond, 4)
+	}
+	assert.Equal(t, 4, lim.capacity())
+}
+
+func TestLimiterAdaptiveRelease(t *testing.T) {
+	l := NewLimiters()
+	l.SetMethodLimit(testMethod, Limit{Adaptive: &AdaptiveLimit{InitialLimit: 4, Backoff: 0.5}})
+	call := l.UnaryClientInterceptor()
+	assert.Error(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(status.Error(codes.Unavailable, ""), 0)))
+	assert.Equal(t, 2, l.ConcurrencyLimit(testMethod))
+	// canceled calls are not sampled
+	assert.Error(t, call(context.Background(), testMethod, nil, nil, nil, invokerOf(status.Error(codes.Canceled, ""), time.Millisecond)))
+	assert.Equal(t, 2, l.ConcurrencyLimit(testMethod))
+}
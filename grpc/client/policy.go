@@ -0,0 +1,216 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/health" // registers the client side health checking
+)
+
+var (
+	ErrInvalidPolicy = errors.New("invalid service policy")
+)
+
+// RetryPolicy retries the calls failing with one of the retryable codes,
+// refer to https://github.com/grpc/proposal/blob/master/A6-client-retries.md
+type RetryPolicy struct {
+	// MaxAttempts counts the original call, 2 to 5
+	MaxAttempts       int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+	RetryableCodes    []codes.Code
+}
+
+// ServicePolicy is the call policy of a service, rendered into the gRPC service config of its target
+type ServicePolicy struct {
+	// Retry is nil to disable retries
+	Retry *RetryPolicy
+	// Timeout of every call of the service, 0 leaves it to the caller's context
+	Timeout time.Duration
+	// HealthCheckService is the name checked with the grpc.health.v1 service, empty disables health checking
+	HealthCheckService string
+	// LoadBalancing is the name of a registered balancer, round_robin by default
+	LoadBalancing string
+}
+
+// SetPolicy sets the policy of a service. Once started, the pool of the endpoint serving the service is
+// replaced and the old one drained, an invalid policy then leaves everything as it was
+func (sc *ServiceClientPool) SetPolicy(service string, policy ServicePolicy) error {
+	if err := policy.Validate(); err != nil {
+		return fmt.Errorf("service %s: %w", service, err)
+	}
+	sc.reloadMu.Lock()
+	defer sc.reloadMu.Unlock()
+	old, had := sc.policies[service]
+	sc.policies[service] = policy
+	if err := sc.rebuild(service); err != nil {
+		if had {
+			sc.policies[service] = old
+		} else {
+			delete(sc.policies, service)
+		}
+		return err
+	}
+	return nil
+}
+
+// policy gets the policy of a service, Option.Policy applies to the services without one
+func (sc *ServiceClientPool) policy(service string) ServicePolicy {
+	if p, ok := sc.policies[service]; ok {
+		return p
+	}
+	if sc.option.Policy != nil {
+		return *sc.option.Policy
+	}
+	return ServicePolicy{}
+}
+
+func (p *ServicePolicy) lbPolicy() string {
+	if p.LoadBalancing == "" {
+		return roundrobin.Name
+	}
+	return p.LoadBalancing
+}
+
+// Validate checks the policy would not be ignored by gRPC
+func (p *ServicePolicy) Validate() error {
+	if balancer.Get(p.lbPolicy()) == nil {
+		return fmt.Errorf("%w: unknown load balancing policy %q", ErrInvalidPolicy, p.LoadBalancing)
+	}
+	if p.HealthCheckService != "" && p.lbPolicy() != roundrobin.Name {
+		return fmt.Errorf("%w: health checking needs %s", ErrInvalidPolicy, roundrobin.Name)
+	}
+	if p.Timeout < 0 {
+		return fmt.Errorf("%w: negative timeout", ErrInvalidPolicy)
+	}
+	if r := p.Retry; r != nil {
+		switch {
+		case r.MaxAttempts < 2 || r.MaxAttempts > 5:
+			return fmt.Errorf("%w: retry max attempts %d not in [2, 5]", ErrInvalidPolicy, r.MaxAttempts)
+		case r.InitialBackoff <= 0 || r.MaxBackoff < r.InitialBackoff:
+			return fmt.Errorf("%w: retry backoff %v to %v", ErrInvalidPolicy, r.InitialBackoff, r.MaxBackoff)
+		case r.BackoffMultiplier <= 0:
+			return fmt.Errorf("%w: retry backoff multiplier %v", ErrInvalidPolicy, r.BackoffMultiplier)
+		case len(r.RetryableCodes) == 0:
+			return fmt.Errorf("%w: no retryable codes", ErrInvalidPolicy)
+		}
+		for _, c := range r.RetryableCodes {
+			if c == codes.OK || c > codes.Unauthenticated {
+				return fmt.Errorf("%w: retryable code %v", ErrInvalidPolicy, c)
+			}
+		}
+	}
+	return nil
+}
+
+// refer to https://github.com/grpc/grpc-proto/blob/master/grpc/service_config/service_config.proto
+type serviceConfig struct {
+	LoadBalancingConfig []map[string]struct{} `json:"loadBalancingConfig"`
+	MethodConfig        []methodConfig        `json:"methodConfig,omitempty"`
+	HealthCheckConfig   *healthCheckConfig    `json:"healthCheckConfig,omitempty"`
+}
+
+type methodConfig struct {
+	Name        []methodName `json:"name"`
+	Timeout     string       `json:"timeout,omitempty"`
+	RetryPolicy *retryPolicy `json:"retryPolicy,omitempty"`
+}
+
+type methodName struct {
+	Service string `json:"service"`
+}
+
+type retryPolicy struct {
+	MaxAttempts          int      `json:"maxAttempts"`
+	InitialBackoff       string   `json:"initialBackoff"`
+	MaxBackoff           string   `json:"maxBackoff"`
+	BackoffMultiplier    float64  `json:"backoffMultiplier"`
+	RetryableStatusCodes []string `json:"retryableStatusCodes"`
+}
+
+type healthCheckConfig struct {
+	ServiceName string `json:"serviceName"`
+}
+
+// renderServiceConfig renders the policies of the services sharing a target, they must agree on
+// the load balancing and the health checking which apply to the whole connection
+func (sc *ServiceClientPool) renderServiceConfig(services []string) (string, error) {
+	services = append([]string(nil), services...)
+	sort.Strings(services)
+	cfg := serviceConfig{}
+	var lb, health string
+	for i, srv := range services {
+		p := sc.policy(srv)
+		if err := p.Validate(); err != nil {
+			return "", fmt.Errorf("service %s: %w", srv, err)
+		}
+		if i == 0 {
+			lb, health = p.lbPolicy(), p.HealthCheckService
+		} else if p.lbPolicy() != lb || p.HealthCheckService != health {
+			return "", fmt.Errorf("%w: services %s and %s share a target with different load balancing or health checking",
+				ErrInvalidPolicy, services[0], srv)
+		}
+
+		mc := methodConfig{Name: []methodName{{Service: srv}}}
+		if p.Timeout > 0 {
+			mc.Timeout = formatDuration(p.Timeout)
+		}
+		if r := p.Retry; r != nil {
+			rp := &retryPolicy{
+				MaxAttempts:       r.MaxAttempts,
+				InitialBackoff:    formatDuration(r.InitialBackoff),
+				MaxBackoff:        formatDuration(r.MaxBackoff),
+				BackoffMultiplier: r.BackoffMultiplier,
+			}
+			for _, c := range r.RetryableCodes {
+				rp.RetryableStatusCodes = append(rp.RetryableStatusCodes, codeName(c))
+			}
+			mc.RetryPolicy = rp
+		}
+		if mc.Timeout != "" || mc.RetryPolicy != nil {
+			cfg.MethodConfig = append(cfg.MethodConfig, mc)
+		}
+	}
+	if lb == "" {
+		lb = roundrobin.Name
+	}
+	cfg.LoadBalancingConfig = []map[string]struct{}{{lb: {}}}
+	if health != "" {
+		cfg.HealthCheckConfig = &healthCheckConfig{ServiceName: health}
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// formatDuration formats a duration the way protobuf JSON does, e.g. "0.1s"
+func formatDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+// codeName gets the canonical name of a code, e.g. "DEADLINE_EXCEEDED"
+func codeName(c codes.Code) string {
+	if c == codes.Canceled {
+		return "CANCELLED"
+	}
+	var b strings.Builder
+	for i, r := range c.String() {
+		if i > 0 && unicode.IsUpper(r) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
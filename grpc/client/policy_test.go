@@ -0,0 +1,147 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+// retryOn is a valid retry policy on the codes
+func retryOn(c ...codes.Code) *RetryPolicy {
+	return &RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, BackoffMultiplier: 2, RetryableCodes: c}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for name, c := range map[string]struct {
+		policy ServicePolicy
+		valid  bool
+	}{
+		"empty":                  {ServicePolicy{}, true},
+		"full":                   {ServicePolicy{Retry: retryOn(codes.Unavailable), Timeout: time.Second, HealthCheckService: "orders"}, true},
+		"pick first":             {ServicePolicy{LoadBalancing: "pick_first"}, true},
+		"unknown balancer":       {ServicePolicy{LoadBalancing: "nearest"}, false},
+		"health with pick first": {ServicePolicy{LoadBalancing: "pick_first", HealthCheckService: "orders"}, false},
+		"negative timeout":       {ServicePolicy{Timeout: -time.Second}, false},
+		"one attempt":            {ServicePolicy{Retry: &RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Second, MaxBackoff: time.Second, BackoffMultiplier: 1, RetryableCodes: []codes.Code{codes.Unavailable}}}, false},
+		"six attempts":           {ServicePolicy{Retry: &RetryPolicy{MaxAttempts: 6, InitialBackoff: time.Second, MaxBackoff: time.Second, BackoffMultiplier: 1, RetryableCodes: []codes.Code{codes.Unavailable}}}, false},
+		"no backoff":             {ServicePolicy{Retry: &RetryPolicy{MaxAttempts: 2, MaxBackoff: time.Second, BackoffMultiplier: 1, RetryableCodes: []codes.Code{codes.Unavailable}}}, false},
+		"max under initial":      {ServicePolicy{Retry: &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second, MaxBackoff: time.Millisecond, BackoffMultiplier: 1, RetryableCodes: []codes.Code{codes.Unavailable}}}, false},
+		"no multiplier":          {ServicePolicy{Retry: &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Second, MaxBackoff: time.Second, RetryableCodes: []codes.Code{codes.Unavailable}}}, false},
+		"no codes":               {ServicePolicy{Retry: retryOn()}, false},
+		"retry on OK":            {ServicePolicy{Retry: retryOn(codes.OK)}, false},
+		"unknown code":           {ServicePolicy{Retry: retryOn(codes.Code(17))}, false},
+	} {
+		err := c.policy.Validate()
+		if c.valid {
+			assert.NoError(t, err, name)
+		} else {
+			assert.True(t, errors.Is(err, ErrInvalidPolicy), name)
+		}
+	}
+}
+
+func TestCodeName(t *testing.T) {
+	for c, want := range map[codes.Code]string{
+		codes.Canceled:           "CANCELLED",
+		codes.Unknown:            "UNKNOWN",
+		codes.DeadlineExceeded:   "DEADLINE_EXCEEDED",
+		codes.ResourceExhausted:  "RESOURCE_EXHAUSTED",
+		codes.FailedPrecondition: "FAILED_PRECONDITION",
+		codes.Unavailable:        "UNAVAILABLE",
+		codes.DataLoss:           "DATA_LOSS",
+	} {
+		assert.Equal(t, want, codeName(c))
+	}
+}
+
+func TestRenderServiceConfig(t *testing.T) {
+	for name, c := range map[string]struct {
+		policies map[string]ServicePolicy
+		def      *ServicePolicy
+		json     string
+	}{
+		"no policy": {
+			json: `{"loadBalancingConfig": [{"round_robin": {}}]}`,
+		},
+		"retry and timeout": {
+			policies: map[string]ServicePolicy{
+				"a.A": {Retry: retryOn(codes.Unavailable, codes.Canceled), Timeout: 1500 * time.Millisecond},
+				"b.B": {Timeout: 100 * time.Millisecond},
+			},
+			json: `{
+				"loadBalancingConfig": [{"round_robin": {}}],
+				"methodConfig": [
+					{"name": [{"service": "a.A"}], "timeout": "1.5s", "retryPolicy": {
+						"maxAttempts": 3, "initialBackoff": "0.1s", "maxBackoff": "1s", "backoffMultiplier": 2,
+						"retryableStatusCodes": ["UNAVAILABLE", "CANCELLED"]}},
+					{"name": [{"service": "b.B"}], "timeout": "0.1s"}
+				]
+			}`,
+		},
+		"default policy": {
+			def: &ServicePolicy{HealthCheckService: "shared"},
+			json: `{
+				"loadBalancingConfig": [{"round_robin": {}}],
+				"healthCheckConfig": {"serviceName": "shared"}
+			}`,
+		},
+		"pick first": {
+			policies: map[string]ServicePolicy{"a.A": {LoadBalancing: "pick_first"}, "b.B": {LoadBalancing: "pick_first"}},
+			json:     `{"loadBalancingConfig": [{"pick_first": {}}]}`,
+		},
+	} {
+		sc := NewServiceClientPool(&Option{Policy: c.def})
+		for srv, p := range c.policies {
+			sc.policies[srv] = p
+		}
+		// the services are rendered in order whatever their order on the target
+		cfg, err := sc.renderServiceConfig([]string{"b.B", "a.A"})
+		assert.NoError(t, err, name)
+		assert.JSONEq(t, c.json, cfg, name)
+	}
+}
+
+func TestRenderServiceConfigConflict(t *testing.T) {
+	for name, policies := range map[string]map[string]ServicePolicy{
+		"load balancing":  {"a.A": {LoadBalancing: "pick_first"}},
+		"health checking": {"a.A": {HealthCheckService: "a"}, "b.B": {HealthCheckService: "b"}},
+		"invalid":         {"b.B": {Timeout: -time.Second}},
+	} {
+		sc := NewServiceClientPool(&Option{})
+		sc.policies = policies
+		_, err := sc.renderServiceConfig([]string{"a.A", "b.B"})
+		assert.True(t, errors.Is(err, ErrInvalidPolicy), name)
+	}
+}
+
+func TestSetPolicyRollback(t *testing.T) {
+	sc := NewServiceClientPool(&Option{})
+	sc.SetServices("127.0.0.1:1", "a.A", "b.B")
+	assert.NoError(t, sc.Start())
+	defer sc.CloseAll()
+
+	assert.True(t, errors.Is(sc.SetPolicy("a.A", ServicePolicy{Timeout: -time.Second}), ErrInvalidPolicy))
+
+	// a new policy replaces the pool of the target
+	first := sc.pools["127.0.0.1:1"]
+	assert.NoError(t, sc.SetPolicy("a.A", ServicePolicy{Timeout: time.Second}))
+	second := sc.pools["127.0.0.1:1"]
+	assert.NotSame(t, first, second)
+	assert.Same(t, second, sc.clients["b.B"])
+
+	// a policy conflicting with b.B restores the previous one and keeps the pool
+	err := sc.SetPolicy("a.A", ServicePolicy{Timeout: time.Second, LoadBalancing: "pick_first"})
+	assert.True(t, errors.Is(err, ErrInvalidPolicy))
+	assert.Equal(t, ServicePolicy{Timeout: time.Second}, sc.policies["a.A"])
+	assert.Same(t, second, sc.pools["127.0.0.1:1"])
+
+	// a service without a policy is left without one
+	err = sc.SetPolicy("b.B", ServicePolicy{HealthCheckService: "b"})
+	assert.True(t, errors.Is(err, ErrInvalidPolicy))
+	_, ok := sc.policies["b.B"]
+	assert.False(t, ok)
+	assert.Same(t, second, sc.clients["b.B"])
+}
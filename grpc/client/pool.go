@@ -3,7 +3,6 @@ package client
 import (
 	"context"
 	"errors"
-	"fmt"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -12,7 +11,6 @@ import (
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
-	"google.golang.org/grpc/balancer/roundrobin"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
@@ -20,11 +18,14 @@ import (
 )
 
 var (
-	ErrNotFoundClient = errors.New("not found grpc client service")
-	ErrConnShutdown   = errors.New("grpc connection has closed")
+	ErrNotFoundClient   = errors.New("not found grpc client service")
+	ErrConnShutdown     = errors.New("grpc connection has closed")
+	ErrNotFoundEndpoint = errors.New("not found grpc endpoint")
+	ErrDuplicateService = errors.New("grpc service mapped to several endpoints")
 
 	defaultPoolSize                    = 10
 	defaultDialTimeout                 = 10 * time.Second
+	defaultDrainTimeout                = 30 * time.Second
 	defaultKeepAlive                   = 30 * time.Second
 	defaultKeepAliveTimeout            = 10 * time.Second
 	defaultBackoffMaxDelay             = 3 * time.Second
@@ -40,6 +41,20 @@ type Option struct {
 	KeepAlive        time.Duration
 	KeepAliveTimeout time.Duration
 	DialOptions      []grpc.DialOption
+	// DrainTimeout is how long a replaced connection pool waits for its calls in flight before closing
+	DrainTimeout time.Duration
+	// Policy applies to the services without their own policy set with SetPolicy
+	Policy *ServicePolicy
+	// WarmUp dials every connection of a pool at Start instead of on demand
+	WarmUp bool
+	// HealthCheckInterval is the period of the grpc.health.v1 probes of every connection
+	HealthCheckInterval time.Duration
+	// EjectAfter consecutive failed probes or unavailable calls take a connection out of the rotation
+	// for EjectDuration
+	EjectAfter    int
+	EjectDuration time.Duration
+	// StreamReconnects is the number of reconnections in a row of a resumable stream before giving up
+	StreamReconnects int
 }
 
 type Pool struct {
@@ -47,45 +62,123 @@ type Pool struct {
 	next     int64
 	cap      int64
 
-	option *Option
-	conns  []*grpc.ClientConn
-	sync.Mutex
+	option        *Option
+	serviceConfig string
+	healthService string
+	conns         []*poolConn
+	closing       int32
+	closeOnce     sync.Once
+	exit          chan struct{}
+	sync.RWMutex
 }
 
 func (p *Pool) getConn() (*grpc.ClientConn, error) {
-	var (
-		idx  int64
-		next int64
-		err  error
-	)
+	pc, err := p.pick(nil)
+	if err != nil {
+		return nil, err
+	}
+	return pc.cc, nil
+}
 
-	next = atomic.AddInt64(&p.next, 1)
-	idx = next % p.cap
-	conn := p.conns[idx]
-	if conn != nil && p.checkState(conn) == nil {
-		return conn, nil
+// pick selects the healthy connection with the least calls in flight. Another connection is dialed
+// while the pool is not full and the connections are all busy, the ejected or failing ones are only
+// used when nothing else is left, and so is the excluded one
+func (p *Pool) pick(exclude *grpc.ClientConn) (*poolConn, error) {
+	start := atomic.AddInt64(&p.next, 1)
+	now := time.Now().UnixNano()
+	free := int64(-1)
+	var best, fallback, excluded *poolConn
+
+	p.RLock()
+	for i := int64(0); i < p.cap; i++ {
+		idx := (start + i) % p.cap
+		pc := p.conns[idx]
+		if pc == nil || pc.cc.GetState() == connectivity.Shutdown {
+			if free < 0 {
+				free = idx
+			}
+			continue
+		}
+		if exclude != nil && pc.cc == exclude {
+			excluded = pc
+			continue
+		}
+		if p.checkState(pc.cc) == nil && !pc.isEjected(now) {
+			if best == nil || pc.load() < best.load() {
+				best = pc
+			}
+		} else if fallback == nil || pc.load() < fallback.load() {
+			fallback = pc
+		}
 	}
+	p.RUnlock()
 
-	if conn != nil {
-		conn.Close()
+	if best != nil && (best.load() == 0 || free < 0) {
+		return best, nil
+	}
+	// a draining pool serves the callers that got it before it was replaced, it no longer dials
+	if free >= 0 && atomic.LoadInt32(&p.closing) == 0 {
+		pc, err := p.dial(free)
+		if err == nil {
+			return pc, nil
+		}
+		if best == nil && fallback == nil && excluded == nil {
+			return nil, err
+		}
+	}
+	if best != nil {
+		return best, nil
+	}
+	if fallback != nil {
+		return fallback, nil
 	}
+	if excluded != nil {
+		return excluded, nil
+	}
+	return nil, ErrConnShutdown
+}
 
+// dial connects a free slot, unless another caller did it in the meantime
+func (p *Pool) dial(idx int64) (*poolConn, error) {
 	p.Lock()
 	defer p.Unlock()
 
 	// double check to prevent initialization
-	conn = p.conns[idx]
-	if conn != nil && p.checkState(conn) == nil {
-		return conn, nil
+	if pc := p.conns[idx]; pc != nil && pc.cc.GetState() != connectivity.Shutdown {
+		return pc, nil
 	}
 
-	conn, err = p.connect()
+	pc := &poolConn{pool: p}
+	conn, err := p.connect(pc)
 	if err != nil {
 		return nil, err
 	}
+	pc.cc = conn
+	p.conns[idx] = pc
+	return pc, nil
+}
 
-	p.conns[idx] = conn
-	return conn, nil
+// warmUp dials every connection of the pool instead of waiting for the load to need them
+func (p *Pool) warmUp() error {
+	for i := int64(0); i < p.cap; i++ {
+		if _, err := p.dial(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outstanding counts the calls in flight on the pool
+func (p *Pool) outstanding() int64 {
+	p.RLock()
+	defer p.RUnlock()
+	var n int64
+	for _, pc := range p.conns {
+		if pc != nil {
+			n += pc.load()
+		}
+	}
+	return n
 }
 
 func (p *Pool) checkState(conn *grpc.ClientConn) error {
@@ -98,18 +191,6 @@ func (p *Pool) checkState(conn *grpc.ClientConn) error {
 	return nil
 }
 
-// refer to https://github.com/grpc/grpc-proto/blob/master/grpc/service_config/service_config.proto
-//retryPolicy := fmt.Sprintf(`{
-//		"methodConfig": [{
-//		  "name": [{"service": "%s"}],
-//		  "retryPolicy": {
-//			  "MaxAttempts": %d,
-//			  "InitialBackoff": "%fs",
-//			  "MaxBackoff": "%fs",
-//			  "BackoffMultiplier": %f,
-//			  "RetryableStatusCodes": [ "UNAVAILABLE" ]
-//		  }
-//		}]}`, RetryServiceName, MaxAttempts, InitialBackoff, MaxBackoff, BackoffMultiplier)
 func (p *Pool) defaultDialOptions() []grpc.DialOption {
 	return []grpc.DialOption{
 		//grpc.WithBlock(),
@@ -118,20 +199,6 @@ func (p *Pool) defaultDialOptions() []grpc.DialOption {
 		//	MinConnectTimeout: 0,
 		//}),
 		//grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy": "round_robin"}`),
-		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{
-			"LoadBalancingPolicy": "%s",
-			"MethodConfig": [
-				{
-					"Name": [{"Service": "helloworld.Greeter"}], 
-					"RetryPolicy": {
-						"MaxAttempts":2, "InitialBackoff": "0.1s", 
-						"MaxBackoff": "1s", "BackoffMultiplier": 2.0, 
-						"RetryableStatusCodes": ["UNAVAILABLE", "CANCELLED"]
-					}
-				}
-			],
-			"HealthCheckConfig": {"ServiceName": "helloworld.Greeter"}
-		}`, roundrobin.Name)),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithUnaryInterceptor(UnaryClientInterceptor),
 		grpc.WithInitialWindowSize(defaultInitialWindowSize),
@@ -157,13 +224,21 @@ func (p *Pool) defaultDialOptions() []grpc.DialOption {
 	}
 }
 
-func (p *Pool) connect() (*grpc.ClientConn, error) {
+func (p *Pool) connect(pc *poolConn) (*grpc.ClientConn, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), p.option.DialTimeOut)
 	defer cancel()
 	opts := p.option.DialOptions
 	if opts == nil {
 		opts = p.defaultDialOptions()
 	}
+	opts = append(opts[:len(opts):len(opts)],
+		grpc.WithChainUnaryInterceptor(pc.trackUnary),
+		grpc.WithChainStreamInterceptor(pc.trackStream),
+	)
+	if p.serviceConfig != "" {
+		// the policies rendered by Start, a service config pushed by the resolver takes precedence
+		opts = append(opts, grpc.WithDefaultServiceConfig(p.serviceConfig))
+	}
 	conn, err := grpc.DialContext(ctx, p.endpoint, opts...)
 	if err != nil {
 		return nil, err
@@ -173,18 +248,32 @@ func (p *Pool) connect() (*grpc.ClientConn, error) {
 }
 
 func (p *Pool) Close() {
+	atomic.StoreInt32(&p.closing, 1)
+	p.closeOnce.Do(func() { close(p.exit) })
 	p.Lock()
 	defer p.Unlock()
 
-	for _, conn := range p.conns {
-		if conn == nil {
+	for _, pc := range p.conns {
+		if pc == nil {
 			continue
 		}
-		conn.Close()
+		pc.cc.Close()
+	}
+}
+
+// drain closes the pool once its calls in flight are done or the timeout elapses
+func (p *Pool) drain(timeout time.Duration) {
+	atomic.StoreInt32(&p.closing, 1)
+	deadline := time.Now().Add(timeout)
+	for p.outstanding() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
 	}
+	p.Close()
 }
 
-func newClientPoolWithOption(endpoint string, option *Option) *Pool {
+// newClientPoolWithOption creates the pool of an endpoint dialed with the service config and probed
+// with the health service, both are set before its health checks start
+func newClientPoolWithOption(endpoint string, option *Option, serviceConfig, healthService string) *Pool {
 	if (option.PoolSize) <= 0 {
 		option.PoolSize = defaultPoolSize
 	}
@@ -201,42 +290,72 @@ func newClientPoolWithOption(endpoint string, option *Option) *Pool {
 		option.KeepAliveTimeout = defaultKeepAliveTimeout
 	}
 
-	return &Pool{
-		endpoint: endpoint,
-		option:   option,
-		cap:      int64(option.PoolSize),
-		conns:    make([]*grpc.ClientConn, option.PoolSize),
+	if option.DrainTimeout <= 0 {
+		option.DrainTimeout = defaultDrainTimeout
+	}
+
+	if option.HealthCheckInterval <= 0 {
+		option.HealthCheckInterval = defaultHealthCheckInterval
+	}
+
+	if option.EjectAfter <= 0 {
+		option.EjectAfter = defaultEjectAfter
 	}
+
+	if option.EjectDuration <= 0 {
+		option.EjectDuration = defaultEjectDuration
+	}
+
+	p := &Pool{
+		endpoint:      endpoint,
+		option:        option,
+		serviceConfig: serviceConfig,
+		healthService: healthService,
+		cap:           int64(option.PoolSize),
+		conns:         make([]*poolConn, option.PoolSize),
+		exit:          make(chan struct{}),
+	}
+	go p.healthCheck()
+	return p
 }
 
 type ServiceClientPool struct {
 	useTLS   bool
+	started  bool
 	option   *Option
 	services map[string][]string
+	policies map[string]ServicePolicy
+	pools    map[string]*Pool
 	clients  map[string]*Pool
+	mu       sync.RWMutex
+	// reloadMu serializes the changes of the mapping and the policies, the pools are dialed holding it
+	// and mu is only taken to swap them in, so the calls go on meanwhile
+	reloadMu sync.Mutex
 }
 
 func NewServiceClientPool(option *Option) *ServiceClientPool {
 	return &ServiceClientPool{
 		option:   option,
 		services: make(map[string][]string),
+		policies: make(map[string]ServicePolicy),
 	}
 }
 
-func (sc *ServiceClientPool) Start() {
-	var clients = make(map[string]*Pool, len(sc.services))
+// Start creates the client pools, it fails when the policies of the services are invalid
+func (sc *ServiceClientPool) Start() error {
+	sc.reloadMu.Lock()
+	defer sc.reloadMu.Unlock()
 	if !sc.useTLS {
 		sc.addDialOption(grpc.WithTransportCredentials(insecure.NewCredentials()))
 	}
-	for endpoint, serviceName := range sc.services {
-		clientPool := newClientPoolWithOption(endpoint, sc.option)
-		for _, srv := range serviceName {
-			clients[srv] = clientPool
-		}
+	sc.started = true
+	if err := sc.apply(sc.services); err != nil {
+		sc.started = false
+		return err
 	}
 
-	sc.clients = clients
 	scp = sc
+	return nil
 }
 
 func (sc *ServiceClientPool) addDialOption(opt grpc.DialOption) {
@@ -264,10 +383,15 @@ func (sc *ServiceClientPool) SetTLS(clientKeyPath, clientPemPath, caPemPath, com
 	sc.addDialOption(opt)
 }
 
+// SetServices maps the services to an endpoint, it may be a target of a resolver set with SetResolver
 func (sc *ServiceClientPool) SetServices(endpoint string, services ...string) {
 	if len(services) == 0 {
 		return
 	}
+	sc.reloadMu.Lock()
+	defer sc.reloadMu.Unlock()
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
 	sc.services[endpoint] = append(sc.services[endpoint], services...)
 }
 
@@ -277,7 +401,9 @@ func (sc *ServiceClientPool) GetClientWithFullMethod(fullMethod string) (*grpc.C
 }
 
 func (sc *ServiceClientPool) GetClient(serviceName string) (*grpc.ClientConn, error) {
+	sc.mu.RLock()
 	cc, ok := sc.clients[serviceName]
+	sc.mu.RUnlock()
 	if !ok {
 		return nil, ErrNotFoundClient
 	}
@@ -286,7 +412,9 @@ func (sc *ServiceClientPool) GetClient(serviceName string) (*grpc.ClientConn, er
 }
 
 func (sc *ServiceClientPool) Close(serviceName string) {
+	sc.mu.RLock()
 	cc, ok := sc.clients[serviceName]
+	sc.mu.RUnlock()
 	if !ok {
 		return
 	}
@@ -295,7 +423,9 @@ func (sc *ServiceClientPool) Close(serviceName string) {
 }
 
 func (sc *ServiceClientPool) CloseAll() {
-	for _, client := range sc.clients {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	for _, client := range sc.pools {
 		client.Close()
 	}
 }
@@ -318,13 +448,18 @@ func (sc *ServiceClientPool) Invoke(
 	reply interface{},
 	opts ...grpc.CallOption,
 ) error {
-	var md metadata.MD
 	serviceName := sc.spiltFullMethod(fullMethod)
 	conn, err := sc.GetClient(serviceName)
 	if err != nil {
 		return err
 	}
 
+	ctx = withHeaders(ctx, headers)
+	return conn.Invoke(ctx, fullMethod, args, reply, opts...)
+}
+
+// withHeaders merges the headers into the outgoing metadata of the context
+func withHeaders(ctx context.Context, headers map[string]string) context.Context {
 	md, exist := metadata.FromOutgoingContext(ctx)
 	if exist {
 		md = md.Copy()
@@ -336,8 +471,7 @@ func (sc *ServiceClientPool) Invoke(
 		md.Set(k, v)
 	}
 
-	ctx = metadata.NewOutgoingContext(ctx, md)
-	return conn.Invoke(ctx, fullMethod, args, reply, opts...)
+	return metadata.NewOutgoingContext(ctx, md)
 }
 
 var scp *ServiceClientPool
@@ -0,0 +1,253 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AddService maps the services to an endpoint at runtime, a service mapped elsewhere moves to the endpoint
+func (sc *ServiceClientPool) AddService(endpoint string, services ...string) error {
+	if len(services) == 0 {
+		return nil
+	}
+	sc.reloadMu.Lock()
+	defer sc.reloadMu.Unlock()
+	next := sc.copyServices()
+	for ep, list := range next {
+		next[ep] = without(list, services)
+	}
+	next[endpoint] = append(next[endpoint], services...)
+	return sc.apply(next)
+}
+
+// RemoveService unmaps the services at runtime, an endpoint left without services is drained
+func (sc *ServiceClientPool) RemoveService(services ...string) error {
+	sc.reloadMu.Lock()
+	defer sc.reloadMu.Unlock()
+	next := sc.copyServices()
+	for ep, list := range next {
+		next[ep] = without(list, services)
+	}
+	return sc.apply(next)
+}
+
+// UpdateEndpoint moves the services of an endpoint to another one, the old connections are drained
+func (sc *ServiceClientPool) UpdateEndpoint(oldEndpoint, newEndpoint string) error {
+	sc.reloadMu.Lock()
+	defer sc.reloadMu.Unlock()
+	next := sc.copyServices()
+	list, ok := next[oldEndpoint]
+	if !ok {
+		return ErrNotFoundEndpoint
+	}
+	delete(next, oldEndpoint)
+	next[newEndpoint] = append(next[newEndpoint], list...)
+	return sc.apply(next)
+}
+
+// Reload replaces the whole endpoint to services mapping, only the endpoints whose services changed
+// get new connections
+func (sc *ServiceClientPool) Reload(services map[string][]string) error {
+	sc.reloadMu.Lock()
+	defer sc.reloadMu.Unlock()
+	next := make(map[string][]string, len(services))
+	for ep, list := range services {
+		next[ep] = append([]string(nil), list...)
+	}
+	return sc.apply(next)
+}
+
+// LoadConfig reloads the mapping from a YAML or JSON file mapping each endpoint to its services
+//
+//	"127.0.0.1:6868": ["hello.HelloServer"]
+//	"memory:///orders": ["orders.Orders", "orders.Refunds"]
+func (sc *ServiceClientPool) LoadConfig(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var services map[string][]string
+	if err = yaml.Unmarshal(b, &services); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	return sc.Reload(services)
+}
+
+// WatchConfig loads the config file and reloads it every time it changes, until stop is called
+func (sc *ServiceClientPool) WatchConfig(path string, interval time.Duration) (stop func(), err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = sc.LoadConfig(path); err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	exit := make(chan struct{})
+	var once sync.Once
+	go func() {
+		modTime, size := fi.ModTime(), fi.Size()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-exit:
+				return
+			case <-ticker.C:
+			}
+			fi, err := os.Stat(path)
+			if err != nil || (fi.ModTime().Equal(modTime) && fi.Size() == size) {
+				continue
+			}
+			modTime, size = fi.ModTime(), fi.Size()
+			if err = sc.LoadConfig(path); err != nil {
+				log.Printf("reload grpc client config %s err: %v", path, err)
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() { close(exit) })
+	}, nil
+}
+
+// apply switches to the next mapping, the pools of the endpoints whose services changed are replaced
+// and drained. Nothing changes when a policy is invalid. It is called with reloadMu held, the new pools
+// are created before taking mu to swap them in
+func (sc *ServiceClientPool) apply(next map[string][]string) error {
+	for ep, list := range next {
+		if len(list) == 0 {
+			delete(next, ep)
+		}
+	}
+	if !sc.started {
+		sc.mu.Lock()
+		sc.services = next
+		sc.mu.Unlock()
+		return nil
+	}
+
+	clients := make(map[string]*Pool)
+	pools := make(map[string]*Pool, len(next))
+	var created []*Pool
+	fail := func(err error) error {
+		for _, p := range created {
+			p.Close()
+		}
+		return err
+	}
+	for endpoint, list := range next {
+		p, ok := sc.pools[endpoint]
+		if !ok || !sameServices(sc.services[endpoint], list) {
+			var err error
+			if p, err = sc.newPool(endpoint, list); err != nil {
+				return fail(err)
+			}
+			created = append(created, p)
+		}
+		pools[endpoint] = p
+		for _, srv := range list {
+			if other, ok := clients[srv]; ok && other != p {
+				return fail(fmt.Errorf("%w: %s", ErrDuplicateService, srv))
+			}
+			clients[srv] = p
+		}
+	}
+
+	sc.mu.Lock()
+	old := sc.pools
+	sc.services, sc.pools, sc.clients = next, pools, clients
+	sc.mu.Unlock()
+	for endpoint, p := range old {
+		if pools[endpoint] != p {
+			go p.drain(sc.option.DrainTimeout)
+		}
+	}
+	return nil
+}
+
+// rebuild replaces the pool of the endpoint serving the service, e.g. after its policy changed,
+// it is called with reloadMu held
+func (sc *ServiceClientPool) rebuild(service string) error {
+	if !sc.started {
+		return nil
+	}
+	for endpoint, list := range sc.services {
+		if len(without(list, []string{service})) == len(list) {
+			continue
+		}
+		p, err := sc.newPool(endpoint, list)
+		if err != nil {
+			return err
+		}
+		sc.mu.Lock()
+		old := sc.pools[endpoint]
+		sc.pools[endpoint] = p
+		for _, srv := range list {
+			sc.clients[srv] = p
+		}
+		sc.mu.Unlock()
+		if old != nil {
+			go old.drain(sc.option.DrainTimeout)
+		}
+		return nil
+	}
+	return nil
+}
+
+// newPool creates the pool of an endpoint with the policies of its services
+func (sc *ServiceClientPool) newPool(endpoint string, services []string) (*Pool, error) {
+	cfg, err := sc.renderServiceConfig(services)
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %s: %w", endpoint, err)
+	}
+	p := newClientPoolWithOption(endpoint, sc.option, cfg, sc.policy(services[0]).HealthCheckService)
+	if sc.option.WarmUp {
+		if err = p.warmUp(); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("endpoint %s: %w", endpoint, err)
+		}
+	}
+	return p, nil
+}
+
+func (sc *ServiceClientPool) copyServices() map[string][]string {
+	next := make(map[string][]string, len(sc.services))
+	for ep, list := range sc.services {
+		next[ep] = append([]string(nil), list...)
+	}
+	return next
+}
+
+func without(list, remove []string) []string {
+	out := list[:0:0]
+	for _, s := range list {
+		keep := true
+		for _, r := range remove {
+			if s == r {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func sameServices(a, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return equalStrings(a, b)
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// draining reports whether the pool was replaced
+func draining(p *Pool) bool {
+	return atomic.LoadInt32(&p.closing) == 1
+}
+
+func TestReloadBeforeStart(t *testing.T) {
+	sc := NewServiceClientPool(&Option{})
+	assert.NoError(t, sc.AddService("127.0.0.1:1", "a.A", "b.B"))
+	assert.NoError(t, sc.AddService("127.0.0.1:2", "b.B"))
+	assert.Equal(t, map[string][]string{"127.0.0.1:1": {"a.A"}, "127.0.0.1:2": {"b.B"}}, sc.services)
+
+	assert.Equal(t, ErrNotFoundEndpoint, sc.UpdateEndpoint("127.0.0.1:3", "127.0.0.1:4"))
+	assert.NoError(t, sc.UpdateEndpoint("127.0.0.1:2", "127.0.0.1:1"))
+	assert.NoError(t, sc.RemoveService("a.A"))
+	assert.Equal(t, map[string][]string{"127.0.0.1:1": {"b.B"}}, sc.services)
+	// nothing is dialed before Start
+	assert.Empty(t, sc.pools)
+}
+
+func TestReloadReplacesChangedPools(t *testing.T) {
+	sc := NewServiceClientPool(&Option{DrainTimeout: 10 * time.Millisecond})
+	sc.SetServices("127.0.0.1:1", "a.A")
+	sc.SetServices("127.0.0.1:2", "b.B")
+	assert.NoError(t, sc.Start())
+	defer sc.CloseAll()
+	first, second := sc.pools["127.0.0.1:1"], sc.pools["127.0.0.1:2"]
+
+	// only the endpoint whose services changed gets a new pool
+	assert.NoError(t, sc.AddService("127.0.0.1:1", "c.C"))
+	assert.NotSame(t, first, sc.pools["127.0.0.1:1"])
+	assert.Same(t, sc.pools["127.0.0.1:1"], sc.clients["c.C"])
+	assert.Same(t, second, sc.pools["127.0.0.1:2"])
+	assert.Eventually(t, func() bool { return draining(first) }, time.Second, 10*time.Millisecond)
+	assert.False(t, draining(second))
+
+	assert.NoError(t, sc.RemoveService("b.B"))
+	_, err := sc.GetClient("b.B")
+	assert.Equal(t, ErrNotFoundClient, err)
+	assert.NotContains(t, sc.pools, "127.0.0.1:2")
+	assert.Eventually(t, func() bool { return draining(second) }, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, sc.UpdateEndpoint("127.0.0.1:1", "127.0.0.1:3"))
+	assert.Equal(t, map[string][]string{"127.0.0.1:3": {"a.A", "c.C"}}, sc.services)
+	assert.Same(t, sc.pools["127.0.0.1:3"], sc.clients["a.A"])
+
+	// the same mapping keeps the pools, an invalid one changes nothing
+	third := sc.pools["127.0.0.1:3"]
+	assert.NoError(t, sc.Reload(map[string][]string{"127.0.0.1:3": {"c.C", "a.A"}}))
+	assert.Same(t, third, sc.pools["127.0.0.1:3"])
+	err = sc.Reload(map[string][]string{"127.0.0.1:3": {"a.A"}, "127.0.0.1:4": {"a.A"}})
+	assert.True(t, errors.Is(err, ErrDuplicateService))
+	assert.Same(t, third, sc.clients["a.A"])
+	assert.False(t, draining(third))
+}
+
+func TestWatchConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	writeFile(t, path, "\"127.0.0.1:1\": [\"a.A\"]\n")
+	_, err := NewServiceClientPool(&Option{}).WatchConfig(filepath.Join(t.TempDir(), "missing.yaml"), 0)
+	assert.Error(t, err)
+
+	sc := NewServiceClientPool(&Option{DrainTimeout: 10 * time.Millisecond})
+	assert.NoError(t, sc.Start())
+	defer sc.CloseAll()
+	stop, err := sc.WatchConfig(path, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer stop()
+	_, err = sc.GetClient("a.A")
+	assert.NoError(t, err)
+
+	writeFile(t, path, "{\"127.0.0.1:1\": [\"a.A\"], \"127.0.0.1:2\": [\"b.B\"]}")
+	assert.Eventually(t, func() bool {
+		_, err := sc.GetClient("b.B")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// a broken file keeps the last mapping
+	writeFile(t, path, "\"127.0.0.1:1\": [a.A")
+	time.Sleep(50 * time.Millisecond)
+	_, err = sc.GetClient("b.B")
+	assert.NoError(t, err)
+
+	stop()
+	stop()
+	writeFile(t, path, "\"127.0.0.1:1\": [\"a.A\"]\n")
+	time.Sleep(50 * time.Millisecond)
+	_, err = sc.GetClient("b.B")
+	assert.NoError(t, err)
+}
+
+func TestReloadDialsOutsideLock(t *testing.T) {
+	l := serveHealth(t, &testHealth{})
+	dialing, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	sc := NewServiceClientPool(&Option{
+		PoolSize: 1,
+		WarmUp:   true,
+		DialOptions: []grpc.DialOption{
+			grpc.WithBlock(),
+			grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+				if addr == "slow:1" {
+					once.Do(func() { close(dialing) })
+					<-release
+				}
+				return l.DialContext(ctx)
+			}),
+		},
+	})
+	sc.SetServices("fast:1", grpc_health_v1.Health_ServiceDesc.ServiceName)
+	assert.NoError(t, sc.Start())
+	defer sc.CloseAll()
+
+	added := make(chan error, 1)
+	go func() { added <- sc.AddService("slow:1", "b.B") }()
+	<-dialing
+	// the calls are not held up by the endpoint being warmed up
+	done := make(chan error, 1)
+	go func() {
+		_, err := sc.GetClient(grpc_health_v1.Health_ServiceDesc.ServiceName)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("GetClient waited for the warm up of another endpoint")
+	}
+
+	close(release)
+	assert.NoError(t, <-added)
+	_, err := sc.GetClient("b.B")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,301 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/resolver"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrNoEndpoints = errors.New("no endpoints for target")
+
+	defaultResolveInterval = 30 * time.Second
+)
+
+// Resolver discovers the endpoints of a target
+type Resolver interface {
+	// Watch calls update with the endpoints of the target now and every time they change, until stop is called
+	Watch(target string, update func(endpoints []string, err error)) (stop func())
+}
+
+// NewResolverBuilder wraps a Resolver as a gRPC resolver.Builder for targets like "scheme:///target"
+func NewResolverBuilder(scheme string, r Resolver) resolver.Builder {
+	return &resolverBuilder{scheme: scheme, r: r}
+}
+
+// RegisterResolver registers the Resolver globally for the scheme, call it before dialing
+func RegisterResolver(scheme string, r Resolver) {
+	resolver.Register(NewResolverBuilder(scheme, r))
+}
+
+type resolverBuilder struct {
+	scheme string
+	r      Resolver
+}
+
+func (b *resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	w := &watchResolver{}
+	w.stop = b.r.Watch(target.Endpoint, func(endpoints []string, err error) {
+		if err != nil {
+			cc.ReportError(err)
+			return
+		}
+		addrs := make([]resolver.Address, 0, len(endpoints))
+		for _, ep := range endpoints {
+			addrs = append(addrs, resolver.Address{Addr: ep})
+		}
+		if err = cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+			log.Printf("resolver update %s://%s err: %v", b.scheme, target.Endpoint, err)
+		}
+	})
+	return w, nil
+}
+
+func (b *resolverBuilder) Scheme() string {
+	return b.scheme
+}
+
+type watchResolver struct {
+	stop func()
+}
+
+func (w *watchResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (w *watchResolver) Close() {
+	w.stop()
+}
+
+// MemoryResolver is an in-memory registry, mostly for tests. The updates are called without its lock held,
+// one at a time in the order of the changes, so they must not change the resolver themselves
+type MemoryResolver struct {
+	sync.Mutex
+	targets  map[string][]string
+	watchers map[string]map[int]func([]string, error)
+	next     int
+
+	// notifyMu orders the updates of concurrent changes
+	notifyMu sync.Mutex
+}
+
+func NewMemoryResolver() *MemoryResolver {
+	return &MemoryResolver{
+		targets:  make(map[string][]string),
+		watchers: make(map[string]map[int]func([]string, error)),
+	}
+}
+
+// Set replaces the endpoints of the target
+func (m *MemoryResolver) Set(target string, endpoints ...string) {
+	m.change(target, func(list []string) ([]string, bool) {
+		return append([]string(nil), endpoints...), true
+	})
+}
+
+// Add registers an endpoint of the target
+func (m *MemoryResolver) Add(target, endpoint string) {
+	m.change(target, func(list []string) ([]string, bool) {
+		for _, ep := range list {
+			if ep == endpoint {
+				return list, false
+			}
+		}
+		return append(list, endpoint), true
+	})
+}
+
+// Remove deregisters an endpoint of the target
+func (m *MemoryResolver) Remove(target, endpoint string) {
+	m.change(target, func(list []string) ([]string, bool) {
+		kept := list[:0:0]
+		for _, ep := range list {
+			if ep != endpoint {
+				kept = append(kept, ep)
+			}
+		}
+		return kept, true
+	})
+}
+
+func (m *MemoryResolver) Watch(target string, update func([]string, error)) func() {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.Lock()
+	id := m.next
+	m.next++
+	if m.watchers[target] == nil {
+		m.watchers[target] = make(map[int]func([]string, error))
+	}
+	m.watchers[target][id] = update
+	list, ok := m.targets[target]
+	m.Unlock()
+
+	if ok {
+		update(append([]string(nil), list...), nil)
+	}
+	return func() {
+		m.Lock()
+		delete(m.watchers[target], id)
+		m.Unlock()
+	}
+}
+
+// change applies fn to the endpoints of the target and notifies the watchers if it changed them
+func (m *MemoryResolver) change(target string, fn func(list []string) ([]string, bool)) {
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.Lock()
+	list, changed := fn(m.targets[target])
+	if !changed {
+		m.Unlock()
+		return
+	}
+	m.targets[target] = list
+	updates := make([]func([]string, error), 0, len(m.watchers[target]))
+	for _, update := range m.watchers[target] {
+		updates = append(updates, update)
+	}
+	m.Unlock()
+
+	for _, update := range updates {
+		update(append([]string(nil), list...), nil)
+	}
+}
+
+// DNSResolver resolves targets like "_grpc._tcp.example.com" with DNS SRV records and polls them
+type DNSResolver struct {
+	Interval time.Duration
+	Resolver *net.Resolver
+}
+
+func NewDNSResolver(interval time.Duration) *DNSResolver {
+	if interval <= 0 {
+		interval = defaultResolveInterval
+	}
+	return &DNSResolver{Interval: interval, Resolver: net.DefaultResolver}
+}
+
+func (d *DNSResolver) Watch(target string, update func([]string, error)) func() {
+	return poll(d.Interval, func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultDialTimeout)
+		defer cancel()
+		_, srvs, err := d.Resolver.LookupSRV(ctx, "", "", target)
+		if err != nil {
+			return nil, err
+		}
+		list := make([]string, 0, len(srvs))
+		for _, srv := range srvs {
+			host := strings.TrimSuffix(srv.Target, ".")
+			list = append(list, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+		return list, nil
+	}, update)
+}
+
+// FileResolver reads the endpoints from a YAML or JSON file mapping each target to its endpoints,
+// the file is reloaded when it changes
+//
+//	orders: ["10.0.0.1:9000", "10.0.0.2:9000"]
+type FileResolver struct {
+	Path     string
+	Interval time.Duration
+}
+
+func NewFileResolver(path string, interval time.Duration) *FileResolver {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &FileResolver{Path: path, Interval: interval}
+}
+
+func (f *FileResolver) Watch(target string, update func([]string, error)) func() {
+	var modTime time.Time
+	var size int64
+	var last []string
+	return poll(f.Interval, func() ([]string, error) {
+		fi, err := os.Stat(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		if fi.ModTime().Equal(modTime) && fi.Size() == size {
+			return last, nil
+		}
+		b, err := os.ReadFile(f.Path)
+		if err != nil {
+			return nil, err
+		}
+		var targets map[string][]string
+		if err = yaml.Unmarshal(b, &targets); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", f.Path, err)
+		}
+		modTime, size = fi.ModTime(), fi.Size()
+		list, ok := targets[target]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNoEndpoints, target)
+		}
+		last = list
+		return list, nil
+	}, update)
+}
+
+// poll calls lookup now and at every interval, update is called on errors and when the endpoints change
+func poll(interval time.Duration, lookup func() ([]string, error), update func([]string, error)) func() {
+	exit := make(chan struct{})
+	var once sync.Once
+	go func() {
+		var last []string
+		first := true
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			list, err := lookup()
+			if err != nil {
+				update(nil, err)
+			} else {
+				list = append([]string(nil), list...)
+				sort.Strings(list)
+				if first || !equalStrings(list, last) {
+					first, last = false, list
+					update(append([]string(nil), list...), nil)
+				}
+			}
+			select {
+			case <-exit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() { close(exit) })
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetResolver lets the services be set with targets like "scheme:///target" resolved by r,
+// endpoints are then added and removed live
+func (sc *ServiceClientPool) SetResolver(scheme string, r Resolver) {
+	sc.addDialOption(grpc.WithResolvers(NewResolverBuilder(scheme, r)))
+}
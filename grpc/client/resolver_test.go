@@ -0,0 +1,178 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// endpointUpdates collects the updates of a watcher
+type endpointUpdates chan []string
+
+func (u endpointUpdates) update(endpoints []string, err error) {
+	if err != nil {
+		endpoints = []string{"error: " + err.Error()}
+	}
+	u <- endpoints
+}
+
+func (u endpointUpdates) next(t *testing.T) []string {
+	select {
+	case endpoints := <-u:
+		return endpoints
+	case <-time.After(2 * time.Second):
+		t.Fatal("no update")
+	}
+	return nil
+}
+
+func (u endpointUpdates) none(t *testing.T) {
+	select {
+	case endpoints := <-u:
+		t.Fatalf("unexpected update %v", endpoints)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryResolverWatch(t *testing.T) {
+	r := NewMemoryResolver()
+	r.Set("orders", "10.0.0.1:9000")
+
+	updates := make(endpointUpdates, 8)
+	stop := r.Watch("orders", updates.update)
+	assert.Equal(t, []string{"10.0.0.1:9000"}, updates.next(t))
+
+	r.Add("orders", "10.0.0.2:9000")
+	assert.Equal(t, []string{"10.0.0.1:9000", "10.0.0.2:9000"}, updates.next(t))
+	r.Add("orders", "10.0.0.2:9000")
+	updates.none(t)
+	r.Remove("orders", "10.0.0.1:9000")
+	assert.Equal(t, []string{"10.0.0.2:9000"}, updates.next(t))
+	// the other targets are not notified
+	r.Set("users", "10.0.0.3:9000")
+	updates.none(t)
+
+	stop()
+	r.Set("orders", "10.0.0.4:9000")
+	updates.none(t)
+}
+
+func TestMemoryResolverNotifiesOutsideLock(t *testing.T) {
+	r := NewMemoryResolver()
+	var seen int32
+	stop := r.Watch("orders", func(endpoints []string, err error) {
+		// the watcher may look at the resolver while it is notified
+		r.Lock()
+		atomic.AddInt32(&seen, int32(len(r.targets["orders"])))
+		r.Unlock()
+	})
+	defer stop()
+
+	done := make(chan struct{})
+	go func() {
+		r.Set("orders", "10.0.0.1:9000", "10.0.0.2:9000")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the update deadlocked on the resolver lock")
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&seen))
+}
+
+// writeFile replaces the file at once, a poller never reads it half written
+func writeFile(t *testing.T, path, content string) {
+	tmp := path + ".tmp"
+	assert.NoError(t, os.WriteFile(tmp, []byte(content), 0o644))
+	assert.NoError(t, os.Rename(tmp, path))
+}
+
+func TestFileResolverWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "endpoints.yaml")
+	writeFile(t, path, "orders: [\"10.0.0.2:9000\", \"10.0.0.1:9000\"]\n")
+
+	f := NewFileResolver(path, 10*time.Millisecond)
+	updates := make(endpointUpdates, 8)
+	stop := f.Watch("orders", updates.update)
+	defer stop()
+	// the endpoints are sorted
+	assert.Equal(t, []string{"10.0.0.1:9000", "10.0.0.2:9000"}, updates.next(t))
+
+	// the same endpoints in another order are not an update
+	writeFile(t, path, "orders:\n  - 10.0.0.1:9000\n  - 10.0.0.2:9000\n")
+	updates.none(t)
+
+	writeFile(t, path, "{\"orders\": [\"10.0.0.3:9000\"]}")
+	assert.Equal(t, []string{"10.0.0.3:9000"}, updates.next(t))
+
+	missing := make(endpointUpdates, 8)
+	stopMissing := f.Watch("users", missing.update)
+	defer stopMissing()
+	assert.Contains(t, missing.next(t)[0], ErrNoEndpoints.Error())
+}
+
+func TestRegisterResolver(t *testing.T) {
+	r := NewMemoryResolver()
+	RegisterResolver("memory-test", r)
+	b := resolver.Get("memory-test")
+	if assert.NotNil(t, b) {
+		assert.Equal(t, "memory-test", b.Scheme())
+	}
+}
+
+// serveHealth serves h on a bufconn listener
+func serveHealth(t *testing.T, h *testHealth) *bufconn.Listener {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, h)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l
+}
+
+func TestResolverAddressUpdates(t *testing.T) {
+	ok := func(n int32) (*grpc_health_v1.HealthCheckResponse, error) {
+		return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+	}
+	ha, hb := &testHealth{check: ok}, &testHealth{check: ok}
+	listeners := map[string]*bufconn.Listener{"a:1": serveHealth(t, ha), "b:1": serveHealth(t, hb)}
+
+	r := NewMemoryResolver()
+	r.Set("health", "a:1")
+	cc, err := grpc.Dial("memory:///health",
+		grpc.WithResolvers(NewResolverBuilder("memory", r)),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			if l, ok := listeners[addr]; ok {
+				return l.DialContext(ctx)
+			}
+			return nil, errors.New("unknown endpoint " + addr)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer cc.Close()
+	client := grpc_health_v1.NewHealthClient(cc)
+
+	_, err = client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ha.calls))
+
+	// the calls move to the new endpoint once the resolver drops the old one
+	r.Set("health", "b:1")
+	assert.Eventually(t, func() bool {
+		_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		return err == nil && atomic.LoadInt32(&hb.calls) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
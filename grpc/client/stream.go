@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrNilResumer = errors.New("resumable stream without resumer")
+
+	defaultStreamReconnects   = 5
+	defaultStreamRetryBackoff = 100 * time.Millisecond
+)
+
+// StreamResumer brings a stream reopened after a transient failure back to where the failed one was,
+// e.g. sends the subscription again with the offset of the last message received. attempt counts the
+// reconnections in a row from 1, an Unavailable error makes another attempt
+type StreamResumer func(ctx context.Context, stream grpc.ClientStream, attempt int) error
+
+// NewStream opens a server, client or bidi stream on a connection of the pool of the method's service,
+// the headers are merged into the outgoing metadata the way Invoke does
+func (sc *ServiceClientPool) NewStream(
+	ctx context.Context,
+	fullMethod string,
+	headers map[string]string,
+	desc *grpc.StreamDesc,
+	opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	conn, err := sc.GetClientWithFullMethod(fullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = withHeaders(ctx, headers)
+	return conn.NewStream(ctx, desc, fullMethod, opts...)
+}
+
+// NewResumableStream opens a stream like NewStream which reconnects when it fails with Unavailable:
+// it is reopened on a connection of the pool, resume restores its state and the failed RecvMsg is
+// retried on it. A failed SendMsg returns io.EOF as usual, the following RecvMsg reconnects, so resume
+// must send again the messages the server has not acknowledged. CloseSend is repeated after resume.
+// resume is required, ErrNilResumer is returned without it
+func (sc *ServiceClientPool) NewResumableStream(
+	ctx context.Context,
+	fullMethod string,
+	headers map[string]string,
+	desc *grpc.StreamDesc,
+	resume StreamResumer,
+	opts ...grpc.CallOption,
+) (grpc.ClientStream, error) {
+	if resume == nil {
+		return nil, ErrNilResumer
+	}
+	s := &resumableStream{
+		sc:     sc,
+		ctx:    withHeaders(ctx, headers),
+		method: fullMethod,
+		desc:   desc,
+		opts:   opts,
+		resume: resume,
+	}
+	cs, cancel, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	s.cs, s.cancel = cs, cancel
+	return s, nil
+}
+
+type resumableStream struct {
+	sc     *ServiceClientPool
+	ctx    context.Context
+	method string
+	desc   *grpc.StreamDesc
+	opts   []grpc.CallOption
+	resume StreamResumer
+
+	mu        sync.Mutex
+	cs        grpc.ClientStream
+	cancel    context.CancelFunc
+	closeSent bool
+	// reconnecting is closed once the running reconnection is over, reconnectErr then tells how it went
+	reconnecting chan struct{}
+	reconnectErr error
+}
+
+// open opens the underlying stream with its own context, so a replaced one is released
+func (s *resumableStream) open() (grpc.ClientStream, context.CancelFunc, error) {
+	conn, err := s.sc.GetClientWithFullMethod(s.method)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	cs, err := conn.NewStream(ctx, s.desc, s.method, s.opts...)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return cs, cancel, nil
+}
+
+func (s *resumableStream) current() grpc.ClientStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cs
+}
+
+// reconnect replaces the failed stream, unless another goroutine did it already. The lock is not held
+// while the stream is reopened, resumed or while waiting between the attempts
+func (s *resumableStream) reconnect(failed grpc.ClientStream) error {
+	s.mu.Lock()
+	if s.cs != failed {
+		s.mu.Unlock()
+		return nil
+	}
+	if done := s.reconnecting; done != nil {
+		s.mu.Unlock()
+		select {
+		case <-done:
+		case <-s.ctx.Done():
+			return status.FromContextError(s.ctx.Err()).Err()
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.cs != failed {
+			return nil
+		}
+		return s.reconnectErr
+	}
+	done := make(chan struct{})
+	s.reconnecting = done
+	s.mu.Unlock()
+
+	err := s.retry()
+	s.mu.Lock()
+	s.reconnecting, s.reconnectErr = nil, err
+	s.mu.Unlock()
+	close(done)
+	return err
+}
+
+// retry reopens and resumes the stream with a backoff until it works or fails with another code than
+// Unavailable
+func (s *resumableStream) retry() error {
+	max := s.sc.option.StreamReconnects
+	if max <= 0 {
+		max = defaultStreamReconnects
+	}
+	backoff := defaultStreamRetryBackoff
+	var err error
+	for attempt := 1; attempt <= max; attempt++ {
+		var cs grpc.ClientStream
+		var cancel context.CancelFunc
+		cs, cancel, err = s.open()
+		if err == nil {
+			if err = s.resume(s.ctx, cs, attempt); err == nil {
+				s.mu.Lock()
+				if s.closeSent {
+					err = cs.CloseSend()
+				}
+				if err == nil {
+					s.cancel()
+					s.cs, s.cancel = cs, cancel
+				}
+				s.mu.Unlock()
+				if err == nil {
+					return nil
+				}
+			}
+			cancel()
+		}
+		if status.Code(err) != codes.Unavailable {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-s.ctx.Done():
+			timer.Stop()
+			return status.FromContextError(s.ctx.Err()).Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > defaultBackoffMaxDelay {
+			backoff = defaultBackoffMaxDelay
+		}
+	}
+	return err
+}
+
+func (s *resumableStream) RecvMsg(m interface{}) error {
+	for {
+		cs := s.current()
+		err := cs.RecvMsg(m)
+		if err == nil {
+			return nil
+		}
+		if status.Code(err) == codes.Unavailable && s.ctx.Err() == nil {
+			if err = s.reconnect(cs); err == nil {
+				continue
+			}
+		}
+		s.mu.Lock()
+		s.cancel()
+		s.mu.Unlock()
+		return err
+	}
+}
+
+func (s *resumableStream) SendMsg(m interface{}) error {
+	return s.current().SendMsg(m)
+}
+
+func (s *resumableStream) CloseSend() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeSent = true
+	return s.cs.CloseSend()
+}
+
+func (s *resumableStream) Header() (metadata.MD, error) {
+	return s.current().Header()
+}
+
+func (s *resumableStream) Trailer() metadata.MD {
+	return s.current().Trailer()
+}
+
+func (s *resumableStream) Context() context.Context {
+	return s.current().Context()
+}
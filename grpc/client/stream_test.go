@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const healthWatch = "/grpc.health.v1.Health/Watch"
+
+// countingHealth streams the numbers from the one in the request's service up to total as statuses,
+// the first stream breaks with Unavailable after breakAfter of them unless it is 0
+type countingHealth struct {
+	grpc_health_v1.UnimplementedHealthServer
+	total      int
+	breakAfter int
+	streams    int32
+}
+
+func (h *countingHealth) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	from, err := strconv.Atoi(req.Service)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	first := atomic.AddInt32(&h.streams, 1) == 1
+	for i := from; i < h.total; i++ {
+		if first && h.breakAfter > 0 && i-from == h.breakAfter {
+			return status.Error(codes.Unavailable, "connection lost")
+		}
+		if err := stream.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_ServingStatus(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newStreamPool gets a started pool serving the health service of h over bufconn
+func newStreamPool(t *testing.T, h grpc_health_v1.HealthServer) *ServiceClientPool {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, h)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	sc := NewServiceClientPool(&Option{
+		DialOptions: []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		},
+	})
+	sc.SetServices("bufnet", grpc_health_v1.Health_ServiceDesc.ServiceName)
+	assert.NoError(t, sc.Start())
+	t.Cleanup(sc.CloseAll)
+	return sc
+}
+
+var watchDesc = &grpc.StreamDesc{StreamName: "Watch", ServerStreams: true}
+
+func TestResumableStream(t *testing.T) {
+	sc := newStreamPool(t, &countingHealth{total: 6, breakAfter: 3})
+	var received, resumed int
+	resume := func(ctx context.Context, cs grpc.ClientStream, attempt int) error {
+		resumed = attempt
+		// the server starts again after the last message received
+		return cs.SendMsg(&grpc_health_v1.HealthCheckRequest{Service: strconv.Itoa(received)})
+	}
+	cs, err := sc.NewResumableStream(context.Background(), healthWatch, nil, watchDesc, resume)
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg(&grpc_health_v1.HealthCheckRequest{Service: "0"}))
+	assert.NoError(t, cs.CloseSend())
+
+	for {
+		resp := &grpc_health_v1.HealthCheckResponse{}
+		err := cs.RecvMsg(resp)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, received, int(resp.Status))
+		received++
+	}
+	assert.Equal(t, 6, received)
+	assert.Equal(t, 1, resumed)
+}
+
+func TestResumableStreamOtherErrors(t *testing.T) {
+	h := &countingHealth{total: 6, breakAfter: 3}
+	sc := newStreamPool(t, h)
+	_, err := sc.NewResumableStream(context.Background(), healthWatch, nil, watchDesc, nil)
+	assert.Equal(t, ErrNilResumer, err)
+
+	// an error other than Unavailable is returned as is, so is the one of resume
+	cs, err := sc.NewResumableStream(context.Background(), healthWatch, nil, watchDesc, func(ctx context.Context, cs grpc.ClientStream, attempt int) error {
+		return status.Error(codes.FailedPrecondition, "offset lost")
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg(&grpc_health_v1.HealthCheckRequest{Service: "0"}))
+	assert.NoError(t, cs.CloseSend())
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, cs.RecvMsg(&grpc_health_v1.HealthCheckResponse{}))
+	}
+	assert.Equal(t, codes.FailedPrecondition, status.Code(cs.RecvMsg(&grpc_health_v1.HealthCheckResponse{})))
+
+	cs, err = sc.NewResumableStream(context.Background(), healthWatch, nil, watchDesc, func(context.Context, grpc.ClientStream, int) error {
+		t.Error("resumed a stream which did not break")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, cs.SendMsg(&grpc_health_v1.HealthCheckRequest{Service: "x"}))
+	assert.NoError(t, cs.CloseSend())
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.RecvMsg(&grpc_health_v1.HealthCheckResponse{})))
+}
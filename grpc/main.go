@@ -15,7 +15,9 @@ func main()  {
 func RunClient()  {
 	pool := client.NewDefaultPool()
 	pool.SetServices("127.0.0.1:6868", "hello.HelloServer")
-	pool.Start()
+	if err := pool.Start(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func RunServer()  {
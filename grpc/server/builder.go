@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/grpc-ecosystem/go-grpc-middleware"
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"google.golang.org/grpc"
@@ -16,6 +17,9 @@ type GrpcServerBuilder struct {
 	enabledReflection bool
 	enabledPrometheus bool
 	enabledHealth     bool
+	enabledGateway    bool
+	gatewayAddr       string
+	tlsConfig         *tls.Config
 }
 
 func (b *GrpcServerBuilder) EnableReflection() {
@@ -30,6 +34,16 @@ func (b *GrpcServerBuilder) EnabledHealth() {
 	b.enabledHealth = true
 }
 
+// EnableGateway serves an HTTP/JSON gateway to the registered services, on the gRPC port when addr is
+// empty, the connections are then told apart by their first bytes. With SetTLSCert the gateway serves
+// HTTPS with the TLS config of the server, so its clients show a certificate too, and it needs an addr
+// of its own, Start fails without it. The gateway then calls the server with the server certificate,
+// which must be valid for client auth
+func (b *GrpcServerBuilder) EnableGateway(addr string) {
+	b.enabledGateway = true
+	b.gatewayAddr = addr
+}
+
 func (b *GrpcServerBuilder) AddOption(opt grpc.ServerOption) {
 	b.options = append(b.options, opt)
 }
@@ -50,7 +64,8 @@ func (b *GrpcServerBuilder) SetUnaryInterceptors(interceptors ...grpc.UnaryServe
 }
 
 func (b *GrpcServerBuilder) SetTLSCert(serverKeyPath, serverPemPath, caPemPath string) {
-	cred := setCert(serverKeyPath, serverPemPath, caPemPath)
+	cred, config := setCert(serverKeyPath, serverPemPath, caPemPath)
+	b.tlsConfig = config
 	b.AddOption(cred)
 }
 
@@ -83,7 +98,11 @@ func (b *GrpcServerBuilder) Build() GrpcServer {
 
 		grpc_health_v1.RegisterHealthServer(srv, &HealthImpl{})
 	}
-	return &grpcServer{srv, nil}
+	s := &grpcServer{server: srv}
+	if b.enabledGateway {
+		s.gateway = newGateway(b.gatewayAddr, b.tlsConfig)
+	}
+	return s
 }
 
 type HealthImpl struct{}
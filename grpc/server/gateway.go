@@ -0,0 +1,634 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	// MetadataHeaderPrefix marks the HTTP headers forwarded as gRPC metadata, and the gRPC headers
+	// returned as HTTP headers
+	MetadataHeaderPrefix = "Grpc-Metadata-"
+
+	defaultGatewayShutdown = 10 * time.Second
+	maxGatewayBody         = 4 << 20
+
+	// the reads are bounded, not the writes which last as long as a server streaming reply
+	defaultGatewayReadHeaderTimeout = 10 * time.Second
+	defaultGatewayReadTimeout       = 30 * time.Second
+	defaultGatewayIdleTimeout       = 2 * time.Minute
+	maxGatewayHeaderBytes           = 64 << 10
+)
+
+// ErrGatewayTLSAddr is returned by Start and StartWithListener when the gateway shares the port of a server with TLS, the
+// HTTP/2 preface the connections are told apart by is encrypted
+var ErrGatewayTLSAddr = errors.New("grpc gateway needs an addr of its own with TLS")
+
+// gateway transcodes HTTP/JSON requests into calls to the services of the server. The routes come
+// from the google.api.http annotations of the methods, the methods without one are served on
+// POST /package.Service/Method with the request as body. Client and bidi streaming methods are
+// not served, a server streaming one replies with a JSON object per line
+type gateway struct {
+	addr   string
+	tls    *tls.Config
+	pipe   *childListener
+	conn   *grpc.ClientConn
+	http   *http.Server
+	routes []*route
+}
+
+type route struct {
+	verb         string
+	path         *pathTemplate
+	method       protoreflect.MethodDescriptor
+	fullMethod   string
+	body         string
+	responseBody string
+}
+
+func newGateway(addr string, config *tls.Config) *gateway {
+	g := &gateway{addr: addr, tls: config, pipe: newChildListener(pipeAddr{})}
+	g.http = &http.Server{
+		Handler:           g,
+		ReadHeaderTimeout: defaultGatewayReadHeaderTimeout,
+		ReadTimeout:       defaultGatewayReadTimeout,
+		IdleTimeout:       defaultGatewayIdleTimeout,
+		MaxHeaderBytes:    maxGatewayHeaderBytes,
+	}
+	if config != nil {
+		g.http.TLSConfig = config.Clone()
+	}
+	return g
+}
+
+// start serves the gateway, it returns the listener the gRPC server serves instead of l
+func (g *gateway) start(srv *grpc.Server, l net.Listener) (net.Listener, error) {
+	if g.tls != nil && g.addr == "" {
+		return nil, ErrGatewayTLSAddr
+	}
+	routes, err := buildRoutes(srv)
+	if err != nil {
+		return nil, err
+	}
+	g.routes = routes
+	// the gateway calls the server over an in-memory connection, through its interceptors
+	go srv.Serve(g.pipe)
+	g.conn, err = grpc.Dial("passthrough:///gateway",
+		grpc.WithContextDialer(g.pipe.dial),
+		grpc.WithTransportCredentials(g.pipeCredentials()))
+	if err != nil {
+		return nil, err
+	}
+
+	var hl net.Listener
+	if g.addr == "" {
+		m := newMuxListener(l)
+		go m.serve()
+		hl, l = m.http, m
+	} else if hl, err = net.Listen("tcp", g.addr); err != nil {
+		g.conn.Close()
+		return nil, err
+	}
+	go func() {
+		var err error
+		if g.tls != nil {
+			err = g.http.ServeTLS(hl, "", "")
+		} else {
+			err = g.http.Serve(hl)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("grpc gateway serve err: %v", err)
+		}
+	}()
+	return l, nil
+}
+
+// pipeCredentials gets the credentials of the in-memory connection, with TLS the server requires a
+// client certificate so the gateway shows its own and only trusts the same one back
+func (g *gateway) pipeCredentials() credentials.TransportCredentials {
+	if g.tls == nil {
+		return insecure.NewCredentials()
+	}
+	certs := g.tls.Certificates
+	return credentials.NewTLS(&tls.Config{
+		Certificates: certs,
+		// the name of the server certificate is unknown here, the peer is checked below instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 || len(certs) == 0 || !bytes.Equal(raw[0], certs[0].Certificate[0]) {
+				return errors.New("grpc gateway pipe: unexpected server certificate")
+			}
+			return nil
+		},
+	})
+}
+
+// stop lets the HTTP requests in flight finish, the gRPC server must be stopped after it
+func (g *gateway) stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultGatewayShutdown)
+	defer cancel()
+	g.http.Shutdown(ctx)
+	if g.conn != nil {
+		g.conn.Close()
+	}
+	g.pipe.Close()
+}
+
+// buildRoutes maps the methods of the registered services, sorted for a stable matching order
+func buildRoutes(srv *grpc.Server) ([]*route, error) {
+	info := srv.GetServiceInfo()
+	names := make([]string, 0, len(info))
+	for name := range info {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var routes []*route
+	for _, name := range names {
+		desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			log.Printf("grpc gateway skips service %s: %v", name, err)
+			continue
+		}
+		sd, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		for i := 0; i < sd.Methods().Len(); i++ {
+			md := sd.Methods().Get(i)
+			if md.IsStreamingClient() {
+				continue
+			}
+			fullMethod := fmt.Sprintf("/%s/%s", sd.FullName(), md.Name())
+			rule, _ := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+			if rule == nil || rule.GetPattern() == nil {
+				rule = &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: fullMethod}, Body: "*"}
+			}
+			for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+				rt, err := newRoute(md, fullMethod, r)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", fullMethod, err)
+				}
+				routes = append(routes, rt)
+			}
+		}
+	}
+	return routes, nil
+}
+
+func newRoute(md protoreflect.MethodDescriptor, fullMethod string, rule *annotations.HttpRule) (*route, error) {
+	var verb, path string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		verb, path = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		verb, path = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		verb, path = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		verb, path = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		verb, path = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		verb, path = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("no http pattern")
+	}
+	tmpl, err := parseTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	return &route{
+		verb:         verb,
+		path:         tmpl,
+		method:       md,
+		fullMethod:   fullMethod,
+		body:         rule.GetBody(),
+		responseBody: rule.GetResponseBody(),
+	}, nil
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, rt := range g.routes {
+		if rt.verb != r.Method {
+			continue
+		}
+		if vars, ok := rt.path.match(r.URL.EscapedPath()); ok {
+			g.serve(w, r, rt, vars)
+			return
+		}
+	}
+	writeError(w, status.Errorf(codes.NotFound, "no route for %s %s", r.Method, r.URL.Path))
+}
+
+func (g *gateway) serve(w http.ResponseWriter, r *http.Request, rt *route, vars map[string]string) {
+	in, err := rt.request(r, vars)
+	if err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	ctx := metadata.NewOutgoingContext(r.Context(), incomingMetadata(r))
+
+	var header metadata.MD
+	if !rt.method.IsStreamingServer() {
+		out := dynamicpb.NewMessage(rt.method.Output())
+		if err = g.conn.Invoke(ctx, rt.fullMethod, in, out, grpc.Header(&header)); err != nil {
+			writeError(w, err)
+			return
+		}
+		b, err := rt.response(out)
+		if err != nil {
+			writeError(w, status.Error(codes.Internal, err.Error()))
+			return
+		}
+		writeHeader(w, header, "application/json")
+		w.Write(b)
+		return
+	}
+
+	stream, err := g.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, rt.fullMethod)
+	if err == nil {
+		err = stream.SendMsg(in)
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	if err == nil {
+		header, err = stream.Header()
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeHeader(w, header, "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	for {
+		out := dynamicpb.NewMessage(rt.method.Output())
+		if err = stream.RecvMsg(out); err != nil {
+			break
+		}
+		var b []byte
+		if b, err = rt.response(out); err != nil {
+			break
+		}
+		w.Write(append(b, '\n'))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err != io.EOF {
+		// the status is already sent, the error ends the stream as its last line
+		b, _ := protojson.Marshal(status.Convert(err).Proto())
+		w.Write(append(b, '\n'))
+	}
+}
+
+// request builds the request from the body, the path variables and the query parameters
+func (rt *route) request(r *http.Request, vars map[string]string) (proto.Message, error) {
+	in := dynamicpb.NewMessage(rt.method.Input())
+	if rt.body != "" {
+		b, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxGatewayBody))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > 0 {
+			if rt.body != "*" {
+				fd := in.Descriptor().Fields().ByName(protoreflect.Name(rt.body))
+				if fd == nil {
+					return nil, fmt.Errorf("unknown body field %s", rt.body)
+				}
+				b = []byte(fmt.Sprintf(`{%q: %s}`, fd.JSONName(), b))
+			}
+			if err = protojson.Unmarshal(b, in); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for field, value := range vars {
+		if err := setField(in, field, value); err != nil {
+			return nil, err
+		}
+	}
+	if rt.body == "*" {
+		return in, nil
+	}
+	for key, values := range r.URL.Query() {
+		if _, ok := vars[key]; ok || key == rt.body {
+			continue
+		}
+		for _, v := range values {
+			if err := setField(in, key, v); err == errUnknownField {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return in, nil
+}
+
+// response renders the reply, or only its response_body field
+func (rt *route) response(out proto.Message) ([]byte, error) {
+	b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(out)
+	if err != nil || rt.responseBody == "" {
+		return b, err
+	}
+	fd := out.ProtoReflect().Descriptor().Fields().ByName(protoreflect.Name(rt.responseBody))
+	if fd == nil {
+		return nil, fmt.Errorf("unknown response body field %s", rt.responseBody)
+	}
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	return fields[fd.JSONName()], nil
+}
+
+var errUnknownField = fmt.Errorf("unknown field")
+
+// setField sets a field given by its dotted path from a path or query string, a repeated field
+// gets the value appended
+func setField(msg protoreflect.Message, path, value string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fields := msg.Descriptor().Fields()
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = fields.ByJSONName(name)
+		}
+		if fd == nil {
+			return errUnknownField
+		}
+		if i < len(names)-1 {
+			if fd.Message() == nil || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field %s is not a message", path)
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+		if fd.IsMap() {
+			return fmt.Errorf("map field %s can not be set from a string", path)
+		}
+		v, err := parseValue(msg, fd, value)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", path, err)
+		}
+		if fd.IsList() {
+			msg.Mutable(fd).List().Append(v)
+		} else {
+			msg.Set(fd, v)
+		}
+	}
+	return nil
+}
+
+func parseValue(msg protoreflect.Message, fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	case protoreflect.MessageKind:
+		// well known types like google.protobuf.Timestamp take their JSON string form
+		m := msg.NewField(fd).Message()
+		if fd.IsList() {
+			m = msg.Mutable(fd).List().NewElement().Message()
+		}
+		err := protojson.Unmarshal([]byte(strconv.Quote(s)), m.Interface())
+		return protoreflect.ValueOfMessage(m), err
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported kind %v", fd.Kind())
+}
+
+// incomingMetadata forwards the authorization and the Grpc-Metadata- headers
+func incomingMetadata(r *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for key, values := range r.Header {
+		switch {
+		case key == "Authorization":
+			md.Append("authorization", values...)
+		case strings.HasPrefix(key, MetadataHeaderPrefix):
+			md.Append(strings.ToLower(key[len(MetadataHeaderPrefix):]), values...)
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		md.Append("x-forwarded-for", host)
+	}
+	return md
+}
+
+func writeHeader(w http.ResponseWriter, md metadata.MD, contentType string) {
+	for key, values := range md {
+		for _, v := range values {
+			w.Header().Add(MetadataHeaderPrefix+key, v)
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+}
+
+// writeError replies with the HTTP status of the gRPC code and the google.rpc.Status as body
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	b, _ := protojson.Marshal(st.Proto())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	w.Write(b)
+}
+
+// httpStatus maps a gRPC code to an HTTP status, refer to google/rpc/code.proto
+func httpStatus(c codes.Code) int {
+	switch c {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// pathTemplate is a google.api.http path like "/v1/{name=shelves/*}/books/{id}:publish"
+type pathTemplate struct {
+	segments []string
+	verb     string
+	vars     []pathVar
+}
+
+// pathVar binds the segments [start, end) to a field, end is -1 for a trailing "**"
+type pathVar struct {
+	field      string
+	start, end int
+}
+
+func parseTemplate(path string) (*pathTemplate, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path %q does not start with /", path)
+	}
+	t := &pathTemplate{}
+	rest := path[1:]
+	if i := strings.LastIndexByte(rest, ':'); i >= 0 && !strings.ContainsAny(rest[i:], "/}") {
+		rest, t.verb = rest[:i], rest[i+1:]
+	}
+	for rest != "" {
+		var seg string
+		if strings.HasPrefix(rest, "{") {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("path %q has an unclosed variable", path)
+			}
+			field, pattern := rest[1:end], "*"
+			if i := strings.IndexByte(field, '='); i >= 0 {
+				field, pattern = field[:i], field[i+1:]
+			}
+			v := pathVar{field: field, start: len(t.segments)}
+			t.segments = append(t.segments, strings.Split(pattern, "/")...)
+			v.end = len(t.segments)
+			t.vars = append(t.vars, v)
+			rest = strings.TrimPrefix(rest[end+1:], "/")
+			continue
+		}
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			seg, rest = rest[:i], rest[i+1:]
+		} else {
+			seg, rest = rest, ""
+		}
+		t.segments = append(t.segments, seg)
+	}
+	for i, seg := range t.segments {
+		if seg == "**" && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("path %q has ** before its end", path)
+		}
+	}
+	return t, nil
+}
+
+// match matches an escaped URL path, it returns the values of the variables
+func (t *pathTemplate) match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+	if t.verb != "" {
+		if !strings.HasSuffix(path, ":"+t.verb) {
+			return nil, false
+		}
+		path = path[:len(path)-len(t.verb)-1]
+	}
+	parts := strings.Split(path, "/")
+	n := len(t.segments)
+	if n > 0 && t.segments[n-1] == "**" {
+		if len(parts) < n-1 {
+			return nil, false
+		}
+	} else if len(parts) != n {
+		return nil, false
+	}
+	for i, seg := range t.segments {
+		switch seg {
+		case "**":
+		case "*":
+			if parts[i] == "" {
+				return nil, false
+			}
+		default:
+			if parts[i] != seg {
+				return nil, false
+			}
+		}
+	}
+
+	vars := make(map[string]string, len(t.vars))
+	for _, v := range t.vars {
+		end := v.end
+		if end == n && t.segments[n-1] == "**" {
+			end = len(parts)
+		}
+		value := strings.Join(parts[v.start:end], "/")
+		if end-v.start == 1 {
+			var err error
+			if value, err = url.PathUnescape(value); err != nil {
+				return nil, false
+			}
+		}
+		vars[v.field] = value
+	}
+	return vars, true
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tmpl, err := parseTemplate("/v1/{name=shelves/*}/books/{id}:publish")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"v1", "shelves", "*", "books", "*"}, tmpl.segments)
+	assert.Equal(t, "publish", tmpl.verb)
+	assert.Equal(t, []pathVar{{field: "name", start: 1, end: 3}, {field: "id", start: 4, end: 5}}, tmpl.vars)
+
+	// a colon inside a variable is not a verb
+	tmpl, err = parseTemplate("/v1/{name=a:b/*}")
+	assert.NoError(t, err)
+	assert.Empty(t, tmpl.verb)
+
+	for _, path := range []string{"v1/books", "/v1/{name", "/v1/**/books", "/v1/{name=**}/books"} {
+		_, err = parseTemplate(path)
+		assert.Error(t, err, path)
+	}
+}
+
+func TestTemplateMatch(t *testing.T) {
+	for _, c := range []struct {
+		template string
+		path     string
+		vars     map[string]string
+	}{
+		{"/v1/books/{id}", "/v1/books/42", map[string]string{"id": "42"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", map[string]string{"name": "shelves/1/books/2"}},
+		{"/v1/{name=files/**}", "/v1/files/a/b/c.txt", map[string]string{"name": "files/a/b/c.txt"}},
+		{"/v1/{name=files/**}", "/v1/files", map[string]string{"name": "files"}},
+		{"/v1/books/{id}:publish", "/v1/books/42:publish", map[string]string{"id": "42"}},
+		{"/v1/books", "/v1/books", map[string]string{}},
+		// a single segment is unescaped, a multi segment one keeps its escapes
+		{"/v1/books/{id}", "/v1/books/a%2Fb%20c", map[string]string{"id": "a/b c"}},
+		{"/v1/{name=shelves/*}", "/v1/shelves/a%2Fb", map[string]string{"name": "shelves/a%2Fb"}},
+	} {
+		tmpl, err := parseTemplate(c.template)
+		assert.NoError(t, err)
+		vars, ok := tmpl.match(c.path)
+		assert.True(t, ok, c.path)
+		assert.Equal(t, c.vars, vars, c.path)
+	}
+
+	for _, c := range []struct{ template, path string }{
+		{"/v1/books/{id}", "/v1/books"},
+		{"/v1/books/{id}", "/v1/books/"},
+		{"/v1/books/{id}", "/v1/books/42/pages"},
+		{"/v1/books/{id}", "v1/books/42"},
+		{"/v1/books/{id}:publish", "/v1/books/42"},
+		{"/v1/books/{id}:publish", "/v1/books/42:delete"},
+		{"/v1/{name=files/**}", "/v1/dirs/a"},
+		{"/v1/books/{id}", "/v1/books/%zz"},
+	} {
+		tmpl, err := parseTemplate(c.template)
+		assert.NoError(t, err)
+		_, ok := tmpl.match(c.path)
+		assert.False(t, ok, c.path)
+	}
+}
+
+func TestSetField(t *testing.T) {
+	msg := (&descriptorpb.FieldDescriptorProto{}).ProtoReflect()
+	assert.NoError(t, setField(msg, "name", "id"))
+	assert.NoError(t, setField(msg, "number", "7"))
+	assert.NoError(t, setField(msg, "label", "LABEL_REPEATED"))
+	assert.NoError(t, setField(msg, "type", "9"))
+	// by JSON name and through a nested message
+	assert.NoError(t, setField(msg, "jsonName", "ident"))
+	assert.NoError(t, setField(msg, "options.deprecated", "true"))
+	field := msg.Interface().(*descriptorpb.FieldDescriptorProto)
+	assert.Equal(t, "id", field.GetName())
+	assert.Equal(t, int32(7), field.GetNumber())
+	assert.Equal(t, descriptorpb.FieldDescriptorProto_LABEL_REPEATED, field.GetLabel())
+	assert.Equal(t, descriptorpb.FieldDescriptorProto_TYPE_STRING, field.GetType())
+	assert.Equal(t, "ident", field.GetJsonName())
+	assert.True(t, field.GetOptions().GetDeprecated())
+
+	assert.Equal(t, errUnknownField, setField(msg, "size", "1"))
+	assert.Error(t, setField(msg, "number", "seven"))
+	assert.Error(t, setField(msg, "name.first", "a"))
+
+	// a repeated field gets the values appended
+	desc := (&descriptorpb.DescriptorProto{}).ProtoReflect()
+	assert.NoError(t, setField(desc, "reserved_name", "a"))
+	assert.NoError(t, setField(desc, "reservedName", "b"))
+	assert.Equal(t, []string{"a", "b"}, desc.Interface().(*descriptorpb.DescriptorProto).GetReservedName())
+	assert.Error(t, setField(desc, "field.name", "a"))
+}
+
+func TestHTTPStatus(t *testing.T) {
+	for code, want := range map[codes.Code]int{
+		codes.OK:                 http.StatusOK,
+		codes.Canceled:           499,
+		codes.Unknown:            http.StatusInternalServerError,
+		codes.InvalidArgument:    http.StatusBadRequest,
+		codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+		codes.NotFound:           http.StatusNotFound,
+		codes.AlreadyExists:      http.StatusConflict,
+		codes.PermissionDenied:   http.StatusForbidden,
+		codes.ResourceExhausted:  http.StatusTooManyRequests,
+		codes.FailedPrecondition: http.StatusBadRequest,
+		codes.Aborted:            http.StatusConflict,
+		codes.OutOfRange:         http.StatusBadRequest,
+		codes.Unimplemented:      http.StatusNotImplemented,
+		codes.Internal:           http.StatusInternalServerError,
+		codes.Unavailable:        http.StatusServiceUnavailable,
+		codes.DataLoss:           http.StatusInternalServerError,
+		codes.Unauthenticated:    http.StatusUnauthorized,
+	} {
+		assert.Equal(t, want, httpStatus(code), code.String())
+	}
+}
+
+func TestGatewaySharedPort(t *testing.T) {
+	b := &GrpcServerBuilder{}
+	b.EnabledHealth()
+	b.EnableGateway("")
+	s := b.Build()
+	assert.NoError(t, s.Start("127.0.0.1:0"))
+	defer s.Stop()
+	addr := s.(*grpcServer).listener.Addr().String()
+
+	resp, err := http.Post("http://"+addr+"/grpc.health.v1.Health/Check", "application/json", strings.NewReader("{}"))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"status": "SERVING"}`, string(body))
+
+	resp, err = http.Get("http://" + addr + "/grpc.health.v1.Health/Check")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	h := s.(*grpcServer).gateway.http
+	assert.Equal(t, defaultGatewayReadHeaderTimeout, h.ReadHeaderTimeout)
+	assert.Equal(t, defaultGatewayReadTimeout, h.ReadTimeout)
+	assert.Equal(t, defaultGatewayIdleTimeout, h.IdleTimeout)
+	assert.Equal(t, maxGatewayHeaderBytes, h.MaxHeaderBytes)
+}
+
+func TestGatewayTLS(t *testing.T) {
+	certPath, keyPath, cert := newTestCert(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	b := &GrpcServerBuilder{}
+	b.SetTLSCert(keyPath, certPath, certPath)
+	b.EnabledHealth()
+	b.EnableGateway(addr)
+	s := b.Build()
+	assert.NoError(t, s.Start("127.0.0.1:0"))
+	defer s.Stop()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool}}}
+	resp, err := client.Post("https://"+addr+"/grpc.health.v1.Health/Check", "application/json", strings.NewReader("{}"))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"status": "SERVING"}`, string(body))
+
+	// the HTTP/2 preface can not be sniffed under TLS
+	b = &GrpcServerBuilder{}
+	b.SetTLSCert(keyPath, certPath, certPath)
+	b.EnableGateway("")
+	assert.Equal(t, ErrGatewayTLSAddr, b.Build().Start("127.0.0.1:0"))
+
+	// the listener of a failed start is left to the caller
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, ErrGatewayTLSAddr, b.Build().StartWithListener(l))
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	c.Close()
+}
+
+// newTestCert writes a self signed certificate valid for the server and the client auth
+func newTestCert(t *testing.T) (certPath, keyPath string, cert tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	assert.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+	assert.NoError(t, err)
+	cert.Leaf, err = x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return certPath, keyPath, cert
+}
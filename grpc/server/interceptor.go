@@ -4,7 +4,9 @@ import (
 	"context"
 	"github.com/grpc-ecosystem/go-grpc-prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"log"
 	"time"
 )
@@ -26,3 +28,15 @@ func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.Una
 
 	return resp, err
 }
+
+// UnaryServerDeadlineInterceptor rejects the requests arriving with less than minBudget left before
+// their deadline, the caller gives up on them anyway. The deadline carried by the context of the
+// handler is the one to pass to the outgoing calls, the client Deadlines shrinks it at every hop
+func UnaryServerDeadlineInterceptor(minBudget time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < minBudget {
+			return nil, status.Errorf(codes.DeadlineExceeded, "%s: deadline budget exhausted", info.FullMethod)
+		}
+		return handler(ctx, req)
+	}
+}
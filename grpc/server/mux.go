@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrListenerClosed = errors.New("listener closed")
+
+	// http2Preface starts every HTTP/2 connection, so every gRPC one
+	http2Preface = []byte("PRI * HTTP/2.0")
+
+	defaultSniffTimeout = 10 * time.Second
+)
+
+// muxListener splits the connections of a listener between gRPC and HTTP/1 by their first bytes,
+// Accept returns the gRPC ones and the HTTP/1 ones go to the http child
+type muxListener struct {
+	net.Listener
+	grpc *childListener
+	http *childListener
+}
+
+func newMuxListener(l net.Listener) *muxListener {
+	m := &muxListener{Listener: l}
+	m.grpc = newChildListener(l.Addr())
+	m.http = newChildListener(l.Addr())
+	return m
+}
+
+// serve accepts the connections until the listener is closed
+func (m *muxListener) serve() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			m.grpc.Close()
+			m.http.Close()
+			return
+		}
+		go m.sniff(conn)
+	}
+}
+
+// sniff hands a connection to the gRPC listener if it starts with the HTTP/2 preface
+func (m *muxListener) sniff(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(defaultSniffTimeout))
+	head, err := br.Peek(len(http2Preface))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && len(head) == 0 {
+		conn.Close()
+		return
+	}
+	target := m.http
+	if bytes.Equal(head, http2Preface) {
+		target = m.grpc
+	}
+	target.deliver(&peekedConn{Conn: conn, r: br})
+}
+
+func (m *muxListener) Accept() (net.Conn, error) {
+	return m.grpc.Accept()
+}
+
+func (m *muxListener) Close() error {
+	err := m.Listener.Close()
+	m.grpc.Close()
+	m.http.Close()
+	return err
+}
+
+// peekedConn replays the sniffed bytes before reading the connection
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// childListener is a listener fed with connections by another goroutine, it is also the
+// in-memory listener of the gateway
+type childListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	exit  chan struct{}
+	once  sync.Once
+}
+
+func newChildListener(addr net.Addr) *childListener {
+	return &childListener{addr: addr, conns: make(chan net.Conn), exit: make(chan struct{})}
+}
+
+func (l *childListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.exit:
+		conn.Close()
+	}
+}
+
+func (l *childListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.exit:
+		return nil, ErrListenerClosed
+	}
+}
+
+func (l *childListener) Close() error {
+	l.once.Do(func() { close(l.exit) })
+	return nil
+}
+
+func (l *childListener) Addr() net.Addr {
+	return l.addr
+}
+
+// dial connects to the listener over an in-memory pipe
+func (l *childListener) dial(ctx context.Context, _ string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.exit:
+		return nil, ErrListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -10,7 +10,7 @@ import (
 
 type GrpcServer interface {
 	Start(addr string) error
-	StartWithListener(l net.Listener)
+	StartWithListener(l net.Listener) error
 	RegisterService(func(*grpc.Server))
 	Await(func())
 	Stop()
@@ -19,21 +19,32 @@ type GrpcServer interface {
 type grpcServer struct {
 	server   *grpc.Server
 	listener net.Listener
+	gateway  *gateway
 }
 
-func (s *grpcServer) Start(addr string) (err error) {
-	s.listener, err = net.Listen("tcp", addr)
+func (s *grpcServer) Start(addr string) error {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		return
+		return err
 	}
-	go s.serve()
-	return
+	if err = s.StartWithListener(l); err != nil {
+		l.Close()
+	}
+	return err
 }
 
-func (s *grpcServer) StartWithListener(l net.Listener) {
+// StartWithListener serves the connections accepted by l, it fails when the gateway can not start
+// and l is then left to the caller
+func (s *grpcServer) StartWithListener(l net.Listener) error {
+	if s.gateway != nil {
+		var err error
+		if l, err = s.gateway.start(s.server, l); err != nil {
+			return err
+		}
+	}
 	s.listener = l
 	go s.serve()
-	return
+	return nil
 }
 
 func (s *grpcServer) serve() {
@@ -57,6 +68,9 @@ func (s *grpcServer) Await(hook func()) {
 }
 
 func (s *grpcServer) Stop() {
+	if s.gateway != nil {
+		s.gateway.stop()
+	}
 	s.server.GracefulStop()
 	s.listener.Close()
 }
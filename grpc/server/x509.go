@@ -3,20 +3,25 @@ package server
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"io/ioutil"
 	"log"
+	"os"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 )
 
-func setCert(serverKeyPath, serverPemPath, caPemPath string) grpc.ServerOption {
+func setCert(serverKeyPath, serverPemPath, caPemPath string) (grpc.ServerOption, *tls.Config) {
+	config := loadTLSConfig(serverKeyPath, serverPemPath, caPemPath)
+	return grpc.Creds(credentials.NewTLS(config)), config
+}
+
+func loadTLSConfig(serverKeyPath, serverPemPath, caPemPath string) *tls.Config {
 	cert, err := tls.LoadX509KeyPair(serverPemPath, serverKeyPath)
 	if err != nil {
 		log.Panic(err)
 	}
 	certPool := x509.NewCertPool()
-	ca, err := ioutil.ReadFile(caPemPath)
+	ca, err := os.ReadFile(caPemPath)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -29,13 +34,12 @@ func setCert(serverKeyPath, serverPemPath, caPemPath string) grpc.ServerOption {
 	//}
 	//certPool.AddCert(cert.Leaf)
 
-	cred := credentials.NewTLS(&tls.Config{
+	return &tls.Config{
 		// Set the certificate chain to allow one or more certificates to be included
 		Certificates: []tls.Certificate{cert},
 		// The client is required to carry a certificate and the client will authenticate (multiple options are supported)
 		ClientAuth: tls.RequireAndVerifyClientCert,
 		// Set the collection of root certificates. The verification method uses the policy set in ClientAuth
 		ClientCAs: certPool,
-	})
-	return grpc.Creds(cred)
+	}
 }
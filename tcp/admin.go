@@ -0,0 +1,208 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxAdminBody bounds the test message sent through the admin API
+const maxAdminBody = 1 << 20
+
+// SessionInfo is a snapshot of a live session
+type SessionInfo struct {
+	Sid         string    `json:"sid"`
+	Uid         string    `json:"uid"`
+	IP          string    `json:"ip"`
+	Authed      bool      `json:"authed"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	SendQueue   int       `json:"send_queue"`
+	RecvQueue   int       `json:"recv_queue"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+}
+
+// countingReader counts the bytes read from the connection
+type countingReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddUint64(r.n, uint64(n))
+	return n, err
+}
+
+// Info get a snapshot of the session
+func (s *Session) Info() SessionInfo {
+	info := SessionInfo{
+		Sid:      s.sid,
+		Uid:      s.GetUserID(),
+		LastSeen: time.Unix(s.GetLastTime(), 0),
+	}
+	if c := s.conn; c != nil {
+		if addr := c.GetClientIP(); addr != nil {
+			info.IP = addr.String()
+		}
+		info.Authed = c.IsAuthed()
+		info.ConnectedAt = c.connected
+		info.SendQueue = len(c.sendCh) + len(c.streamCh)
+		info.RecvQueue = len(c.msgCh)
+		info.BytesIn = atomic.LoadUint64(&c.bytesIn)
+		info.BytesOut = atomic.LoadUint64(&c.bytesOut)
+	}
+	return info
+}
+
+// extras copies the extra data of the session and of its connection
+func (s *Session) extras() map[string]map[string]interface{} {
+	s.mu.RLock()
+	sess := make(map[string]interface{}, len(s.extraMap))
+	for k, v := range s.extraMap {
+		sess[k] = v
+	}
+	s.mu.RUnlock()
+
+	conn := make(map[string]interface{})
+	if c := s.conn; c != nil {
+		c.RLock()
+		for k, v := range c.extraMap {
+			conn[k] = v
+		}
+		c.RUnlock()
+	}
+	return map[string]map[string]interface{}{"session": printable(sess), "conn": printable(conn)}
+}
+
+// printable keeps the values JSON can encode and formats the others
+func printable(m map[string]interface{}) map[string]interface{} {
+	for k, v := range m {
+		if _, err := json.Marshal(v); err != nil {
+			m[k] = fmt.Sprintf("%+v", v)
+		}
+	}
+	return m
+}
+
+// Sessions get a snapshot of every local session ordered by connection time
+func (s *Server) Sessions() []SessionInfo {
+	var list []SessionInfo
+	s.sessions.Range(func(key, value interface{}) bool {
+		list = append(list, value.(*Session).Info())
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ConnectedAt.Before(list[j].ConnectedAt)
+	})
+	return list
+}
+
+// AdminHandler serves the session introspection API, mount it under a prefix with http.StripPrefix:
+//
+//	GET  /sessions              list the sessions, ?uid= filters by user
+//	GET  /sessions/{sid}        show a session
+//	GET  /sessions/{sid}/extra  dump the extra data of the session and its connection
+//	POST /sessions/{sid}/kick   close the session, ?reason= is sent to the client
+//	POST /sessions/{sid}/send   send the request body, ?cmd= sets the command, Single by default
+//
+// it has no authentication of its own, do not expose it publicly
+func (s *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(s.serveAdmin)
+}
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "sessions" || len(parts) > 3 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		uid := r.URL.Query().Get("uid")
+		list := make([]SessionInfo, 0)
+		for _, info := range s.Sessions() {
+			if uid == "" || info.Uid == uid {
+				list = append(list, info)
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	v, ok := s.sessions.Load(parts[1])
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+	sess := v.(*Session)
+	action := ""
+	if len(parts) == 3 {
+		action = parts[2]
+	}
+
+	switch action {
+	case "":
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, sess.Info())
+		}
+	case "extra":
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, sess.extras())
+		}
+	case "kick":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		sess.GetConn().CloseWithReason(CloseKicked, r.URL.Query().Get("reason"))
+		writeJSON(w, http.StatusOK, map[string]string{"sid": sess.GetSessionID()})
+	case "send":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		cmd := Single
+		if v := r.URL.Query().Get("cmd"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid cmd"})
+				return
+			}
+			cmd = CMD(n)
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		sess.GetConn().SendMessage(NewMessage(cmd, data))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sid": sess.GetSessionID(), "bytes": len(data)})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Flog.Errorf("admin encode err: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandler(t *testing.T) {
+	s := newTestServer()
+	s.OnMessage(func(c *Conn, msg *Message) {
+		c.GetSession().BindUserID(string(msg.GetData()))
+		c.GetSession().SetExtraMap("room", "lobby")
+		c.SetExtraMap("ch", make(chan int))
+	})
+	admin := httptest.NewServer(http.StripPrefix("/admin", s.AdminHandler()))
+	defer admin.Close()
+
+	received := make(chan *Message, 1)
+	closed := make(chan error, 1)
+	c := NewClient("")
+	c.OnMessage(func(c *Client, msg *Message) {
+		received <- msg
+	})
+	c.OnClose(func(c *Client, err error) {
+		closed <- err
+	})
+	startTestServer(t, s)
+	c.addr = s.Addr().String()
+	assert.NoError(t, c.Dial())
+	defer c.Close()
+	c.SendBytes(Single, []byte("alice"))
+
+	var list []SessionInfo
+	assert.Eventually(t, func() bool {
+		res, err := http.Get(admin.URL + "/admin/sessions?uid=alice")
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+		list = nil
+		return json.NewDecoder(res.Body).Decode(&list) == nil && len(list) == 1
+	}, time.Second, 10*time.Millisecond)
+	info := list[0]
+	assert.Equal(t, "alice", info.Uid)
+	assert.Equal(t, c.GetRawConn().LocalAddr().String(), info.IP)
+	assert.NotZero(t, info.BytesIn)
+	assert.False(t, info.ConnectedAt.IsZero())
+
+	res, err := http.Get(admin.URL + "/admin/sessions/" + info.Sid + "/extra")
+	assert.NoError(t, err)
+	var extra map[string]map[string]interface{}
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&extra))
+	res.Body.Close()
+	assert.Equal(t, "lobby", extra["session"]["room"])
+	assert.Contains(t, extra["conn"]["ch"], "0x")
+
+	res, err = http.Post(admin.URL+"/admin/sessions/"+info.Sid+"/send?cmd="+strconv.Itoa(int(All)), "text/plain", strings.NewReader("ping"))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	select {
+	case msg := <-received:
+		assert.Equal(t, All, msg.GetCmd())
+		assert.Equal(t, "ping", string(msg.GetData()))
+	case <-time.After(time.Second):
+		t.Fatal("test message not received")
+	}
+
+	res, err = http.Get(admin.URL + "/admin/sessions/" + info.Sid + "/kick")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+	res, err = http.Post(admin.URL+"/admin/sessions/"+info.Sid+"/kick?reason=maintenance", "", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	select {
+	case err := <-closed:
+		assert.Equal(t, CloseKicked, CloseCodeOf(err))
+		assert.Contains(t, err.Error(), "maintenance")
+	case <-time.After(time.Second):
+		t.Fatal("session not kicked")
+	}
+
+	res, err = http.Get(admin.URL + "/admin/sessions/unknown")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
@@ -0,0 +1,231 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrAuthFailed occurs when the handshake credential is rejected
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrAuthTimeout occurs when no valid credential is received before the auth deadline
+	ErrAuthTimeout = errors.New("authentication timeout")
+	// ErrInvalidToken occurs when a token is malformed or its signature does not match
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired occurs when a token is used after its expiry
+	ErrTokenExpired = errors.New("token expired")
+)
+
+const (
+	// DefaultAuthTimeout is how long a connection may take to authenticate
+	DefaultAuthTimeout = 10 * time.Second
+	// DefaultAuthFrames is how many frames a connection may send before it must be authenticated
+	DefaultAuthFrames = 1
+)
+
+// AuthCode is the result code of the handshake sent back in an Auth frame
+type AuthCode uint16
+
+const (
+	AuthOK AuthCode = iota
+	AuthRejected
+)
+
+// AuthFunc validates a handshake frame and returns the user ID bound to the session
+type AuthFunc func(c *Conn, msg *Message) (uid string, err error)
+
+// packAuthResult encodes the handshake result
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ Code      │ uint16 │ 2       ║
+// ║ Reason    │ string │ dynamic ║
+// ╚═══════════╧════════╧═════════╝
+func packAuthResult(code AuthCode, reason string) *Message {
+	b := make([]byte, 2+len(reason))
+	binary.LittleEndian.PutUint16(b, uint16(code))
+	copy(b[2:], reason)
+	return NewMessage(Auth, b)
+}
+
+// UnpackAuthResult decodes the handshake result sent by the server
+func UnpackAuthResult(msg *Message) (AuthCode, string, error) {
+	data := msg.GetData()
+	if msg.GetCmd() != Auth || len(data) < 2 {
+		return 0, "", ErrInvalidToken
+	}
+	return AuthCode(binary.LittleEndian.Uint16(data)), string(data[2:]), nil
+}
+
+// OnAuth auth callbacks on a connection. Once set, the first frames of every connection are handed to the
+// callback until it returns a user ID, nothing reaches OnMessage before. A rejected handshake or one that
+// does not complete within the auth timeout closes the connection
+func (s *Server) OnAuth(callback AuthFunc) {
+	s.onAuth = callback
+}
+
+// authenticate runs the handshake stage for a frame received before the connection is authenticated,
+// the connection is closed once it used up its handshake frames
+func (c *Conn) authenticate(msg *Message) {
+	uid, err := c.srv.onAuth(c, msg)
+	if err == nil && uid != "" {
+		c.sess.BindUserID(uid)
+		c.setAuthed()
+		c.SendMessage(packAuthResult(AuthOK, ""))
+		return
+	}
+	if err == nil {
+		err = ErrAuthFailed
+	}
+
+	c.authFrames++
+	if c.authFrames < c.srv.opt.authFrames {
+		c.SendMessage(packAuthResult(AuthRejected, err.Error()))
+		return
+	}
+	Flog.Errorf("auth %v err: %v", c.GetClientIP(), err)
+	c.CloseWithReason(CloseAuthFailed, err.Error())
+}
+
+// Authenticate sends the credential to the server and waits for the handshake result
+func (c *Client) Authenticate(credential []byte, timeout time.Duration) error {
+	c.SendBytes(Auth, credential)
+	select {
+	case msg := <-c.authCh:
+		code, reason, err := UnpackAuthResult(msg)
+		if err != nil {
+			return err
+		}
+		if code == AuthOK {
+			return nil
+		}
+		if reason != "" {
+			return errors.New(reason)
+		}
+		return ErrAuthFailed
+	case <-c.exitCh:
+		// the server hung up, its Close frame tells why
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.peerReason != nil {
+			return c.peerReason
+		}
+		return ErrAuthFailed
+	case <-time.After(timeout):
+		return ErrAuthTimeout
+	}
+}
+
+// SignToken creates an HMAC-SHA256 token carrying the user ID and its expiry
+func SignToken(secret []byte, uid string, expireAt time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(uid + "|" + strconv.FormatInt(expireAt.Unix(), 10)))
+	return payload + "." + sign(secret, payload)
+}
+
+// VerifyToken checks a token created by SignToken and returns its user ID
+func VerifyToken(secret []byte, token string) (string, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(sign(secret, token[:i])), []byte(token[i+1:])) {
+		return "", ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	j := strings.LastIndexByte(string(b), '|')
+	if j < 0 {
+		return "", ErrInvalidToken
+	}
+	exp, err := strconv.ParseInt(string(b[j+1:]), 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	if time.Now().Unix() > exp {
+		return "", ErrTokenExpired
+	}
+	return string(b[:j]), nil
+}
+
+// SignJWT creates an HS256 JSON Web Token with the given claims
+func SignJWT(secret []byte, claims map[string]interface{}) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(b)
+	return unsigned + "." + sign(secret, unsigned), nil
+}
+
+// VerifyJWT checks the signature, exp and nbf of an HS256 JSON Web Token and returns its claims
+func VerifyJWT(secret []byte, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(b, &header) != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(sign(secret, parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+
+	claims := make(map[string]interface{})
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, ErrInvalidToken
+	}
+	now := float64(time.Now().Unix())
+	if exp, ok := claims["exp"].(float64); ok && now > exp {
+		return nil, ErrTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// TokenAuth authenticates frames carrying a token created by SignToken
+func TokenAuth(secret []byte) AuthFunc {
+	return func(c *Conn, msg *Message) (string, error) {
+		if msg.GetCmd() != Auth {
+			return "", ErrAuthFailed
+		}
+		return VerifyToken(secret, string(msg.GetData()))
+	}
+}
+
+// JWTAuth authenticates frames carrying an HS256 JSON Web Token, the user ID is read from the claim
+func JWTAuth(secret []byte, claim string) AuthFunc {
+	return func(c *Conn, msg *Message) (string, error) {
+		if msg.GetCmd() != Auth {
+			return "", ErrAuthFailed
+		}
+		claims, err := VerifyJWT(secret, string(msg.GetData()))
+		if err != nil {
+			return "", err
+		}
+		uid, ok := claims[claim].(string)
+		if !ok || uid == "" {
+			return "", ErrInvalidToken
+		}
+		return uid, nil
+	}
+}
+
+func sign(secret []byte, data string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken(t *testing.T) {
+	secret := []byte("secret")
+	token := SignToken(secret, "alice", time.Now().Add(time.Minute))
+	uid, err := VerifyToken(secret, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", uid)
+
+	_, err = VerifyToken([]byte("other"), token)
+	assert.Equal(t, ErrInvalidToken, err)
+	_, err = VerifyToken(secret, SignToken(secret, "alice", time.Now().Add(-time.Minute)))
+	assert.Equal(t, ErrTokenExpired, err)
+}
+
+func TestJWT(t *testing.T) {
+	secret := []byte("secret")
+	token, err := SignJWT(secret, map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Minute).Unix()})
+	assert.NoError(t, err)
+	claims, err := VerifyJWT(secret, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", claims["sub"])
+
+	_, err = VerifyJWT([]byte("other"), token)
+	assert.Equal(t, ErrInvalidToken, err)
+	expired, _ := SignJWT(secret, map[string]interface{}{"sub": "bob", "exp": time.Now().Add(-time.Minute).Unix()})
+	_, err = VerifyJWT(secret, expired)
+	assert.Equal(t, ErrTokenExpired, err)
+}
+
+func TestAuthHandshake(t *testing.T) {
+	secret := []byte("secret")
+	messages := make(chan *Conn, 4)
+	closed := make(chan error, 4)
+	s := newTestServer(WithAuthTimeout(200 * time.Millisecond))
+	s.OnAuth(JWTAuth(secret, "sub"))
+	s.OnMessage(func(c *Conn, msg *Message) {
+		messages <- c
+	})
+	s.OnClose(func(c *Conn, err error) {
+		closed <- err
+	})
+
+	// a valid token binds the user and opens the router
+	c := newTestClient(t, s)
+	defer c.Close()
+	token, _ := SignJWT(secret, map[string]interface{}{"sub": "alice"})
+	assert.NoError(t, c.Authenticate([]byte(token), time.Second))
+	c.SendBytes(Single, []byte("hello"))
+	select {
+	case conn := <-messages:
+		assert.Equal(t, "alice", conn.GetSession().GetUserID())
+	case <-time.After(time.Second):
+		t.Fatal("message not routed")
+	}
+
+	// a bad token closes the connection before anything is routed
+	bad := newTestClient(t, s)
+	defer bad.Close()
+	bad.SendBytes(Single, []byte("sneaky"))
+	select {
+	case err := <-closed:
+		assert.ErrorIs(t, err, ErrAuthFailed)
+	case <-time.After(time.Second):
+		t.Fatal("unauthenticated connection not closed")
+	}
+
+	// a silent client is closed at the deadline
+	silent := newTestClient(t, s)
+	defer silent.Close()
+	select {
+	case err := <-closed:
+		assert.ErrorIs(t, err, ErrAuthTimeout)
+	case <-time.After(time.Second):
+		t.Fatal("handshake did not time out")
+	}
+	assert.Empty(t, messages)
+}
+
+func TestAuthPipelinedFrames(t *testing.T) {
+	secret := []byte("secret")
+	cmds := make(chan CMD, 8)
+	streams := make(chan []byte, 1)
+	s := newTestServer()
+	// a slow handshake lets the following frames pile up behind the token
+	auth := TokenAuth(secret)
+	s.OnAuth(func(c *Conn, msg *Message) (string, error) {
+		time.Sleep(50 * time.Millisecond)
+		return auth(c, msg)
+	})
+	s.OnMessage(func(c *Conn, msg *Message) {
+		cmds <- msg.GetCmd()
+	})
+	s.OnStream(func(c *Conn, st *Stream) {
+		b, _ := io.ReadAll(st)
+		streams <- b
+	})
+	c := newTestClient(t, s)
+	defer c.Close()
+
+	// the frames sent right behind the token are routed by their command once it is accepted
+	c.SendBytes(Auth, []byte(SignToken(secret, "alice", time.Now().Add(time.Minute))))
+	go func() { _ = c.SendStream(strings.NewReader("payload")) }()
+	select {
+	case b := <-streams:
+		assert.Equal(t, "payload", string(b))
+	case <-time.After(time.Second):
+		t.Fatal("stream not routed")
+	}
+	assert.Empty(t, cmds)
+}
@@ -0,0 +1,267 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidCapture occurs when a capture file is not written by a Recorder or is truncated
+	ErrInvalidCapture = errors.New("invalid capture file")
+)
+
+// captureMagic starts every capture file
+var captureMagic = []byte("GTCAP\x01")
+
+// Direction tells whether a captured message was received or sent by the server
+type Direction uint8
+
+const (
+	// Inbound a message received from the client
+	Inbound Direction = iota
+	// Outbound a message sent to the client
+	Outbound
+)
+
+// Record is a captured message
+type Record struct {
+	Time time.Time
+	Dir  Direction
+	Sid  string
+	Msg  *Message
+}
+
+// Recorder writes every message a server receives and sends to a capture file.
+// The credentials of the Auth frames received are redacted unless SetKeepAuth is called
+type Recorder struct {
+	mu       sync.Mutex
+	w        *bufio.Writer
+	closer   io.Closer
+	protocol Protocol
+	keepAuth bool
+	err      error
+}
+
+// NewRecorder creates a recorder writing the capture to w
+func NewRecorder(w io.Writer) *Recorder {
+	r := &Recorder{w: bufio.NewWriter(w), protocol: NewDefaultProtocol()}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	_, r.err = r.w.Write(captureMagic)
+	return r
+}
+
+// NewFileRecorder creates a recorder writing the capture to a new file
+func NewFileRecorder(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f), nil
+}
+
+// SetKeepAuth records the Auth frames received as they are, e.g. to replay the capture against a server
+// checking the credentials. The capture then holds secrets and must be protected like them
+func (r *Recorder) SetKeepAuth(keep bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keepAuth = keep
+}
+
+// Record appends a message to the capture, errors are kept and reported by Close
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ Time      │ int64  │ 8       ║
+// ║ Dir       │ uint8  │ 1       ║
+// ║ SidLen    │ uint8  │ 1       ║
+// ║ Sid       │ string │ SidLen  ║
+// ║ Message   │ []byte │ dynamic ║
+// ╚═══════════╧════════╧═════════╝
+// the message is packed with the DefaultProtocol
+func (r *Recorder) Record(dir Direction, sid string, msg *Message) {
+	if len(sid) > 255 {
+		sid = sid[:255]
+	}
+	r.mu.Lock()
+	redact := dir == Inbound && msg.GetCmd() == Auth && !r.keepAuth
+	r.mu.Unlock()
+	if redact {
+		msg = NewMessage(Auth, nil)
+	}
+	b, err := r.protocol.Pack(msg)
+	head := make([]byte, 10, 10+len(sid))
+	binary.LittleEndian.PutUint64(head, uint64(time.Now().UnixNano()))
+	head[8] = byte(dir)
+	head[9] = byte(len(sid))
+	head = append(head, sid...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err != nil {
+		r.err = err
+		return
+	}
+	if _, r.err = r.w.Write(head); r.err == nil {
+		_, r.err = r.w.Write(b)
+	}
+}
+
+// Flush writes the buffered records
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.w.Flush()
+}
+
+// Close flushes the capture and closes the underlying writer if it is an io.Closer
+func (r *Recorder) Close() error {
+	err := r.Flush()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// CaptureReader reads the records of a capture
+type CaptureReader struct {
+	r        *bufio.Reader
+	protocol Protocol
+}
+
+// NewCaptureReader checks the capture header and returns a reader of its records
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != string(captureMagic) {
+		return nil, ErrInvalidCapture
+	}
+	return &CaptureReader{r: br, protocol: NewDefaultProtocol()}, nil
+}
+
+// Next reads the next record, it returns io.EOF at the end of the capture
+func (c *CaptureReader) Next() (*Record, error) {
+	head := make([]byte, 10)
+	if _, err := io.ReadFull(c.r, head); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, ErrInvalidCapture
+	}
+	sid := make([]byte, head[9])
+	if _, err := io.ReadFull(c.r, sid); err != nil {
+		return nil, ErrInvalidCapture
+	}
+	msg, err := c.protocol.Unpack(c.r)
+	if err != nil {
+		return nil, ErrInvalidCapture
+	}
+	return &Record{
+		Time: time.Unix(0, int64(binary.LittleEndian.Uint64(head))),
+		Dir:  Direction(head[8]),
+		Sid:  string(sid),
+		Msg:  msg,
+	}, nil
+}
+
+// record captures a message of the connection if a recorder is set
+func (c *Conn) record(dir Direction, msg *Message) {
+	if r := c.srv.opt.recorder; r != nil {
+		r.Record(dir, c.sessId, msg)
+	}
+}
+
+// Replayer plays the inbound messages of a capture against a server, every captured session
+// gets its own client. A server with OnAuth needs a capture recorded with Recorder.SetKeepAuth
+type Replayer struct {
+	addr      string
+	speed     float64
+	opts      []Option
+	onMessage func(sid string, msg *Message)
+}
+
+// NewReplayer creates a replayer for the server address. speed scales the captured timing,
+// 1 keeps it, 10 plays ten times faster and 0 sends everything without waiting
+func NewReplayer(addr string, speed float64, opts ...Option) *Replayer {
+	return &Replayer{addr: addr, speed: speed, opts: opts, onMessage: func(sid string, msg *Message) {}}
+}
+
+// OnMessage receive callbacks on the replaying clients, sid is the captured session ID
+func (r *Replayer) OnMessage(callback func(sid string, msg *Message)) {
+	r.onMessage = callback
+}
+
+// Replay plays the capture and closes the clients once every message is written
+func (r *Replayer) Replay(capture io.Reader) error {
+	cr, err := NewCaptureReader(capture)
+	if err != nil {
+		return err
+	}
+
+	clients := make(map[string]*Client)
+	defer func() {
+		for _, cli := range clients {
+			cli.closeQueued(5 * time.Second)
+		}
+	}()
+
+	var first time.Time
+	start := time.Now()
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Dir != Inbound {
+			continue
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if r.speed > 0 {
+			at := start.Add(time.Duration(float64(rec.Time.Sub(first)) / r.speed))
+			time.Sleep(time.Until(at))
+		}
+
+		cli, ok := clients[rec.Sid]
+		if !ok {
+			sid := rec.Sid
+			cli = NewClient(r.addr, r.opts...)
+			cli.OnMessage(func(c *Client, msg *Message) {
+				r.onMessage(sid, msg)
+			})
+			if err = cli.Dial(); err != nil {
+				return err
+			}
+			clients[sid] = cli
+		}
+		cli.SendMessage(rec.Msg)
+	}
+}
+
+// closeQueued queues a normal Close frame behind the pending messages and waits until it is written
+func (c *Client) closeQueued(timeout time.Duration) {
+	c.SendMessage(packClose(CloseNormal, ""))
+	select {
+	case <-c.exitCh:
+	case <-time.After(timeout):
+		c.Close()
+	}
+}
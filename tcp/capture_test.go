@@ -0,0 +1,136 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	r := NewRecorder(buf)
+	r.Record(Inbound, "s1", NewMessage(Single, []byte("hello")))
+	r.Record(Outbound, "s1", NewMessage(All, []byte("world")))
+	assert.NoError(t, r.Flush())
+
+	cr, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	rec, err := cr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, Inbound, rec.Dir)
+	assert.Equal(t, "s1", rec.Sid)
+	assert.Equal(t, "hello", string(rec.Msg.GetData()))
+	rec, err = cr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, Outbound, rec.Dir)
+	assert.Equal(t, All, rec.Msg.GetCmd())
+	_, err = cr.Next()
+	assert.Equal(t, io.EOF, err)
+
+	_, err = NewCaptureReader(bytes.NewReader([]byte("nope")))
+	assert.Equal(t, ErrInvalidCapture, err)
+	cr, _ = NewCaptureReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	_, _ = cr.Next()
+	_, err = cr.Next()
+	assert.Equal(t, ErrInvalidCapture, err)
+}
+
+func TestCaptureRedactsAuth(t *testing.T) {
+	buf := new(bytes.Buffer)
+	r := NewRecorder(buf)
+	r.Record(Inbound, "s1", NewMessage(Auth, []byte("token")))
+	r.SetKeepAuth(true)
+	r.Record(Inbound, "s1", NewMessage(Auth, []byte("token")))
+	assert.NoError(t, r.Flush())
+
+	cr, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	rec, err := cr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, Auth, rec.Msg.GetCmd())
+	assert.Empty(t, rec.Msg.GetData())
+	rec, err = cr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", string(rec.Msg.GetData()))
+}
+
+func TestCaptureReplay(t *testing.T) {
+	// record a short conversation of two clients
+	buf := new(bytes.Buffer)
+	rec := NewRecorder(buf)
+	closed := make(chan error, 2)
+	s := newTestServer(WithRecorder(rec))
+	s.OnMessage(func(c *Conn, msg *Message) {
+		c.SendBytes(Single, append([]byte("echo "), msg.GetData()...))
+	})
+	s.OnClose(func(c *Conn, err error) {
+		closed <- err
+	})
+	echoes := make(chan *Message, 8)
+	for _, name := range []string{"alice", "bob"} {
+		c := newTestClient(t, s)
+		c.OnMessage(func(c *Client, msg *Message) {
+			echoes <- msg
+		})
+		c.SendBytes(Single, []byte(name+" 1"))
+		time.Sleep(50 * time.Millisecond)
+		c.SendBytes(Single, []byte(name+" 2"))
+		for i := 0; i < 2; i++ {
+			<-echoes
+		}
+		c.Close()
+		<-closed
+	}
+	s.Stop()
+
+	cr, err := NewCaptureReader(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	counts := map[Direction]int{}
+	sessions := map[string]bool{}
+	for {
+		r, err := cr.Next()
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		counts[r.Dir]++
+		sessions[r.Sid] = true
+	}
+	// two messages and a Close frame in, two echoes out per client
+	assert.Equal(t, 6, counts[Inbound])
+	assert.Equal(t, 4, counts[Outbound])
+	assert.Len(t, sessions, 2)
+
+	// replay it against a fresh server, ten times faster
+	var mu sync.Mutex
+	var got []string
+	s2 := newTestServer()
+	s2.OnMessage(func(c *Conn, msg *Message) {
+		mu.Lock()
+		got = append(got, string(msg.GetData()))
+		mu.Unlock()
+		c.SendBytes(Single, msg.GetData())
+	})
+	startTestServer(t, s2)
+	replies := make(chan string, 8)
+	rp := NewReplayer(s2.Addr().String(), 10)
+	rp.OnMessage(func(sid string, msg *Message) {
+		replies <- sid
+	})
+	start := time.Now()
+	assert.NoError(t, rp.Replay(bytes.NewReader(buf.Bytes())))
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(got) == 4
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"alice 1", "alice 2", "bob 1", "bob 2"}, got)
+}
@@ -0,0 +1,243 @@
+package network
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+)
+
+// Client defines parameters for dialing a TCP server speaking the same Protocol
+type Client struct {
+	addr       string
+	opt        *Options
+	conn       net.Conn
+	protocol   Protocol
+	sendCh     chan *Message
+	streamCh   chan *Message
+	msgCh      chan *Message
+	authCh     chan *Message
+	streams    *streamManager
+	mux        *Mux
+	exitCh     chan struct{}
+	closeOnce  sync.Once
+	mu         sync.Mutex
+	reason     *CloseError
+	peerReason *CloseError
+	onMessage  func(c *Client, msg *Message)
+	onStream   func(c *Client, s *Stream)
+	onClose    func(c *Client, err error)
+}
+
+// NewClient creates a new tcp client for the given server address
+func NewClient(addr string, opts ...Option) *Client {
+	cli := &Client{
+		addr:      addr,
+		protocol:  NewDefaultProtocol(),
+		sendCh:    make(chan *Message, 1024),
+		streamCh:  make(chan *Message, 16),
+		msgCh:     make(chan *Message, 1024),
+		authCh:    make(chan *Message, 1),
+		exitCh:    make(chan struct{}),
+		onMessage: func(c *Client, msg *Message) {},
+		onStream:  func(c *Client, s *Stream) { s.Close() },
+		onClose:   func(c *Client, err error) {},
+	}
+
+	d := defaultOptions()
+	for _, opt := range opts {
+		opt(d)
+	}
+	cli.opt = d
+	cli.streams = newStreamManager(d, cli.sendCh, cli.streamCh, func(s *Stream) {
+		cli.onStream(cli, s)
+	})
+	cli.mux = newMux(d, true, cli.sendCh, cli.streamCh, cli.GetRawConn)
+	return cli
+}
+
+// Dial connects to the server and starts the read and write goroutines
+func (c *Client) Dial() (err error) {
+	if c.opt.tlsConf != nil {
+		c.conn, err = tls.Dial("tcp", c.addr, c.opt.tlsConf)
+	} else {
+		c.conn, err = net.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	go c.readLoop(errCh)
+	go c.writeLoop(errCh)
+	go c.process(errCh)
+	return nil
+}
+
+// OnMessage receive callbacks on the client
+func (c *Client) OnMessage(callback func(c *Client, msg *Message)) {
+	c.onMessage = callback
+}
+
+// OnStream stream callbacks on the client, it runs in its own goroutine and should read s until io.EOF
+func (c *Client) OnStream(callback func(c *Client, s *Stream)) {
+	c.onStream = callback
+}
+
+// OnClose close callbacks on the client, err is a *CloseError carrying the reason sent by the server
+func (c *Client) OnClose(callback func(c *Client, err error)) {
+	c.onClose = callback
+}
+
+// process dispatches received messages until the connection fails
+func (c *Client) process(errCh chan error) {
+	for {
+		select {
+		case <-c.exitCh:
+			return
+		case err := <-errCh:
+			c.shutdown()
+			c.onClose(c, err)
+			return
+		case msg := <-c.msgCh:
+			c.dispatch(msg)
+		}
+	}
+}
+
+// dispatch routes handshake results to Authenticate, unwraps mail deliveries and acknowledges them once OnMessage returns
+func (c *Client) dispatch(msg *Message) {
+	if msg.GetCmd() == Auth {
+		select {
+		case c.authCh <- msg:
+		default:
+		}
+		return
+	}
+	if msg.GetCmd() != MailFrame {
+		c.onMessage(c, msg)
+		return
+	}
+	id, inner, err := UnpackMail(msg)
+	if err != nil {
+		Flog.Errorf("unpack mail err: %v", err)
+		return
+	}
+	c.onMessage(c, inner)
+	c.SendMessage(NewMailAck(id))
+}
+
+// readLoop read goroutine
+func (c *Client) readLoop(errCh chan error) {
+	reader := bufio.NewReader(c.conn)
+	for {
+		msg, err := c.protocol.Unpack(reader)
+		if err != nil {
+			errCh <- c.closeError(err)
+			return
+		}
+		if msg.GetCmd() == Close {
+			c.mu.Lock()
+			c.peerReason = unpackClose(msg)
+			c.mu.Unlock()
+			continue
+		}
+		if isStreamCmd(msg.GetCmd()) {
+			c.streams.handle(msg)
+			continue
+		}
+		if msg.GetCmd() == MuxFrame {
+			c.mux.handle(msg)
+			continue
+		}
+		select {
+		case c.msgCh <- msg:
+		case <-c.exitCh:
+			return
+		}
+	}
+}
+
+// writeLoop write goroutine, queued messages are written before stream fragments
+func (c *Client) writeLoop(errCh chan error) {
+	for {
+		var msg *Message
+		select {
+		case msg = <-c.sendCh:
+		default:
+			select {
+			case <-c.exitCh:
+				return
+			case msg = <-c.sendCh:
+			case msg = <-c.streamCh:
+			}
+		}
+
+		b, err := c.protocol.Pack(msg)
+		if err != nil {
+			Flog.Errorf("pack message err: %v", err)
+			continue
+		}
+		if _, err = c.conn.Write(b); err != nil {
+			errCh <- &CloseError{Code: CloseWriteFailed, Err: err}
+			return
+		}
+		// a queued Close frame hangs up once everything queued before it is written
+		if msg.GetCmd() == Close {
+			c.mu.Lock()
+			if c.reason == nil {
+				c.reason = unpackClose(msg)
+			}
+			c.mu.Unlock()
+			c.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown releases the connection and its streams
+func (c *Client) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.exitCh)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.streams.close(ErrStreamClosed)
+		c.mux.close(ErrMuxClosed, false)
+	})
+}
+
+// SendMessage send message into channel
+func (c *Client) SendMessage(msg *Message) {
+	select {
+	case c.sendCh <- msg:
+	case <-c.exitCh:
+	}
+}
+
+// SendBytes send bytes
+func (c *Client) SendBytes(cmd CMD, b []byte) {
+	c.SendMessage(NewMessage(cmd, b))
+}
+
+// SendStream sends everything read from r to the server as a stream of fragment frames,
+// it blocks until r is drained or the stream is aborted
+func (c *Client) SendStream(r io.Reader) error {
+	return c.streams.send(r)
+}
+
+// Mux get the stream multiplexer of the client
+func (c *Client) Mux() *Mux {
+	return c.mux
+}
+
+// GetRawConn get the raw net.Conn of the client
+func (c *Client) GetRawConn() net.Conn {
+	return c.conn
+}
+
+// Close the client connection with a normal Close frame, OnClose is not called for a local close
+func (c *Client) Close() {
+	c.CloseWithReason(CloseNormal, "")
+}
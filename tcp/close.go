@@ -0,0 +1,253 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// closeWriteTimeout bounds the time spent writing the Close frame
+const closeWriteTimeout = time.Second
+
+// CloseCode tells why a connection was closed, it is carried by the Close frame sent before hanging up
+type CloseCode uint16
+
+const (
+	// CloseNormal the peer closed the connection on purpose
+	CloseNormal CloseCode = iota
+	// CloseAbnormal the peer vanished without a Close frame
+	CloseAbnormal
+	// CloseClientEOF the client hung up
+	CloseClientEOF
+	// CloseIdleTimeout nothing was received within the idle time
+	CloseIdleTimeout
+	// CloseKicked the server closed the connection on purpose
+	CloseKicked
+	// CloseProtocolError a frame could not be decoded or failed its checksum
+	CloseProtocolError
+	// CloseRateLimited the peer sent more than it is allowed to
+	CloseRateLimited
+	// CloseShutdown the server is stopping
+	CloseShutdown
+	// CloseWriteFailed a frame could not be written to the peer
+	CloseWriteFailed
+	// CloseAuthFailed the handshake credential was rejected
+	CloseAuthFailed
+	// CloseAuthTimeout the handshake did not complete in time
+	CloseAuthTimeout
+	// CloseBanned the client IP was banned
+	CloseBanned
+)
+
+var closeCodeNames = map[CloseCode]string{
+	CloseNormal:        "normal",
+	CloseAbnormal:      "abnormal",
+	CloseClientEOF:     "client eof",
+	CloseIdleTimeout:   "idle timeout",
+	CloseKicked:        "kicked",
+	CloseProtocolError: "protocol error",
+	CloseRateLimited:   "rate limited",
+	CloseShutdown:      "shutdown",
+	CloseWriteFailed:   "write failed",
+	CloseAuthFailed:    "auth failed",
+	CloseAuthTimeout:   "auth timeout",
+	CloseBanned:        "banned",
+}
+
+func (c CloseCode) String() string {
+	if name, ok := closeCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("close code %d", uint16(c))
+}
+
+// CloseError is the error handed to OnClose, it carries the close code, the peer's reason text
+// and the underlying error if any
+type CloseError struct {
+	Code CloseCode
+	Text string
+	Err  error
+}
+
+func (e *CloseError) Error() string {
+	if e.Text != "" {
+		return fmt.Sprintf("connection closed: %s: %s", e.Code, e.Text)
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("connection closed: %s: %v", e.Code, e.Err)
+	}
+	return fmt.Sprintf("connection closed: %s", e.Code)
+}
+
+func (e *CloseError) Unwrap() error {
+	return e.Err
+}
+
+// Is keeps errors.Is working with the sentinel errors reported before close codes existed
+func (e *CloseError) Is(target error) bool {
+	switch target {
+	case ErrClientClosed:
+		return e.Code == CloseClientEOF
+	case ErrServerClosed:
+		return e.Code == CloseIdleTimeout || e.Code == CloseKicked || e.Code == CloseShutdown || e.Code == CloseBanned
+	case ErrAuthFailed:
+		return e.Code == CloseAuthFailed
+	case ErrAuthTimeout:
+		return e.Code == CloseAuthTimeout
+	}
+	return false
+}
+
+// CloseCodeOf get the close code of an OnClose error
+func CloseCodeOf(err error) CloseCode {
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		return ce.Code
+	}
+	return CloseAbnormal
+}
+
+// packClose encodes a Close frame
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ Code      │ uint16 │ 2       ║
+// ║ Text      │ string │ dynamic ║
+// ╚═══════════╧════════╧═════════╝
+func packClose(code CloseCode, text string) *Message {
+	b := make([]byte, 2+len(text))
+	binary.LittleEndian.PutUint16(b, uint16(code))
+	copy(b[2:], text)
+	return NewMessage(Close, b)
+}
+
+// unpackClose decodes a Close frame received from the peer
+func unpackClose(msg *Message) *CloseError {
+	data := msg.GetData()
+	if len(data) < 2 {
+		return &CloseError{Code: CloseNormal}
+	}
+	return &CloseError{Code: CloseCode(binary.LittleEndian.Uint16(data)), Text: string(data[2:])}
+}
+
+// classify turns a read error into a CloseError, local is the reason recorded when this side hung up
+// and peer the reason of the peer's Close frame
+func classify(err error, local, peer *CloseError, eof CloseCode) *CloseError {
+	switch {
+	case local != nil:
+		return local
+	case peer != nil:
+		return peer
+	case err == io.EOF:
+		return &CloseError{Code: eof, Err: err}
+	case errors.Is(err, net.ErrClosed):
+		return &CloseError{Code: CloseNormal, Err: err}
+	case errors.Is(err, ErrChecksum):
+		return &CloseError{Code: CloseProtocolError, Err: err}
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &CloseError{Code: CloseAbnormal, Err: err}
+	}
+	return &CloseError{Code: CloseProtocolError, Err: err}
+}
+
+// CloseWithReason sends a Close frame with the reason to the client and hangs up,
+// OnClose then receives a *CloseError with the same code. Only the first reason is kept
+func (c *Conn) CloseWithReason(code CloseCode, text string) {
+	c.closeWith(&CloseError{Code: code, Text: text})
+}
+
+// closeWith sends the Close frame of e and hangs up
+func (c *Conn) closeWith(e *CloseError) {
+	if !c.setReason(e) {
+		return
+	}
+	// a peer that stopped reading must not hold the close up
+	_ = c.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	if err := c.writeMessage(packClose(e.Code, e.Text)); err != nil {
+		Flog.Debugf("send close frame err: %v", err)
+	}
+	c.shutdown(e)
+}
+
+// shutdown is the single close path of a connection, whatever ends it first. It keeps the first cause,
+// hangs up and wakes up process, which reports the cause to OnClose and releases the session
+func (c *Conn) shutdown(e *CloseError) {
+	c.closeOnce.Do(func() {
+		c.setReason(e)
+		if c.loop != nil {
+			c.loop.unwatch(c)
+		}
+		c.conn.Close()
+		close(c.done)
+		if c.loop != nil {
+			c.loop.detach(c)
+		}
+	})
+}
+
+// closeReason get the cause recorded by shutdown
+func (c *Conn) closeReason() *CloseError {
+	c.RLock()
+	defer c.RUnlock()
+	return c.reason
+}
+
+// push hands a received message to process, it gives up once the connection is closed
+func (c *Conn) push(msg *Message) {
+	select {
+	case c.msgCh <- msg:
+	case <-c.done:
+	}
+}
+
+// setReason records why this side hangs up, it returns false if a reason was already recorded
+func (c *Conn) setReason(e *CloseError) bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.reason != nil {
+		return false
+	}
+	c.reason = e
+	return true
+}
+
+// closing reports whether this side already decided to hang up
+func (c *Conn) closing() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.reason != nil
+}
+
+// closeError builds the error reported to OnClose for a failed read
+func (c *Conn) closeError(err error) *CloseError {
+	c.RLock()
+	defer c.RUnlock()
+	return classify(err, c.reason, c.peerReason, CloseClientEOF)
+}
+
+// CloseWithReason sends a Close frame with the reason to the server and hangs up
+func (c *Client) CloseWithReason(code CloseCode, text string) {
+	c.mu.Lock()
+	if c.reason == nil {
+		c.reason = &CloseError{Code: code, Text: text}
+	}
+	c.mu.Unlock()
+	if c.conn != nil {
+		if b, err := c.protocol.Pack(packClose(code, text)); err == nil {
+			_, _ = c.conn.Write(b)
+		}
+	}
+	c.shutdown()
+}
+
+// closeError builds the error reported to OnClose for a failed read
+func (c *Client) closeError(err error) *CloseError {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return classify(err, c.reason, c.peerReason, CloseAbnormal)
+}
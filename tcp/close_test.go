@@ -0,0 +1,157 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseFrame(t *testing.T) {
+	p := NewDefaultProtocol()
+	b, err := p.Pack(packClose(CloseRateLimited, "slow down"))
+	assert.NoError(t, err)
+	msg, err := p.Unpack(bytes.NewReader(b))
+	assert.NoError(t, err)
+	ce := unpackClose(msg)
+	assert.Equal(t, CloseRateLimited, ce.Code)
+	assert.Equal(t, "slow down", ce.Text)
+	assert.Equal(t, "connection closed: rate limited: slow down", ce.Error())
+}
+
+func TestCloseWithReason(t *testing.T) {
+	conns := make(chan *Conn, 1)
+	closed := make(chan error, 1)
+	s := newTestServer()
+	s.OnMessage(func(c *Conn, msg *Message) {
+		conns <- c
+	})
+	s.OnClose(func(c *Conn, err error) {
+		closed <- err
+	})
+	startTestServer(t, s)
+
+	clientClosed := make(chan error, 1)
+	c := NewClient(s.Addr().String())
+	c.OnClose(func(c *Client, err error) {
+		clientClosed <- err
+	})
+	assert.NoError(t, c.Dial())
+	defer c.Close()
+	c.SendBytes(Single, []byte("hello"))
+
+	conn := <-conns
+	conn.CloseWithReason(CloseRateLimited, "too many messages")
+	select {
+	case err := <-clientClosed:
+		assert.Equal(t, CloseRateLimited, CloseCodeOf(err))
+		assert.Contains(t, err.Error(), "too many messages")
+	case <-time.After(time.Second):
+		t.Fatal("client not closed")
+	}
+	select {
+	case err := <-closed:
+		assert.Equal(t, CloseRateLimited, CloseCodeOf(err))
+	case <-time.After(time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
+
+func TestCloseReasons(t *testing.T) {
+	closed := make(chan error, 4)
+	s := newTestServer()
+	s.OnClose(func(c *Conn, err error) {
+		closed <- err
+	})
+	startTestServer(t, s)
+
+	// a client closing normally tells the server so
+	c := newTestClient(t, s)
+	c.Close()
+	select {
+	case err := <-closed:
+		assert.Equal(t, CloseNormal, CloseCodeOf(err))
+	case <-time.After(time.Second):
+		t.Fatal("normal close not reported")
+	}
+
+	// a client hanging up without a Close frame keeps reporting ErrClientClosed
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-closed:
+		assert.Equal(t, CloseClientEOF, CloseCodeOf(err))
+		assert.ErrorIs(t, err, ErrClientClosed)
+	case <-time.After(time.Second):
+		t.Fatal("eof not reported")
+	}
+
+	// a corrupted frame is a protocol error
+	conn, err = net.Dial("tcp", s.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	b, _ := NewDefaultProtocol().Pack(NewMessage(Single, []byte("hello")))
+	b[len(b)-1] ^= 0xff
+	_, err = conn.Write(b)
+	assert.NoError(t, err)
+	select {
+	case err := <-closed:
+		assert.Equal(t, CloseProtocolError, CloseCodeOf(err))
+		assert.ErrorIs(t, err, ErrChecksum)
+	case <-time.After(time.Second):
+		t.Fatal("protocol error not reported")
+	}
+}
+
+func TestHeartbeatClosesStalledPeersAtOnce(t *testing.T) {
+	const peers = 3
+	conns := make(chan *Conn, peers)
+	closed := make(chan time.Time, peers)
+	s := newTestServer()
+	s.OnConnect(func(c *Conn) {
+		conns <- c
+	})
+	s.OnClose(func(c *Conn, err error) {
+		closed <- time.Now()
+	})
+	startTestServer(t, s)
+
+	// the peers never read, so their socket buffers fill up and every Close frame write stalls
+	for i := 0; i < peers; i++ {
+		raw, err := net.Dial("tcp", s.Addr().String())
+		assert.NoError(t, err)
+		defer raw.Close()
+	}
+	payload := make([]byte, 1<<20)
+	stalled := make([]*Conn, 0, peers)
+	for i := 0; i < peers; i++ {
+		c := <-conns
+		for j := 0; j < 32; j++ {
+			c.SendMessage(NewMessage(Single, payload))
+		}
+		stalled = append(stalled, c)
+	}
+	for _, c := range stalled {
+		atomic.StoreInt64(&c.GetSession().lastTime, 0)
+	}
+
+	// one stalled peer must not delay the idle timeout of the next ones
+	var first, last time.Time
+	for i := 0; i < peers; i++ {
+		select {
+		case at := <-closed:
+			if first.IsZero() {
+				first = at
+			}
+			last = at
+		case <-time.After(5 * time.Second):
+			t.Fatal("idle connection not closed")
+		}
+	}
+	assert.Less(t, int64(last.Sub(first)), int64(closeWriteTimeout/2))
+}
@@ -0,0 +1,493 @@
+package network
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	clusterHello   = "hello"
+	clusterWelcome = "welcome"
+	clusterUp      = "up"
+	clusterDown    = "down"
+	clusterSingle  = "single"
+	clusterUser    = "user"
+	clusterAll     = "all"
+	clusterPublish = "publish"
+	clusterMail    = "mail"
+
+	clusterNodeKey = "cluster_node"
+
+	clusterRetryMin = 100 * time.Millisecond
+	clusterRetryMax = 5 * time.Second
+)
+
+// clusterFrame is the JSON payload of a ClusterFrame message exchanged between nodes
+type clusterFrame struct {
+	Type     string           `json:"type"`
+	Node     string           `json:"node,omitempty"`
+	Sid      string           `json:"sid,omitempty"`
+	Uid      string           `json:"uid,omitempty"`
+	Topic    string           `json:"topic,omitempty"`
+	Retain   bool             `json:"retain,omitempty"`
+	Mail     uint64           `json:"mail,omitempty"`
+	Cmd      CMD              `json:"cmd,omitempty"`
+	Data     []byte           `json:"data,omitempty"`
+	Sessions []clusterSession `json:"sessions,omitempty"`
+}
+
+type clusterSession struct {
+	Sid string `json:"sid"`
+	Uid string `json:"uid,omitempty"`
+}
+
+// clusterNode is the directory of the sessions living on a remote node
+type clusterNode struct {
+	conn     *Conn
+	sessions map[string]string
+	users    map[string]int
+}
+
+func newClusterNode(conn *Conn) *clusterNode {
+	return &clusterNode{
+		conn:     conn,
+		sessions: make(map[string]string),
+		users:    make(map[string]int),
+	}
+}
+
+func (n *clusterNode) up(sid, uid string) {
+	n.down(sid)
+	n.sessions[sid] = uid
+	if uid != "" {
+		n.users[uid]++
+	}
+}
+
+func (n *clusterNode) down(sid string) {
+	uid, ok := n.sessions[sid]
+	if !ok {
+		return
+	}
+	delete(n.sessions, sid)
+	if uid != "" {
+		if n.users[uid]--; n.users[uid] <= 0 {
+			delete(n.users, uid)
+		}
+	}
+}
+
+// Cluster links the Server of this node with the servers of its peers.
+// Nodes dial each other from a static peer list, announce where their sessions and users live,
+// and forward SendSingle, SendUser, SendAll and Publish to the nodes that own the targets
+type Cluster struct {
+	id       string
+	addr     string
+	peers    []string
+	opts     []Option
+	srv      *Server
+	inner    *Server
+	codec    Codec
+	secret   []byte
+	exitCh   chan struct{}
+	stopOnce sync.Once
+
+	// mu orders announcements with the snapshot sent when a link comes up, frames are queued on the
+	// links under it without blocking
+	mu    sync.Mutex
+	links map[string]*Client
+	out   map[string]*Client
+
+	nodesMu sync.RWMutex
+	nodes   map[string]*clusterNode
+}
+
+// NewCluster attaches a cluster to srv, it should be created before the server starts.
+// addr is where this node accepts links from its peers, peers lists the link addresses of the other nodes,
+// opts are applied to the inter-node links
+func NewCluster(srv *Server, nodeID, addr string, peers []string, opts ...Option) *Cluster {
+	c := &Cluster{
+		id:     nodeID,
+		addr:   addr,
+		peers:  peers,
+		opts:   opts,
+		srv:    srv,
+		codec:  &JSONCodec{},
+		exitCh: make(chan struct{}),
+		links:  make(map[string]*Client),
+		out:    make(map[string]*Client),
+		nodes:  make(map[string]*clusterNode),
+	}
+	srv.cluster = c
+	return c
+}
+
+// SetSecret makes the nodes authenticate their links with a token signed by the shared secret, every node
+// must use the same one. It should be set before Start, without it or WithTLS in the link options any
+// host reaching the cluster address may join
+func (c *Cluster) SetSecret(secret []byte) {
+	c.secret = secret
+}
+
+// Start listens for peer links on the cluster address and dials every peer
+func (c *Cluster) Start() error {
+	listener, err := net.Listen("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.StartWithListener(listener)
+	return nil
+}
+
+// StartWithListener accepts peer links from the given listener and dials every peer
+func (c *Cluster) StartWithListener(listener net.Listener) {
+	c.addr = listener.Addr().String()
+	c.inner = NewServer(c.addr, c.opts...)
+	if len(c.secret) > 0 {
+		c.inner.OnAuth(TokenAuth(c.secret))
+	} else if c.inner.opt.tlsConf == nil {
+		Flog.Errorf("cluster %s links are not authenticated, set a secret or TLS", c.id)
+	}
+	c.inner.OnMessage(c.handle)
+	c.inner.OnClose(func(conn *Conn, err error) {
+		if node, ok := conn.GetExtraMap(clusterNodeKey).(string); ok {
+			c.nodesMu.Lock()
+			if dir, ok := c.nodes[node]; ok && dir.conn == conn {
+				delete(c.nodes, node)
+			}
+			c.nodesMu.Unlock()
+		}
+	})
+	c.inner.StartWithListener(listener)
+
+	for _, peer := range c.peers {
+		if peer == c.addr {
+			continue
+		}
+		go c.dial(peer)
+	}
+}
+
+// Stop closes every link of the node, it may be called more than once
+func (c *Cluster) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.exitCh)
+		if c.inner != nil {
+			c.inner.Stop()
+		}
+	})
+}
+
+// ID get the node ID
+func (c *Cluster) ID() string {
+	return c.id
+}
+
+// Nodes get the IDs of the peers this node can forward to
+func (c *Cluster) Nodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := make([]string, 0, len(c.out))
+	for node := range c.out {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Locate get the ID of the node the session lives on
+func (c *Cluster) Locate(sid string) (string, bool) {
+	if _, ok := c.srv.sessions.Load(sid); ok {
+		return c.id, true
+	}
+	c.nodesMu.RLock()
+	defer c.nodesMu.RUnlock()
+	for id, node := range c.nodes {
+		if _, ok := node.sessions[sid]; ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// LocateUser get the IDs of the nodes holding sessions bound to the user ID
+func (c *Cluster) LocateUser(uid string) []string {
+	var nodes []string
+	if len(c.srv.users.sessions(uid)) > 0 {
+		nodes = append(nodes, c.id)
+	}
+	c.nodesMu.RLock()
+	defer c.nodesMu.RUnlock()
+	for id, node := range c.nodes {
+		if node.users[uid] > 0 {
+			nodes = append(nodes, id)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// dial keeps an outgoing link to the peer until the cluster stops
+func (c *Cluster) dial(peer string) {
+	retry := clusterRetryMin
+	for {
+		cli := NewClient(peer, c.opts...)
+		closed := make(chan struct{})
+		cli.OnClose(func(cli *Client, err error) {
+			close(closed)
+		})
+		cli.OnMessage(func(cli *Client, msg *Message) {
+			var f clusterFrame
+			if msg.GetCmd() != ClusterFrame || c.codec.Decode(msg.GetData(), &f) != nil {
+				return
+			}
+			if f.Type == clusterWelcome {
+				c.mu.Lock()
+				c.out[f.Node] = cli
+				c.mu.Unlock()
+			}
+		})
+
+		if err := c.link(cli); err == nil {
+			retry = clusterRetryMin
+			c.mu.Lock()
+			c.links[peer] = cli
+			c.sendLocked(cli, clusterFrame{Type: clusterHello, Node: c.id, Sessions: c.snapshot()})
+			c.mu.Unlock()
+
+			c.keepalive(cli, closed)
+
+			c.mu.Lock()
+			delete(c.links, peer)
+			for node, out := range c.out {
+				if out == cli {
+					delete(c.out, node)
+				}
+			}
+			c.mu.Unlock()
+		}
+
+		select {
+		case <-c.exitCh:
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > clusterRetryMax {
+			retry = clusterRetryMax
+		}
+	}
+}
+
+// link connects to the peer and authenticates with the shared secret if there is one
+func (c *Cluster) link(cli *Client) error {
+	if err := cli.Dial(); err != nil {
+		return err
+	}
+	if len(c.secret) == 0 {
+		return nil
+	}
+	token := SignToken(c.secret, c.id, time.Now().Add(c.inner.opt.authTimeout))
+	if err := cli.Authenticate([]byte(token), c.inner.opt.authTimeout); err != nil {
+		Flog.Errorf("cluster link %s auth err: %v", cli.addr, err)
+		cli.Close()
+		return err
+	}
+	return nil
+}
+
+// keepalive pings the peer so the link is not reaped as idle, it returns once the link is down
+func (c *Cluster) keepalive(cli *Client, closed chan struct{}) {
+	tick := time.NewTicker(IdleTime * time.Second / 3)
+	defer tick.Stop()
+	for {
+		select {
+		case <-c.exitCh:
+			cli.Close()
+			return
+		case <-closed:
+			return
+		case <-tick.C:
+			cli.SendBytes(Heartbeat, nil)
+		}
+	}
+}
+
+// snapshot lists the local sessions
+func (c *Cluster) snapshot() []clusterSession {
+	var list []clusterSession
+	c.srv.sessions.Range(func(key, value interface{}) bool {
+		sess := value.(*Session)
+		list = append(list, clusterSession{Sid: sess.GetSessionID(), Uid: sess.GetUserID()})
+		return true
+	})
+	return list
+}
+
+func (c *Cluster) encode(f clusterFrame) *Message {
+	b, err := c.codec.Encode(f)
+	if err != nil {
+		Flog.Errorf("cluster encode err: %v", err)
+		return nil
+	}
+	return NewMessage(ClusterFrame, b)
+}
+
+// post queues the frame on a link without blocking, so c.mu is never held across a full link.
+// A link that can't keep up is dropped instead, the peer gets a fresh snapshot once it is dialed again
+func (c *Cluster) post(cli *Client, msg *Message) {
+	select {
+	case cli.sendCh <- msg:
+	default:
+		Flog.Errorf("cluster link %s err: send queue full, dropping the link", cli.addr)
+		go cli.Close()
+	}
+}
+
+func (c *Cluster) sendLocked(cli *Client, f clusterFrame) {
+	if msg := c.encode(f); msg != nil {
+		c.post(cli, msg)
+	}
+}
+
+// broadcast sends the frame to every linked peer
+func (c *Cluster) broadcast(f clusterFrame) {
+	msg := c.encode(f)
+	if msg == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cli := range c.links {
+		c.post(cli, msg)
+	}
+}
+
+// sendTo sends the frame to the given nodes
+func (c *Cluster) sendTo(nodes []string, f clusterFrame) {
+	msg := c.encode(f)
+	if msg == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, node := range nodes {
+		if cli, ok := c.out[node]; ok {
+			c.post(cli, msg)
+		}
+	}
+}
+
+func (c *Cluster) sessionUp(sess *Session) {
+	c.broadcast(clusterFrame{Type: clusterUp, Sid: sess.GetSessionID(), Uid: sess.GetUserID()})
+}
+
+func (c *Cluster) sessionDown(sess *Session) {
+	c.broadcast(clusterFrame{Type: clusterDown, Sid: sess.GetSessionID()})
+}
+
+func (c *Cluster) forwardSingle(sid string, msg *Message) {
+	node, ok := c.Locate(sid)
+	if !ok || node == c.id {
+		return
+	}
+	c.sendTo([]string{node}, clusterFrame{Type: clusterSingle, Sid: sid, Cmd: msg.GetCmd(), Data: msg.GetData()})
+}
+
+func (c *Cluster) forwardUser(uid string, msg *Message) bool {
+	var nodes []string
+	for _, node := range c.LocateUser(uid) {
+		if node != c.id {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		return false
+	}
+	c.sendTo(nodes, clusterFrame{Type: clusterUser, Uid: uid, Cmd: msg.GetCmd(), Data: msg.GetData()})
+	return true
+}
+
+// forwardMail asks the nodes the user is online on to deliver a mail of the shared mailbox store
+func (c *Cluster) forwardMail(uid string, id uint64) {
+	var nodes []string
+	for _, node := range c.LocateUser(uid) {
+		if node != c.id {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) > 0 {
+		c.sendTo(nodes, clusterFrame{Type: clusterMail, Uid: uid, Mail: id})
+	}
+}
+
+func (c *Cluster) forwardAll(msg *Message) {
+	c.broadcast(clusterFrame{Type: clusterAll, Cmd: msg.GetCmd(), Data: msg.GetData()})
+}
+
+func (c *Cluster) forwardPublish(topic string, data []byte, retain bool) {
+	c.broadcast(clusterFrame{Type: clusterPublish, Topic: topic, Data: data, Retain: retain})
+}
+
+// handle processes a frame received on a link accepted from a peer
+func (c *Cluster) handle(conn *Conn, msg *Message) {
+	if msg.GetCmd() != ClusterFrame {
+		return
+	}
+	var f clusterFrame
+	if err := c.codec.Decode(msg.GetData(), &f); err != nil {
+		Flog.Errorf("cluster decode err: %v", err)
+		return
+	}
+
+	switch f.Type {
+	case clusterHello:
+		node := newClusterNode(conn)
+		for _, s := range f.Sessions {
+			node.up(s.Sid, s.Uid)
+		}
+		c.nodesMu.Lock()
+		c.nodes[f.Node] = node
+		c.nodesMu.Unlock()
+		conn.SetExtraMap(clusterNodeKey, f.Node)
+		conn.SendMessage(c.encode(clusterFrame{Type: clusterWelcome, Node: c.id}))
+	case clusterUp, clusterDown:
+		node, _ := conn.GetExtraMap(clusterNodeKey).(string)
+		c.nodesMu.Lock()
+		if dir, ok := c.nodes[node]; ok {
+			if f.Type == clusterUp {
+				dir.up(f.Sid, f.Uid)
+			} else {
+				dir.down(f.Sid)
+			}
+		}
+		c.nodesMu.Unlock()
+	case clusterSingle:
+		c.srv.sendSingleLocal(f.Sid, NewMessage(f.Cmd, f.Data))
+	case clusterUser:
+		c.srv.sendUserLocal(f.Uid, NewMessage(f.Cmd, f.Data))
+	case clusterAll:
+		c.srv.sendAllLocal(NewMessage(f.Cmd, f.Data))
+	case clusterPublish:
+		c.srv.publishLocal(f.Topic, f.Data, f.Retain)
+	case clusterMail:
+		if mb := c.srv.opt.mailbox; mb != nil {
+			mb.deliverID(f.Uid, f.Mail)
+		}
+	}
+}
+
+// sessionChanged announces a new or rebound session to the cluster
+func (s *Server) sessionChanged(sess *Session) {
+	if s.cluster != nil {
+		s.cluster.sessionUp(sess)
+	}
+}
+
+// sessionClosed announces a closed session to the cluster
+func (s *Server) sessionClosed(sess *Session) {
+	if s.cluster != nil {
+		s.cluster.sessionDown(sess)
+	}
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testNode struct {
+	srv     *Server
+	cluster *Cluster
+	conns   chan *Conn
+}
+
+func newTestCluster(t *testing.T, n int) []*testNode {
+	return waitTestCluster(t, newTestClusterWithSecrets(t, make([][]byte, n), nil))
+}
+
+// waitTestCluster waits until every node is linked to all the others
+func waitTestCluster(t *testing.T, nodes []*testNode) []*testNode {
+	n := len(nodes)
+	for _, node := range nodes {
+		node := node
+		assert.Eventually(t, func() bool {
+			return len(node.cluster.Nodes()) == n-1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	return nodes
+}
+
+// newTestClusterWithSecrets starts a node per secret, a nil secret leaves the node's links unauthenticated.
+// opts, if not nil, makes the options of each node's server
+func newTestClusterWithSecrets(t *testing.T, secrets [][]byte, opts func() []Option) []*testNode {
+	n := len(secrets)
+	listeners := make([]net.Listener, n)
+	peers := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		peers[i] = l.Addr().String()
+	}
+
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		var nodeOpts []Option
+		if opts != nil {
+			nodeOpts = opts()
+		}
+		node := &testNode{srv: newTestServer(nodeOpts...), conns: make(chan *Conn, 8)}
+		node.cluster = NewCluster(node.srv, fmt.Sprintf("node-%d", i), peers[i], peers)
+		node.cluster.SetSecret(secrets[i])
+		node.srv.OnConnect(func(c *Conn) {
+			node.conns <- c
+		})
+		node.srv.OnMessage(func(c *Conn, msg *Message) {
+			c.GetSession().BindUserID(string(msg.GetData()))
+		})
+		startTestServer(t, node.srv)
+		node.cluster.StartWithListener(listeners[i])
+		t.Cleanup(node.cluster.Stop)
+		nodes[i] = node
+	}
+	return nodes
+}
+
+func TestClusterSecret(t *testing.T) {
+	secret := []byte("cluster secret")
+	nodes := newTestClusterWithSecrets(t, [][]byte{secret, secret, []byte("wrong secret")}, nil)
+
+	for _, node := range nodes[:2] {
+		node := node
+		assert.Eventually(t, func() bool {
+			return len(node.cluster.Nodes()) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	// the intruder can't link to the others nor the others to it
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, []string{"node-1"}, nodes[0].cluster.Nodes())
+	assert.Equal(t, []string{"node-0"}, nodes[1].cluster.Nodes())
+	assert.Empty(t, nodes[2].cluster.Nodes())
+}
+
+func TestClusterForward(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+
+	received := make(chan *Message, 8)
+	bob := newTestClient(t, nodes[2].srv)
+	defer bob.Close()
+	bob.OnMessage(func(c *Client, msg *Message) {
+		received <- msg
+	})
+	sid := (<-nodes[2].conns).GetSession().GetSessionID()
+	bob.SendBytes(Single, []byte("bob"))
+
+	assert.Eventually(t, func() bool {
+		node, ok := nodes[0].cluster.Locate(sid)
+		users := nodes[0].cluster.LocateUser("bob")
+		return ok && node == "node-2" && len(users) == 1 && users[0] == "node-2"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	expect := func(data string) {
+		select {
+		case msg := <-received:
+			assert.Equal(t, data, string(msg.GetData()))
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not forwarded", data)
+		}
+	}
+
+	nodes[0].srv.SendSingle(sid, NewMessage(Single, []byte("single")))
+	expect("single")
+	nodes[1].srv.SendUser("bob", NewMessage(Single, []byte("user")))
+	expect("user")
+	nodes[0].srv.SendAll(NewMessage(All, []byte("all")))
+	expect("all")
+
+	assert.NoError(t, bob.Subscribe("room.#"))
+	assert.Eventually(t, func() bool {
+		return len(nodes[2].srv.topics.match("room.1")) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, nodes[1].srv.Publish("room.1", []byte("group"), false))
+	select {
+	case msg := <-received:
+		_, payload, err := UnpackPublish(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, "group", string(payload))
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish not forwarded")
+	}
+
+	bob.Close()
+	assert.Eventually(t, func() bool {
+		_, ok := nodes[0].cluster.Locate(sid)
+		return !ok && len(nodes[1].cluster.LocateUser("bob")) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClusterStopTwice(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	nodes[0].cluster.Stop()
+	assert.NotPanics(t, nodes[0].cluster.Stop)
+}
+
+func TestClusterSharedMailbox(t *testing.T) {
+	store := NewMemoryMailboxStore()
+	nodes := waitTestCluster(t, newTestClusterWithSecrets(t, make([][]byte, 2), func() []Option {
+		return []Option{WithMailbox(NewMailbox(store, time.Minute, time.Minute))}
+	}))
+
+	received := make(chan *Message, 4)
+	bob := newTestClient(t, nodes[1].srv)
+	defer bob.Close()
+	bob.OnMessage(func(c *Client, msg *Message) {
+		received <- msg
+	})
+	bob.SendBytes(Single, []byte("bob"))
+	assert.Eventually(t, func() bool {
+		return len(nodes[0].cluster.LocateUser("bob")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the mail is stored by node 0 and delivered right away by node 1, the retry is far away
+	assert.NoError(t, nodes[0].srv.SendMail("bob", NewMessage(Single, []byte("mail"))))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "mail", string(msg.GetData()))
+	case <-time.After(2 * time.Second):
+		t.Fatal("mail not delivered by the owner node")
+	}
+	assert.Eventually(t, func() bool {
+		users, _ := store.Users()
+		return len(users) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,161 @@
+package network
+
+import (
+	"hash/fnv"
+	"runtime"
+	"sync"
+)
+
+// DispatchMode tells how received messages are handed to OnMessage
+type DispatchMode int
+
+const (
+	// DispatchSerial calls OnMessage in the connection's own goroutine, one message after the other
+	DispatchSerial DispatchMode = iota
+	// DispatchPool hands messages to a shared pool of workers, the messages of a session always go to
+	// the same worker so they are still handled in order
+	DispatchPool
+	// DispatchConcurrent calls OnMessage in a new goroutine for every message, without any ordering
+	DispatchConcurrent
+)
+
+const (
+	// DefaultDispatchQueue is the default size of the per connection inbox and of the per worker queue
+	DefaultDispatchQueue = 1024
+)
+
+// DefaultDispatchWorkers is the default size of the worker pool
+var DefaultDispatchWorkers = 4 * runtime.NumCPU()
+
+// dispatcher runs the message handlers according to the dispatch mode
+type dispatcher struct {
+	mode DispatchMode
+
+	// pool mode, a queue per worker
+	queues []chan poolTask
+	mu     sync.Mutex
+	refs   int
+	stop   bool
+	closed bool
+
+	// concurrent mode, bounds the handlers running at once, nil is unbounded
+	sem chan struct{}
+}
+
+type poolTask struct {
+	c   *Conn
+	msg *Message
+}
+
+func newDispatcher(opt *Options) *dispatcher {
+	d := &dispatcher{mode: opt.dispatchMode}
+	switch opt.dispatchMode {
+	case DispatchPool:
+		d.queues = make([]chan poolTask, opt.dispatchWorkers)
+		for i := range d.queues {
+			d.queues[i] = make(chan poolTask, opt.dispatchQueue)
+		}
+	case DispatchConcurrent:
+		if opt.dispatchWorkers > 0 {
+			d.sem = make(chan struct{}, opt.dispatchWorkers)
+		}
+	}
+	return d
+}
+
+// start runs the pool workers, it is called when the server starts
+func (d *dispatcher) start() {
+	for _, q := range d.queues {
+		go d.work(q)
+	}
+}
+
+// acquire registers a connection, it returns false once the pool is closed
+func (d *dispatcher) acquire() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return false
+	}
+	d.refs++
+	return true
+}
+
+// release unregisters a connection, the last one closes a stopping pool
+func (d *dispatcher) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refs--
+	d.closeLocked()
+}
+
+// shutdown closes the pool once every connection released it
+func (d *dispatcher) shutdown() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stop = true
+	d.closeLocked()
+}
+
+func (d *dispatcher) closeLocked() {
+	if !d.stop || d.refs > 0 || d.closed {
+		return
+	}
+	d.closed = true
+	for _, q := range d.queues {
+		close(q)
+	}
+}
+
+// work runs the tasks of a pool queue until it is closed
+func (d *dispatcher) work(queue chan poolTask) {
+	for t := range queue {
+		t.c.handle(t.msg)
+	}
+}
+
+// submit hands a message to OnMessage according to the mode, it blocks while the worker queue
+// or the concurrency limit is full so a slow handler slows down the reading of the connection
+func (d *dispatcher) submit(c *Conn, msg *Message) {
+	switch d.mode {
+	case DispatchPool:
+		c.handlers.Add(1)
+		d.queues[c.shard%uint32(len(d.queues))] <- poolTask{c: c, msg: msg}
+	case DispatchConcurrent:
+		c.handlers.Add(1)
+		if d.sem != nil {
+			d.sem <- struct{}{}
+		}
+		go func() {
+			c.handle(msg)
+			if d.sem != nil {
+				<-d.sem
+			}
+		}()
+	default:
+		c.run(msg)
+	}
+}
+
+// handle runs the handler of a message submitted to the pool or to a goroutine
+func (c *Conn) handle(msg *Message) {
+	defer c.handlers.Done()
+	c.run(msg)
+}
+
+// run runs the handler of a message, a panic is logged instead of taking the server down
+func (c *Conn) run(msg *Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			Flog.Errorf("handle message from %v panic: %v", c.GetClientIP(), r)
+		}
+	}()
+	c.dispatch(msg)
+}
+
+// shardOf picks the pool worker of a session
+func shardOf(sid string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(sid))
+	return h.Sum32()
+}
@@ -0,0 +1,133 @@
+package network
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchPoolOrdering(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer(WithDispatch(DispatchPool, 4, 8))
+	var mu sync.Mutex
+	got := make(map[string][]int)
+	s.OnMessage(func(c *Conn, msg *Message) {
+		n, _ := strconv.Atoi(string(msg.GetData()))
+		mu.Lock()
+		got[c.GetSession().GetSessionID()] = append(got[c.GetSession().GetSessionID()], n)
+		mu.Unlock()
+	})
+	cc := newCloseCounter(s)
+	startTestServer(t, s)
+
+	const clients, count = 5, 200
+	for i := 0; i < clients; i++ {
+		c := newTestClient(t, s)
+		for j := 0; j < count; j++ {
+			c.SendBytes(Single, []byte(strconv.Itoa(j)))
+		}
+		c.closeQueued(5 * time.Second)
+	}
+	for i := 0; i < clients; i++ {
+		cc.wait(t)
+	}
+
+	// OnClose runs once every message of the session is handled
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, got, clients)
+	for _, list := range got {
+		assert.Len(t, list, count)
+		for j, n := range list {
+			if !assert.Equal(t, j, n) {
+				break
+			}
+		}
+	}
+}
+
+func TestDispatchConcurrentLimit(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer(WithDispatch(DispatchConcurrent, 3, 0))
+	var running, peak, handled int32
+	s.OnMessage(func(c *Conn, msg *Message) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&handled, 1)
+	})
+	startTestServer(t, s)
+
+	c := newTestClient(t, s)
+	for i := 0; i < 12; i++ {
+		c.SendBytes(Single, []byte("x"))
+	}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&handled) == 12
+	}, 2*time.Second, 10*time.Millisecond)
+	// handlers of a single session overlap, up to the limit
+	assert.Equal(t, int32(3), atomic.LoadInt32(&peak))
+}
+
+func TestDispatchPoolStop(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer(WithDispatch(DispatchPool, 2, 1))
+	release := make(chan struct{})
+	var handled int32
+	s.OnMessage(func(c *Conn, msg *Message) {
+		<-release
+		atomic.AddInt32(&handled, 1)
+	})
+	cc := newCloseCounter(s)
+	startTestServer(t, s)
+
+	c := newTestClient(t, s)
+	for i := 0; i < 4; i++ {
+		c.SendBytes(Single, []byte("x"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	go s.Stop()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	cc.wait(t)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&handled))
+}
+
+func TestDispatchSerialRecover(t *testing.T) {
+	s := newTestServer()
+	got := make(chan string, 2)
+	s.OnMessage(func(c *Conn, msg *Message) {
+		if string(msg.GetData()) == "panic" {
+			panic("handler failed")
+		}
+		got <- string(msg.GetData())
+	})
+	c := newTestClient(t, s)
+	defer c.Close()
+
+	// the connection survives a panicking handler
+	c.SendBytes(Single, []byte("panic"))
+	c.SendBytes(Single, []byte("next"))
+	select {
+	case data := <-got:
+		assert.Equal(t, "next", data)
+	case <-time.After(2 * time.Second):
+		t.Fatal("message after the panic not handled")
+	}
+}
+
+func TestDispatchWorkersStartWithServer(t *testing.T) {
+	checkLeaks(t)
+	// a server created but never started runs no worker
+	_ = newTestServer(WithDispatch(DispatchPool, 4, 8))
+}
@@ -0,0 +1,376 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidIP occurs when an IP or CIDR of a filter rule cannot be parsed
+	ErrInvalidIP = errors.New("invalid ip or cidr")
+)
+
+const (
+	// DefaultWatchInterval is how often a watched list file is checked for changes
+	DefaultWatchInterval = 5 * time.Second
+
+	// prunePeriod is how often the expired bans and strikes are dropped
+	prunePeriod = time.Minute
+)
+
+// IPFilter decides at accept time which client IPs may connect. Bans win over the lists,
+// the deny list wins over the allow list and an empty allow list allows everyone
+type IPFilter struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	bans  map[string]time.Time
+
+	autoBan    int
+	autoBanFor time.Duration
+	strikes    map[string][]time.Time
+	pruned     time.Time
+
+	watchOnce sync.Once
+	exitCh    chan struct{}
+}
+
+// NewIPFilter creates a filter allowing every IP
+func NewIPFilter() *IPFilter {
+	return &IPFilter{
+		bans:    make(map[string]time.Time),
+		strikes: make(map[string][]time.Time),
+		exitCh:  make(chan struct{}),
+	}
+}
+
+// parseNets parses CIDRs, a bare IP is a single host network
+func parseNets(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidIP, s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidIP, s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP get the IP of a connection address
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	if addr == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// SetAllow replaces the allow list, only matching IPs may connect once it is not empty
+func (f *IPFilter) SetAllow(cidrs ...string) error {
+	nets, err := parseNets(cidrs)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.allow = nets
+	f.mu.Unlock()
+	return nil
+}
+
+// SetDeny replaces the deny list
+func (f *IPFilter) SetDeny(cidrs ...string) error {
+	nets, err := parseNets(cidrs)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.deny = nets
+	f.mu.Unlock()
+	return nil
+}
+
+// SetAutoBan bans an IP for d once it caused n protocol errors within d, n <= 0 disables it
+func (f *IPFilter) SetAutoBan(n int, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.autoBan = n
+	f.autoBanFor = d
+}
+
+// Allowed reports whether the IP may connect
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if until, ok := f.bans[ip.String()]; ok && (until.IsZero() || time.Now().Before(until)) {
+		return false
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// Ban rejects the IP for d, d <= 0 bans it until Unban
+func (f *IPFilter) Ban(ip net.IP, d time.Duration) {
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(time.Now(), false)
+	f.bans[ip.String()] = until
+	delete(f.strikes, ip.String())
+}
+
+// Unban lifts the ban of the IP
+func (f *IPFilter) Unban(ip net.IP) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.bans, ip.String())
+}
+
+// Bans lists the banned IPs with the end of their ban, a zero time never ends
+func (f *IPFilter) Bans() map[string]time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.prune(time.Now(), true)
+	bans := make(map[string]time.Time, len(f.bans))
+	for ip, until := range f.bans {
+		bans[ip] = until
+	}
+	return bans
+}
+
+// prune drops the expired bans and the strikes too old to count, at most once a prunePeriod unless forced.
+// It is called with mu held
+func (f *IPFilter) prune(now time.Time, force bool) {
+	if !force && now.Sub(f.pruned) < prunePeriod {
+		return
+	}
+	f.pruned = now
+	for ip, until := range f.bans {
+		if !until.IsZero() && now.After(until) {
+			delete(f.bans, ip)
+		}
+	}
+	if f.autoBanFor <= 0 && f.autoBan > 0 {
+		return
+	}
+	for ip, list := range f.strikes {
+		if f.autoBan <= 0 || now.Sub(list[len(list)-1]) >= f.autoBanFor {
+			delete(f.strikes, ip)
+		}
+	}
+}
+
+// strike records a protocol error of the IP and reports whether it has to be banned now
+func (f *IPFilter) strike(ip net.IP) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.autoBan <= 0 || ip == nil {
+		return false
+	}
+	now := time.Now()
+	f.prune(now, false)
+	key := ip.String()
+	list := f.strikes[key][:0]
+	for _, t := range f.strikes[key] {
+		if f.autoBanFor <= 0 || now.Sub(t) < f.autoBanFor {
+			list = append(list, t)
+		}
+	}
+	list = append(list, now)
+	if len(list) < f.autoBan {
+		f.strikes[key] = list
+		return false
+	}
+	delete(f.strikes, key)
+	return true
+}
+
+// LoadFile replaces the allow and deny lists with the rules of the file, one per line:
+//
+//	# comment
+//	allow 10.0.0.0/8
+//	deny 10.1.2.3
+//
+// bans are kept, an invalid file leaves the lists untouched
+func (f *IPFilter) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var allow, deny []string
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"allow|deny <cidr>\"", path, n)
+		}
+		switch fields[0] {
+		case "allow":
+			allow = append(allow, fields[1])
+		case "deny":
+			deny = append(deny, fields[1])
+		default:
+			return fmt.Errorf("%s:%d: unknown rule %q", path, n, fields[0])
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	allowNets, err := parseNets(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := parseNets(deny)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.allow, f.deny = allowNets, denyNets
+	f.mu.Unlock()
+	return nil
+}
+
+// WatchFile loads the file and reloads it every interval once it changed, until Close.
+// A reload that fails is logged and the previous lists are kept
+func (f *IPFilter) WatchFile(path string, interval time.Duration) error {
+	if err := f.LoadFile(path); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		modTime, size := info.ModTime(), info.Size()
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-f.exitCh:
+				return
+			case <-tick.C:
+				info, err := os.Stat(path)
+				if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+					continue
+				}
+				modTime, size = info.ModTime(), info.Size()
+				if err = f.LoadFile(path); err != nil {
+					Flog.Errorf("reload ip filter %s err: %v", path, err)
+					continue
+				}
+				Flog.Infof("ip filter %s reloaded", path)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops watching the list file
+func (f *IPFilter) Close() {
+	f.watchOnce.Do(func() {
+		close(f.exitCh)
+	})
+}
+
+// Ban rejects new connections from the IP for d and kicks its current connections,
+// d <= 0 bans it until Unban
+func (s *Server) Ban(ip string, d time.Duration) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("%w: %q", ErrInvalidIP, ip)
+	}
+	s.ban(parsed, d)
+	return nil
+}
+
+func (s *Server) ban(ip net.IP, d time.Duration) {
+	s.opt.ipFilter.Ban(ip, d)
+	Flog.Infof("ban %v for %v", ip, d)
+	s.sessions.Range(func(key, value interface{}) bool {
+		c := value.(*Session).GetConn()
+		if addrIP(c.GetClientIP()).Equal(ip) {
+			c.CloseWithReason(CloseBanned, "banned")
+		}
+		return true
+	})
+}
+
+// Unban lifts the ban of the IP
+func (s *Server) Unban(ip string) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("%w: %q", ErrInvalidIP, ip)
+	}
+	s.opt.ipFilter.Unban(parsed)
+	return nil
+}
+
+// IPFilter get the filter checking client IPs at accept time
+func (s *Server) IPFilter() *IPFilter {
+	return s.opt.ipFilter
+}
+
+// strike counts a protocol error of the connection's IP towards the automatic ban
+func (s *Server) strike(c *Conn) {
+	ip := addrIP(c.GetClientIP())
+	if s.opt.ipFilter.strike(ip) {
+		s.ban(ip, s.opt.ipFilter.autoBanDuration())
+	}
+}
+
+func (f *IPFilter) autoBanDuration() time.Duration {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.autoBanFor
+}
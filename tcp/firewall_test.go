@@ -0,0 +1,145 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFilterLists(t *testing.T) {
+	f := NewIPFilter()
+	assert.True(t, f.Allowed(net.ParseIP("203.0.113.7")))
+
+	assert.NoError(t, f.SetAllow("10.0.0.0/8", "2001:db8::/32"))
+	assert.NoError(t, f.SetDeny("10.1.2.3"))
+	assert.True(t, f.Allowed(net.ParseIP("10.9.9.9")))
+	assert.True(t, f.Allowed(net.ParseIP("2001:db8::1")))
+	assert.False(t, f.Allowed(net.ParseIP("10.1.2.3")))
+	assert.False(t, f.Allowed(net.ParseIP("203.0.113.7")))
+	assert.ErrorIs(t, f.SetDeny("10.0.0.0/99"), ErrInvalidIP)
+
+	f.Ban(net.ParseIP("10.9.9.9"), 50*time.Millisecond)
+	assert.False(t, f.Allowed(net.ParseIP("10.9.9.9")))
+	assert.Len(t, f.Bans(), 1)
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, f.Allowed(net.ParseIP("10.9.9.9")))
+	assert.Empty(t, f.Bans())
+
+	f.Ban(net.ParseIP("10.9.9.9"), 0)
+	assert.False(t, f.Allowed(net.ParseIP("10.9.9.9")))
+	f.Unban(net.ParseIP("10.9.9.9"))
+	assert.True(t, f.Allowed(net.ParseIP("10.9.9.9")))
+}
+
+func TestIPFilterPrune(t *testing.T) {
+	f := NewIPFilter()
+	f.SetAutoBan(3, 50*time.Millisecond)
+	assert.False(t, f.strike(net.ParseIP("10.0.0.1")))
+	f.Ban(net.ParseIP("10.0.0.2"), 50*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+
+	// the next strike after the prune period drops what expired meanwhile
+	f.mu.Lock()
+	f.pruned = time.Time{}
+	f.mu.Unlock()
+	assert.False(t, f.strike(net.ParseIP("10.0.0.3")))
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	assert.Len(t, f.strikes, 1)
+	assert.Contains(t, f.strikes, "10.0.0.3")
+	assert.Empty(t, f.bans)
+}
+
+func TestIPFilterWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip.list")
+	assert.NoError(t, os.WriteFile(path, []byte("# office\nallow 10.0.0.0/8\n"), 0o644))
+
+	f := NewIPFilter()
+	defer f.Close()
+	assert.NoError(t, f.WatchFile(path, 10*time.Millisecond))
+	assert.False(t, f.Allowed(net.ParseIP("192.0.2.1")))
+
+	assert.NoError(t, os.WriteFile(path, []byte("allow 10.0.0.0/8\nallow 192.0.2.0/24\ndeny 192.0.2.9\n"), 0o644))
+	assert.Eventually(t, func() bool {
+		return f.Allowed(net.ParseIP("192.0.2.1")) && !f.Allowed(net.ParseIP("192.0.2.9"))
+	}, time.Second, 10*time.Millisecond)
+
+	// a broken file keeps the previous lists
+	assert.NoError(t, os.WriteFile(path, []byte("permit everyone\n"), 0o644))
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, f.Allowed(net.ParseIP("192.0.2.1")))
+	assert.Error(t, f.LoadFile(path))
+}
+
+func TestServerBan(t *testing.T) {
+	closed := make(chan error, 1)
+	s := newTestServer()
+	s.OnClose(func(c *Conn, err error) {
+		closed <- err
+	})
+
+	c := newTestClient(t, s)
+	defer c.Close()
+	c.SendBytes(Single, []byte("hello"))
+	assert.Eventually(t, func() bool {
+		n := 0
+		s.sessions.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		return n == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// banning kicks the connection and rejects new ones
+	assert.NoError(t, s.Ban("127.0.0.1", time.Minute))
+	select {
+	case err := <-closed:
+		assert.Equal(t, CloseBanned, CloseCodeOf(err))
+	case <-time.After(time.Second):
+		t.Fatal("banned connection not kicked")
+	}
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.NoError(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	conn.Close()
+
+	assert.NoError(t, s.Unban("127.0.0.1"))
+	assert.ErrorIs(t, s.Ban("nope", time.Minute), ErrInvalidIP)
+	c2 := newTestClient(t, s)
+	defer c2.Close()
+	c2.SendBytes(Single, []byte("hello"))
+	select {
+	case err := <-closed:
+		t.Fatalf("unbanned connection closed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServerAutoBan(t *testing.T) {
+	f := NewIPFilter()
+	f.SetAutoBan(2, time.Minute)
+	s := newTestServer(WithIPFilter(f))
+	startTestServer(t, s)
+
+	bad, _ := NewDefaultProtocol().Pack(NewMessage(Single, []byte("hello")))
+	bad[len(bad)-1] ^= 0xff
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		assert.NoError(t, err)
+		_, err = conn.Write(bad)
+		assert.NoError(t, err)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _ = conn.Read(make([]byte, 64))
+		conn.Close()
+	}
+	assert.Eventually(t, func() bool {
+		_, ok := f.Bans()["127.0.0.1"]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
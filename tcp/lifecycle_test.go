@@ -0,0 +1,259 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// goroutines lists the goroutines running code of this package by ID
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	list := make(map[string]string)
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		stack := string(g)
+		if !strings.Contains(stack, "go-tools/tcp.") || strings.Contains(stack, "testing.tRunner") {
+			continue
+		}
+		id := strings.Fields(stack)[1]
+		list[id] = stack
+	}
+	return list
+}
+
+// checkLeaks fails the test if goroutines of this package started after the call are still running
+// once the test and its cleanups are done
+func checkLeaks(t *testing.T) {
+	before := goroutines()
+	t.Cleanup(func() {
+		var leaked []string
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			leaked = leaked[:0]
+			for id, stack := range goroutines() {
+				if _, ok := before[id]; !ok {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(leaked) > 0 {
+			t.Errorf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+	})
+}
+
+// closeCounter counts OnClose calls per connection
+type closeCounter struct {
+	sync.Mutex
+	calls  map[*Conn]int
+	errs   chan error
+	called int32
+}
+
+func newCloseCounter(s *Server) *closeCounter {
+	cc := &closeCounter{calls: make(map[*Conn]int), errs: make(chan error, 64)}
+	s.OnClose(func(c *Conn, err error) {
+		cc.Lock()
+		cc.calls[c]++
+		cc.Unlock()
+		atomic.AddInt32(&cc.called, 1)
+		cc.errs <- err
+	})
+	return cc
+}
+
+func (cc *closeCounter) wait(t *testing.T) error {
+	select {
+	case err := <-cc.errs:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnClose not called")
+		return nil
+	}
+}
+
+// once asserts every connection got exactly one OnClose call
+func (cc *closeCounter) once(t *testing.T) {
+	time.Sleep(100 * time.Millisecond)
+	cc.Lock()
+	defer cc.Unlock()
+	for _, n := range cc.calls {
+		assert.Equal(t, 1, n)
+	}
+}
+
+func TestLifecycleClientClose(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer()
+	cc := newCloseCounter(s)
+
+	c := newTestClient(t, s)
+	c.SendBytes(Single, []byte("hello"))
+	c.Close()
+	assert.Equal(t, CloseNormal, CloseCodeOf(cc.wait(t)))
+	cc.once(t)
+}
+
+func TestLifecycleConcurrentClose(t *testing.T) {
+	checkLeaks(t)
+	conns := make(chan *Conn, 1)
+	s := newTestServer()
+	s.OnConnect(func(c *Conn) {
+		conns <- c
+	})
+	cc := newCloseCounter(s)
+
+	c := newTestClient(t, s)
+	defer c.Close()
+	conn := <-conns
+
+	// every close path races, only the first cause is reported
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			conn.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			conn.CloseWithReason(CloseRateLimited, "")
+		}()
+		go func() {
+			defer wg.Done()
+			conn.shutdown(&CloseError{Code: CloseWriteFailed})
+		}()
+	}
+	wg.Wait()
+	err := cc.wait(t)
+	assert.Contains(t, []CloseCode{CloseKicked, CloseRateLimited, CloseWriteFailed}, CloseCodeOf(err))
+	cc.once(t)
+}
+
+func TestLifecycleSendAfterClose(t *testing.T) {
+	checkLeaks(t)
+	conns := make(chan *Conn, 1)
+	s := newTestServer()
+	s.OnConnect(func(c *Conn) {
+		conns <- c
+	})
+	cc := newCloseCounter(s)
+
+	c := newTestClient(t, s)
+	defer c.Close()
+	conn := <-conns
+	conn.Close()
+	cc.wait(t)
+
+	// the send queue is gone, senders must not block
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*cap(conn.sendCh); i++ {
+			conn.SendBytes(Single, []byte("late"))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("send blocked after close")
+	}
+	cc.once(t)
+}
+
+func TestLifecycleStuckPeer(t *testing.T) {
+	checkLeaks(t)
+	conns := make(chan *Conn, 1)
+	s := newTestServer()
+	s.OnConnect(func(c *Conn) {
+		conns <- c
+	})
+	cc := newCloseCounter(s)
+	startTestServer(t, s)
+
+	// a raw peer that never reads fills the socket buffers
+	raw, err := net.Dial("tcp", s.Addr().String())
+	assert.NoError(t, err)
+	defer raw.Close()
+	conn := <-conns
+	payload := make([]byte, 64<<10)
+	go func() {
+		for i := 0; i < 1024; i++ {
+			conn.SendBytes(Single, payload)
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close blocked on a stuck peer")
+	}
+	assert.Equal(t, CloseKicked, CloseCodeOf(cc.wait(t)))
+	cc.once(t)
+}
+
+func TestLifecycleStop(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer()
+	cc := newCloseCounter(s)
+
+	clients := make([]*Client, 4)
+	for i := range clients {
+		clients[i] = newTestClient(t, s)
+		defer clients[i].Close()
+		clients[i].SendBytes(Single, []byte("hello"))
+	}
+	assert.Eventually(t, func() bool {
+		n := 0
+		s.sessions.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		return n == len(clients)
+	}, time.Second, 10*time.Millisecond)
+
+	s.Stop()
+	s.Stop()
+	for range clients {
+		assert.Equal(t, CloseShutdown, CloseCodeOf(cc.wait(t)))
+	}
+	cc.once(t)
+	assert.Equal(t, int32(len(clients)), atomic.LoadInt32(&cc.called))
+}
+
+func TestLifecycleAuthTimeout(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer(WithAuthTimeout(100 * time.Millisecond))
+	s.OnAuth(TokenAuth([]byte("secret")))
+	cc := newCloseCounter(s)
+
+	c := newTestClient(t, s)
+	defer c.Close()
+	assert.ErrorIs(t, cc.wait(t), ErrAuthTimeout)
+	cc.once(t)
+}
@@ -0,0 +1,60 @@
+// Command loadtest measures how many connections and messages per second a tcp Server handles.
+//
+//	go run ./tcp/loadtest/cmd -clients 200 -duration 30s -rate 50 -mix 64:8,4096:2
+//
+// without -addr an echo server is started over loopback and its resource usage is reported,
+// a remote server must echo every message back to its sender
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	network "go-tools/tcp"
+	"go-tools/tcp/loadtest"
+)
+
+func main() {
+	addr := flag.String("addr", "", "address of an echo server, empty starts one over loopback")
+	clients := flag.Int("clients", 100, "number of simulated clients")
+	duration := flag.Duration("duration", 10*time.Second, "duration of the sending phase")
+	rate := flag.Float64("rate", 0, "messages per second per client, 0 waits for each reply before the next message")
+	mix := flag.String("mix", "64:1", "message sizes and weights as size:weight pairs")
+	cmd := flag.Uint("cmd", uint(network.Single), "command of the generated messages")
+	rampUp := flag.Duration("ramp", 0, "spread the client connections over this duration")
+	reactor := flag.Int("reactor", 0, "event loops of the loopback server, 0 runs goroutines per connection")
+	flag.Parse()
+
+	m, err := loadtest.ParseMix(*mix, network.CMD(*cmd))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var opts []network.Option
+	if *reactor > 0 {
+		opts = append(opts, network.WithReactor(*reactor))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	report, err := loadtest.Run(ctx, loadtest.Config{
+		Addr:     *addr,
+		Clients:  *clients,
+		Duration: *duration,
+		Rate:     *rate,
+		Mix:      m,
+		RampUp:   *rampUp,
+		Options:  opts,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Print(report)
+}
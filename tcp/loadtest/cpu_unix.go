@@ -0,0 +1,17 @@
+//go:build unix
+
+package loadtest
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime get the user and system CPU time used by the process
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
@@ -0,0 +1,377 @@
+// Package loadtest drives simulated clients speaking the DefaultProtocol against a tcp Server
+// and reports latency percentiles, throughput, errors and the server resource usage
+package loadtest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	network "go-tools/tcp"
+)
+
+var (
+	// ErrInvalidMix occurs when a message mix cannot be parsed
+	ErrInvalidMix = errors.New("invalid message mix")
+)
+
+const (
+	// headerSize is the send time and sequence number written at the start of every payload
+	headerSize = 16
+	// DefaultDrain is how long Run waits for the replies of the last messages
+	DefaultDrain = 2 * time.Second
+)
+
+// Mix is a kind of message sent by the clients, picked in proportion to its weight
+type Mix struct {
+	Cmd    network.CMD
+	Size   int
+	Weight int
+}
+
+// ParseMix parses a mix written as size:weight pairs, e.g. "64:8,1024:2,65536:1"
+func ParseMix(s string, cmd network.CMD) ([]Mix, error) {
+	var mix []Mix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		size, weight, ok := strings.Cut(part, ":")
+		if !ok {
+			weight = "1"
+		}
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidMix, part)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidMix, part)
+		}
+		mix = append(mix, Mix{Cmd: cmd, Size: n, Weight: w})
+	}
+	if len(mix) == 0 {
+		return nil, ErrInvalidMix
+	}
+	return mix, nil
+}
+
+// Config describes a load test
+type Config struct {
+	// Addr of the server under test, it must echo every message back. Empty starts an echo server over loopback
+	Addr string
+	// Clients is the number of simulated clients
+	Clients int
+	// Duration of the sending phase
+	Duration time.Duration
+	// Rate is the messages per second of each client, 0 sends the next message once the previous reply is received
+	Rate float64
+	// Mix is the kind of messages sent, 64 byte Single messages by default
+	Mix []Mix
+	// RampUp spreads the client connections over this duration
+	RampUp time.Duration
+	// Drain is how long to wait for the replies of the last messages
+	Drain time.Duration
+	// Options are passed to the clients and to the loopback server
+	Options []network.Option
+}
+
+// Latency holds the latency distribution of the replies
+type Latency struct {
+	Min  time.Duration
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	P999 time.Duration
+	Max  time.Duration
+}
+
+// Usage is the resource usage sampled during the test. For a loopback server it is the usage
+// of the whole process, the simulated clients included
+type Usage struct {
+	PeakSessions   int
+	PeakGoroutines int
+	PeakHeap       uint64
+	CPU            time.Duration
+	BytesIn        uint64
+	BytesOut       uint64
+}
+
+// Report is the result of a load test
+type Report struct {
+	Clients     int
+	Connected   int
+	DialErrors  int
+	Closed      int64
+	Sent        int64
+	Received    int64
+	Lost        int64
+	SentBytes   int64
+	Elapsed     time.Duration
+	MsgsPerSec  float64
+	BytesPerSec float64
+	Latency     Latency
+	// Server is nil when testing a remote server
+	Server *Usage
+}
+
+// String formats the report as a table
+func (r *Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "clients      %d connected, %d dial errors, %d closed early\n", r.Connected, r.DialErrors, r.Closed)
+	fmt.Fprintf(&b, "messages     %d sent, %d received, %d lost in %v\n", r.Sent, r.Received, r.Lost, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(&b, "throughput   %.0f msg/s, %.2f MB/s\n", r.MsgsPerSec, r.BytesPerSec/(1<<20))
+	l := r.Latency
+	fmt.Fprintf(&b, "latency      min %v  mean %v  p50 %v  p90 %v  p99 %v  p99.9 %v  max %v\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+	if u := r.Server; u != nil {
+		fmt.Fprintf(&b, "server       %d peak sessions, %d peak goroutines, %.1f MB peak heap, %v cpu\n",
+			u.PeakSessions, u.PeakGoroutines, float64(u.PeakHeap)/(1<<20), u.CPU.Round(time.Millisecond))
+		fmt.Fprintf(&b, "server io    %.2f MB in, %.2f MB out\n", float64(u.BytesIn)/(1<<20), float64(u.BytesOut)/(1<<20))
+	}
+	return b.String()
+}
+
+// NewEchoServer creates a server sending every message back to its sender
+func NewEchoServer(opts ...network.Option) *network.Server {
+	s := network.NewServer("127.0.0.1:0", opts...)
+	s.OnMessage(func(c *network.Conn, msg *network.Message) {
+		c.SendMessage(msg)
+	})
+	return s
+}
+
+// worker is a simulated client
+type worker struct {
+	cfg     *Config
+	cli     *network.Client
+	rnd     *rand.Rand
+	weights int
+	replies chan struct{}
+
+	mu        sync.Mutex
+	latencies []time.Duration
+}
+
+// Run executes the load test until the duration elapses or ctx is done
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.Clients <= 0 {
+		cfg.Clients = 1
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = 10 * time.Second
+	}
+	if cfg.Drain <= 0 {
+		cfg.Drain = DefaultDrain
+	}
+	if len(cfg.Mix) == 0 {
+		cfg.Mix = []Mix{{Cmd: network.Single, Size: 64, Weight: 1}}
+	}
+
+	var srv *network.Server
+	var sampler *sampler
+	if cfg.Addr == "" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		srv = NewEchoServer(cfg.Options...)
+		srv.StartWithListener(l)
+		defer srv.Stop()
+		cfg.Addr = l.Addr().String()
+		sampler = newSampler(srv)
+		defer sampler.stop()
+	}
+
+	report := &Report{Clients: cfg.Clients}
+	var sent, received, sentBytes, closed int64
+	workers := make([]*worker, 0, cfg.Clients)
+	for i := 0; i < cfg.Clients; i++ {
+		if cfg.RampUp > 0 && i > 0 {
+			time.Sleep(cfg.RampUp / time.Duration(cfg.Clients))
+		}
+		w := &worker{
+			cfg:     &cfg,
+			cli:     network.NewClient(cfg.Addr, cfg.Options...),
+			rnd:     rand.New(rand.NewSource(time.Now().UnixNano() + int64(i))),
+			replies: make(chan struct{}, 1),
+		}
+		for _, m := range cfg.Mix {
+			w.weights += m.Weight
+		}
+		w.cli.OnMessage(func(c *network.Client, msg *network.Message) {
+			if w.reply(msg) {
+				atomic.AddInt64(&received, 1)
+			}
+		})
+		w.cli.OnClose(func(c *network.Client, err error) {
+			atomic.AddInt64(&closed, 1)
+		})
+		if err := w.cli.Dial(); err != nil {
+			report.DialErrors++
+			continue
+		}
+		workers = append(workers, w)
+	}
+	report.Connected = len(workers)
+	defer func() {
+		for _, w := range workers {
+			w.cli.Close()
+		}
+	}()
+
+	runCtx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(runCtx, &sent, &sentBytes)
+		}(w)
+	}
+	wg.Wait()
+
+	// wait for the replies still in flight
+	deadline := time.Now().Add(cfg.Drain)
+	for atomic.LoadInt64(&received) < atomic.LoadInt64(&sent) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	report.Elapsed = time.Since(start)
+
+	report.Sent = atomic.LoadInt64(&sent)
+	report.Received = atomic.LoadInt64(&received)
+	report.Lost = report.Sent - report.Received
+	report.SentBytes = atomic.LoadInt64(&sentBytes)
+	report.Closed = atomic.LoadInt64(&closed)
+	if secs := report.Elapsed.Seconds(); secs > 0 {
+		report.MsgsPerSec = float64(report.Received) / secs
+		report.BytesPerSec = float64(report.SentBytes) / secs
+	}
+
+	var all []time.Duration
+	for _, w := range workers {
+		w.mu.Lock()
+		all = append(all, w.latencies...)
+		w.mu.Unlock()
+	}
+	report.Latency = percentiles(all)
+	if sampler != nil {
+		report.Server = sampler.stop()
+	}
+	return report, nil
+}
+
+// run sends messages until ctx is done
+func (w *worker) run(ctx context.Context, sent, sentBytes *int64) {
+	var tick <-chan time.Time
+	if w.cfg.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / w.cfg.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for seq := uint64(0); ; seq++ {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		msg := w.message(seq)
+		w.cli.SendMessage(msg)
+		atomic.AddInt64(sent, 1)
+		atomic.AddInt64(sentBytes, int64(len(msg.GetData())))
+
+		if tick == nil {
+			// closed loop, the next message waits for the reply
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.replies:
+			}
+		}
+	}
+}
+
+// message builds the next message of the mix, its payload starts with the send time
+func (w *worker) message(seq uint64) *network.Message {
+	n := w.rnd.Intn(w.weights)
+	m := w.cfg.Mix[0]
+	for _, mix := range w.cfg.Mix {
+		if n < mix.Weight {
+			m = mix
+			break
+		}
+		n -= mix.Weight
+	}
+	size := m.Size
+	if size < headerSize {
+		size = headerSize
+	}
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint64(data, uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint64(data[8:], seq)
+	return network.NewMessage(m.Cmd, data)
+}
+
+// reply records the latency of an echoed message
+func (w *worker) reply(msg *network.Message) bool {
+	data := msg.GetData()
+	if len(data) < headerSize {
+		return false
+	}
+	latency := time.Since(time.Unix(0, int64(binary.LittleEndian.Uint64(data))))
+	w.mu.Lock()
+	w.latencies = append(w.latencies, latency)
+	w.mu.Unlock()
+	select {
+	case w.replies <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// percentiles computes the latency distribution
+func percentiles(list []time.Duration) Latency {
+	if len(list) == 0 {
+		return Latency{}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	var sum time.Duration
+	for _, d := range list {
+		sum += d
+	}
+	at := func(p float64) time.Duration {
+		i := int(p * float64(len(list)))
+		if i >= len(list) {
+			i = len(list) - 1
+		}
+		return list[i]
+	}
+	return Latency{
+		Min:  list[0],
+		Mean: sum / time.Duration(len(list)),
+		P50:  at(0.50),
+		P90:  at(0.90),
+		P99:  at(0.99),
+		P999: at(0.999),
+		Max:  list[len(list)-1],
+	}
+}
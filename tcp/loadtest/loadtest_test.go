@@ -0,0 +1,63 @@
+package loadtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	network "go-tools/tcp"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := ParseMix("64:8, 1024:2,4096", network.Single)
+	assert.NoError(t, err)
+	assert.Equal(t, []Mix{
+		{Cmd: network.Single, Size: 64, Weight: 8},
+		{Cmd: network.Single, Size: 1024, Weight: 2},
+		{Cmd: network.Single, Size: 4096, Weight: 1},
+	}, mix)
+
+	for _, s := range []string{"", "a:1", "64:0", "-1:1"} {
+		_, err = ParseMix(s, network.Single)
+		assert.ErrorIs(t, err, ErrInvalidMix, s)
+	}
+}
+
+func TestRunLoopback(t *testing.T) {
+	mix, _ := ParseMix("32:3,2048:1", network.Single)
+	report, err := Run(context.Background(), Config{
+		Clients:  8,
+		Duration: 300 * time.Millisecond,
+		Mix:      mix,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, report.Connected)
+	assert.Positive(t, report.Sent)
+	assert.Zero(t, report.Lost)
+	assert.Zero(t, report.Closed)
+
+	l := report.Latency
+	assert.Positive(t, l.Min)
+	assert.LessOrEqual(t, l.Min, l.P50)
+	assert.LessOrEqual(t, l.P50, l.P99)
+	assert.LessOrEqual(t, l.P99, l.Max)
+	if assert.NotNil(t, report.Server) {
+		assert.Equal(t, 8, report.Server.PeakSessions)
+		assert.Positive(t, report.Server.BytesIn)
+	}
+	assert.Contains(t, report.String(), "p99")
+}
+
+func TestRunRate(t *testing.T) {
+	report, err := Run(context.Background(), Config{
+		Clients:  2,
+		Duration: 500 * time.Millisecond,
+		Rate:     20,
+	})
+	assert.NoError(t, err)
+	// two clients at 20 msg/s for half a second
+	assert.InDelta(t, 20, report.Sent, 4)
+	assert.Equal(t, report.Sent, report.Received)
+}
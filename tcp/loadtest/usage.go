@@ -0,0 +1,92 @@
+package loadtest
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	network "go-tools/tcp"
+)
+
+// sampleInterval is how often the server usage is sampled
+const sampleInterval = 50 * time.Millisecond
+
+// sampler records the peak usage of a loopback server
+type sampler struct {
+	srv      *network.Server
+	cpu      time.Duration
+	exitCh   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu    sync.Mutex
+	usage Usage
+	bytes map[string][2]uint64
+}
+
+func newSampler(srv *network.Server) *sampler {
+	s := &sampler{
+		srv:    srv,
+		cpu:    cpuTime(),
+		exitCh: make(chan struct{}),
+		done:   make(chan struct{}),
+		bytes:  make(map[string][2]uint64),
+	}
+	go s.run()
+	return s
+}
+
+func (s *sampler) run() {
+	defer close(s.done)
+	tick := time.NewTicker(sampleInterval)
+	defer tick.Stop()
+	for {
+		s.sample()
+		select {
+		case <-s.exitCh:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func (s *sampler) sample() {
+	sessions := s.srv.Sessions()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := &s.usage
+	if len(sessions) > u.PeakSessions {
+		u.PeakSessions = len(sessions)
+	}
+	if n := runtime.NumGoroutine(); n > u.PeakGoroutines {
+		u.PeakGoroutines = n
+	}
+	if mem.HeapAlloc > u.PeakHeap {
+		u.PeakHeap = mem.HeapAlloc
+	}
+	// sessions leave the list once closed, so the last sample of each one is kept
+	for _, info := range sessions {
+		s.bytes[info.Sid] = [2]uint64{info.BytesIn, info.BytesOut}
+	}
+}
+
+// stop ends the sampling and returns the usage, it is safe to call more than once
+func (s *sampler) stop() *Usage {
+	s.stopOnce.Do(func() {
+		s.sample()
+		close(s.exitCh)
+		<-s.done
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.usage
+	u.CPU = cpuTime() - s.cpu
+	for _, b := range s.bytes {
+		u.BytesIn += b[0]
+		u.BytesOut += b[1]
+	}
+	return &u
+}
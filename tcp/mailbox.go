@@ -0,0 +1,460 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidMail occurs when a Mail frame is malformed
+	ErrInvalidMail = errors.New("invalid mail")
+)
+
+const (
+	// DefaultMailTTL is how long an unacknowledged mail is kept
+	DefaultMailTTL = 7 * 24 * time.Hour
+	// DefaultMailRetry is how long the mailbox waits for a MailAck before delivering again
+	DefaultMailRetry = 10 * time.Second
+
+	// mailIDFile holds the last mail ID of a FileMailboxStore
+	mailIDFile = "mail.id"
+)
+
+// Mail is a message stored for a user until the user acknowledges it
+type Mail struct {
+	ID       uint64    `json:"id"`
+	Cmd      CMD       `json:"cmd"`
+	Data     []byte    `json:"data"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+// MailboxStore persists the pending mails of every user
+type MailboxStore interface {
+	// Put stores a mail for the user, a mail without ID gets one unique among the mails of the store
+	// so the nodes sharing it never hand out the same ID
+	Put(uid string, mail *Mail) error
+
+	// Get lists the pending mails of the user in the order they were put
+	Get(uid string) ([]*Mail, error)
+
+	// Delete removes a mail once it is acknowledged or expired
+	Delete(uid string, id uint64) error
+
+	// Users lists the users holding pending mails
+	Users() ([]string, error)
+}
+
+// PackMail encodes a mail delivery, the client answers with a MailAck carrying the mail ID
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ MailID    │ uint64 │ 8       ║
+// ║ Cmd       │ uint16 │ 2       ║
+// ║ Data      │ []byte │ dynamic ║
+// ╚═══════════╧════════╧═════════╝
+func PackMail(mail *Mail) *Message {
+	b := make([]byte, 10+len(mail.Data))
+	binary.LittleEndian.PutUint64(b, mail.ID)
+	binary.LittleEndian.PutUint16(b[8:], uint16(mail.Cmd))
+	copy(b[10:], mail.Data)
+	return NewMessage(MailFrame, b)
+}
+
+// UnpackMail decodes the mail ID and the original message of a Mail frame
+func UnpackMail(msg *Message) (uint64, *Message, error) {
+	data := msg.GetData()
+	if msg.GetCmd() != MailFrame || len(data) < 10 {
+		return 0, nil, ErrInvalidMail
+	}
+	cmd := CMD(binary.LittleEndian.Uint16(data[8:]))
+	return binary.LittleEndian.Uint64(data), NewMessage(cmd, data[10:]), nil
+}
+
+// NewMailAck creates the MailAck frame confirming a mail delivery
+func NewMailAck(id uint64) *Message {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, id)
+	return NewMessage(MailAck, b)
+}
+
+// Mailbox stores messages for offline users and delivers them once the user binds a session,
+// a mail is delivered again every retry interval until it is acknowledged or its TTL expires.
+// A mailbox only reaches the sessions of its own node: in cluster mode every node must use a store shared
+// by all of them, e.g. backed by a database, so the node the user binds on finds the mails stored by the
+// others. A mail put on a node is delivered by the nodes the user is online on, a process adding mails to
+// the store behind the servers' back calls Server.FlushMail
+type Mailbox struct {
+	store MailboxStore
+	ttl   time.Duration
+	retry time.Duration
+	srv   *Server
+
+	mu   sync.Mutex
+	sent map[uint64]time.Time
+}
+
+// NewMailbox creates a mailbox backed by store, zero durations fall back to the defaults
+func NewMailbox(store MailboxStore, ttl, retry time.Duration) *Mailbox {
+	if ttl <= 0 {
+		ttl = DefaultMailTTL
+	}
+	if retry <= 0 {
+		retry = DefaultMailRetry
+	}
+	return &Mailbox{
+		store: store,
+		ttl:   ttl,
+		retry: retry,
+		sent:  make(map[uint64]time.Time),
+	}
+}
+
+// SendMail stores the message for the user and delivers it right away to the user's sessions, on every node
+// in cluster mode, it is retried until acknowledged. Without a mailbox it falls back to SendUser
+func (s *Server) SendMail(uid string, msg *Message) error {
+	if s.opt.mailbox == nil {
+		s.SendUser(uid, msg)
+		return nil
+	}
+	return s.opt.mailbox.put(uid, msg)
+}
+
+// put stores a mail and delivers it if the user is online, the store assigns its ID
+func (m *Mailbox) put(uid string, msg *Message) error {
+	mail := &Mail{
+		Cmd:      msg.GetCmd(),
+		Data:     msg.GetData(),
+		ExpireAt: time.Now().Add(m.ttl),
+	}
+	if err := m.store.Put(uid, mail); err != nil {
+		return err
+	}
+	m.deliver(uid, []*Mail{mail})
+	if m.srv.cluster != nil {
+		m.srv.cluster.forwardMail(uid, mail.ID)
+	}
+	return nil
+}
+
+// FlushMail delivers the pending mails of the user to its sessions on this node,
+// it does nothing without a mailbox
+func (s *Server) FlushMail(uid string) {
+	if s.opt.mailbox != nil {
+		s.opt.mailbox.flush(uid)
+	}
+}
+
+// deliver sends the mails to the local sessions of the user
+func (m *Mailbox) deliver(uid string, mails []*Mail) {
+	sessions := m.srv.users.sessions(uid)
+	if len(sessions) == 0 || len(mails) == 0 {
+		return
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	for _, mail := range mails {
+		m.sent[mail.ID] = now
+	}
+	m.mu.Unlock()
+
+	for _, mail := range mails {
+		msg := PackMail(mail)
+		for _, sess := range sessions {
+			sess.GetConn().SendMessage(msg)
+		}
+	}
+}
+
+// flush delivers every pending mail of a user who just bound a session
+func (m *Mailbox) flush(uid string) {
+	mails, err := m.store.Get(uid)
+	if err != nil {
+		Flog.Errorf("mailbox get %s err: %v", uid, err)
+		return
+	}
+	m.deliver(uid, m.pending(uid, mails, time.Now()))
+}
+
+// deliverID delivers a mail another node put in the shared store
+func (m *Mailbox) deliverID(uid string, id uint64) {
+	mails, err := m.store.Get(uid)
+	if err != nil {
+		Flog.Errorf("mailbox get %s err: %v", uid, err)
+		return
+	}
+	for _, mail := range m.pending(uid, mails, time.Now()) {
+		if mail.ID == id {
+			m.deliver(uid, []*Mail{mail})
+			return
+		}
+	}
+}
+
+// ack removes a delivered mail
+func (m *Mailbox) ack(uid string, data []byte) {
+	if uid == "" || len(data) < 8 {
+		return
+	}
+	id := binary.LittleEndian.Uint64(data)
+	m.mu.Lock()
+	delete(m.sent, id)
+	m.mu.Unlock()
+	if err := m.store.Delete(uid, id); err != nil {
+		Flog.Errorf("mailbox ack %s err: %v", uid, err)
+	}
+}
+
+// pending drops the expired mails and returns the rest
+func (m *Mailbox) pending(uid string, mails []*Mail, now time.Time) []*Mail {
+	list := mails[:0]
+	for _, mail := range mails {
+		if now.After(mail.ExpireAt) {
+			m.mu.Lock()
+			delete(m.sent, mail.ID)
+			m.mu.Unlock()
+			_ = m.store.Delete(uid, mail.ID)
+			continue
+		}
+		list = append(list, mail)
+	}
+	return list
+}
+
+// run redelivers unacknowledged mails and expires old ones until the server stops
+func (m *Mailbox) run() {
+	tick := time.NewTicker(m.retry / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case <-m.srv.exitCh:
+			return
+		case now := <-tick.C:
+			users, err := m.store.Users()
+			if err != nil {
+				Flog.Errorf("mailbox users err: %v", err)
+				continue
+			}
+			for _, uid := range users {
+				mails, err := m.store.Get(uid)
+				if err != nil {
+					continue
+				}
+				mails = m.pending(uid, mails, now)
+				var due []*Mail
+				m.mu.Lock()
+				for _, mail := range mails {
+					if now.Sub(m.sent[mail.ID]) >= m.retry {
+						due = append(due, mail)
+					}
+				}
+				m.mu.Unlock()
+				m.deliver(uid, due)
+			}
+		}
+	}
+}
+
+// MemoryMailboxStore keeps pending mails in memory, they are lost on restart
+type MemoryMailboxStore struct {
+	sync.Mutex
+	mails  map[string][]*Mail
+	nextID uint64
+}
+
+// NewMemoryMailboxStore creates an in-memory mailbox store
+func NewMemoryMailboxStore() *MemoryMailboxStore {
+	return &MemoryMailboxStore{mails: make(map[string][]*Mail)}
+}
+
+// Put implements MailboxStore
+func (s *MemoryMailboxStore) Put(uid string, mail *Mail) error {
+	s.Lock()
+	defer s.Unlock()
+	if mail.ID == 0 {
+		s.nextID++
+		mail.ID = s.nextID
+	}
+	s.mails[uid] = append(s.mails[uid], mail)
+	return nil
+}
+
+// Get implements MailboxStore
+func (s *MemoryMailboxStore) Get(uid string) ([]*Mail, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*Mail(nil), s.mails[uid]...), nil
+}
+
+// Delete implements MailboxStore
+func (s *MemoryMailboxStore) Delete(uid string, id uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	s.mails[uid] = removeMail(s.mails[uid], id)
+	if len(s.mails[uid]) == 0 {
+		delete(s.mails, uid)
+	}
+	return nil
+}
+
+// Users implements MailboxStore
+func (s *MemoryMailboxStore) Users() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	users := make([]string, 0, len(s.mails))
+	for uid := range s.mails {
+		users = append(users, uid)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// FileMailboxStore keeps the pending mails of each user in a JSON file of the directory, and the last
+// mail ID it assigned in a file of its own so the IDs survive a restart. It is not meant to be shared
+// by several processes
+type FileMailboxStore struct {
+	sync.Mutex
+	dir string
+}
+
+// NewFileMailboxStore creates a file mailbox store in dir, the directory is created if needed
+func NewFileMailboxStore(dir string) (*FileMailboxStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileMailboxStore{dir: dir}, nil
+}
+
+// nextID assigns the next mail ID, it is called with the lock held
+func (s *FileMailboxStore) nextID() (uint64, error) {
+	path := filepath.Join(s.dir, mailIDFile)
+	var last uint64
+	b, err := os.ReadFile(path)
+	if err == nil {
+		if last, err = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	last++
+	if err = os.WriteFile(path+".tmp", []byte(strconv.FormatUint(last, 10)), 0o644); err != nil {
+		return 0, err
+	}
+	return last, os.Rename(path+".tmp", path)
+}
+
+// path the user ID is hex encoded so any ID makes a safe file name
+func (s *FileMailboxStore) path(uid string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(uid))+".json")
+}
+
+func (s *FileMailboxStore) load(uid string) ([]*Mail, error) {
+	b, err := os.ReadFile(s.path(uid))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var mails []*Mail
+	err = json.Unmarshal(b, &mails)
+	return mails, err
+}
+
+// save writes the mails to a temporary file first so a crash never leaves a torn file
+func (s *FileMailboxStore) save(uid string, mails []*Mail) error {
+	if len(mails) == 0 {
+		err := os.Remove(s.path(uid))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(mails)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(uid) + ".tmp"
+	if err = os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(uid))
+}
+
+// Put implements MailboxStore
+func (s *FileMailboxStore) Put(uid string, mail *Mail) error {
+	s.Lock()
+	defer s.Unlock()
+	if mail.ID == 0 {
+		id, err := s.nextID()
+		if err != nil {
+			return err
+		}
+		mail.ID = id
+	}
+	mails, err := s.load(uid)
+	if err != nil {
+		return err
+	}
+	return s.save(uid, append(mails, mail))
+}
+
+// Get implements MailboxStore
+func (s *FileMailboxStore) Get(uid string) ([]*Mail, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.load(uid)
+}
+
+// Delete implements MailboxStore
+func (s *FileMailboxStore) Delete(uid string, id uint64) error {
+	s.Lock()
+	defer s.Unlock()
+	mails, err := s.load(uid)
+	if err != nil {
+		return err
+	}
+	return s.save(uid, removeMail(mails, id))
+}
+
+// Users implements MailboxStore
+func (s *FileMailboxStore) Users() ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		uid, err := hex.DecodeString(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			continue
+		}
+		users = append(users, string(uid))
+	}
+	return users, nil
+}
+
+func removeMail(mails []*Mail, id uint64) []*Mail {
+	for i, mail := range mails {
+		if mail.ID == id {
+			return append(mails[:i:i], mails[i+1:]...)
+		}
+	}
+	return mails
+}
@@ -0,0 +1,167 @@
+package network
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMailboxServer(store MailboxStore) *Server {
+	s := newTestServer(WithMailbox(NewMailbox(store, time.Minute, 100*time.Millisecond)))
+	s.OnMessage(func(c *Conn, msg *Message) {
+		c.GetSession().BindUserID(string(msg.GetData()))
+	})
+	return s
+}
+
+func TestMailboxFlushOnBind(t *testing.T) {
+	store := NewMemoryMailboxStore()
+	s := newMailboxServer(store)
+	startTestServer(t, s)
+
+	s.SendUser("alice", NewMessage(Single, []byte("while offline")))
+	users, _ := store.Users()
+	assert.Equal(t, []string{"alice"}, users)
+
+	received := make(chan *Message, 4)
+	c := newTestClient(t, s)
+	defer c.Close()
+	c.OnMessage(func(c *Client, msg *Message) {
+		received <- msg
+	})
+	c.SendBytes(Single, []byte("alice"))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, Single, msg.GetCmd())
+		assert.Equal(t, "while offline", string(msg.GetData()))
+	case <-time.After(2 * time.Second):
+		t.Fatal("mail not flushed")
+	}
+	assert.Eventually(t, func() bool {
+		users, _ := store.Users()
+		return len(users) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMailboxRetryUntilAck(t *testing.T) {
+	store := NewMemoryMailboxStore()
+	s := newMailboxServer(store)
+	startTestServer(t, s)
+
+	// a raw connection never acknowledges, so the mail keeps coming
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	p := NewDefaultProtocol()
+	write := func(msg *Message) {
+		b, err := p.Pack(msg)
+		assert.NoError(t, err)
+		_, err = conn.Write(b)
+		assert.NoError(t, err)
+	}
+	write(NewMessage(Single, []byte("bob")))
+	assert.Eventually(t, func() bool {
+		return len(s.users.sessions("bob")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, s.SendMail("bob", NewMessage(Single, []byte("hi"))))
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var id uint64
+	for i := 0; i < 2; i++ {
+		msg, err := p.Unpack(reader)
+		if !assert.NoError(t, err) {
+			return
+		}
+		mid, inner, err := UnpackMail(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, "hi", string(inner.GetData()))
+		id = mid
+	}
+
+	write(NewMailAck(id))
+	assert.Eventually(t, func() bool {
+		mails, _ := store.Get("bob")
+		return len(mails) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMailboxLeavesAppAck(t *testing.T) {
+	s := newTestServer(WithMailbox(NewMailbox(NewMemoryMailboxStore(), time.Minute, time.Second)))
+	received := make(chan CMD, 1)
+	s.OnMessage(func(c *Conn, msg *Message) {
+		received <- msg.GetCmd()
+	})
+	startTestServer(t, s)
+
+	c := newTestClient(t, s)
+	defer c.Close()
+	c.SendBytes(Ack, []byte("app"))
+	select {
+	case cmd := <-received:
+		assert.Equal(t, Ack, cmd)
+	case <-time.After(2 * time.Second):
+		t.Fatal("the application Ack did not reach OnMessage")
+	}
+}
+
+func TestMailboxSharedStoreIDs(t *testing.T) {
+	store := NewMemoryMailboxStore()
+	s1, s2 := newMailboxServer(store), newMailboxServer(store)
+
+	// two nodes started at once put mails for the same user in the shared store
+	assert.NoError(t, s1.SendMail("alice", NewMessage(Single, []byte("from 1"))))
+	assert.NoError(t, s2.SendMail("alice", NewMessage(Single, []byte("from 2"))))
+	mails, err := store.Get("alice")
+	assert.NoError(t, err)
+	if !assert.Len(t, mails, 2) {
+		return
+	}
+	assert.NotEqual(t, mails[0].ID, mails[1].ID)
+
+	// an ack through the other node removes that mail only
+	s2.opt.mailbox.ack("alice", NewMailAck(mails[0].ID).GetData())
+	left, err := store.Get("alice")
+	assert.NoError(t, err)
+	assert.Len(t, left, 1)
+	assert.Equal(t, "from 2", string(left[0].Data))
+}
+
+func TestFileMailboxStore(t *testing.T) {
+	store, err := NewFileMailboxStore(t.TempDir())
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Put("user/1", &Mail{ID: 1, Cmd: Single, Data: []byte("a")}))
+	assert.NoError(t, store.Put("user/1", &Mail{ID: 2, Cmd: Single, Data: []byte("b")}))
+	users, err := store.Users()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user/1"}, users)
+
+	assert.NoError(t, store.Delete("user/1", 1))
+	mails, err := store.Get("user/1")
+	assert.NoError(t, err)
+	assert.Len(t, mails, 1)
+	assert.Equal(t, "b", string(mails[0].Data))
+
+	assert.NoError(t, store.Delete("user/1", 2))
+	users, err = store.Users()
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+
+	// the IDs it assigns carry on after a restart
+	mail := &Mail{Cmd: Single}
+	assert.NoError(t, store.Put("user/2", mail))
+	assert.Equal(t, uint64(1), mail.ID)
+	store, err = NewFileMailboxStore(store.dir)
+	assert.NoError(t, err)
+	mail = &Mail{Cmd: Single}
+	assert.NoError(t, store.Put("user/2", mail))
+	assert.Equal(t, uint64(2), mail.ID)
+	users, err = store.Users()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"user/2"}, users)
+}
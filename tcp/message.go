@@ -23,6 +23,37 @@ const (
 	All
 )
 
+// ReservedCMD starts the range of the commands used internally by the server, up to 0xFFFF.
+// Applications define their own commands below it so the server never takes their frames over
+const ReservedCMD CMD = 0xFF00
+
+const (
+	// StreamData carries a fragment of a streamed payload
+	StreamData CMD = ReservedCMD + iota
+	// StreamWindow grants the stream sender more bytes to send
+	StreamWindow
+	// StreamReset asks the stream sender to abort
+	StreamReset
+	// MuxFrame carries a frame of a multiplexed logical stream
+	MuxFrame
+	// Subscribe subscribes the session to a topic filter
+	Subscribe
+	// Unsubscribe removes a topic filter of the session
+	Unsubscribe
+	// Publish delivers a message published on a topic
+	Publish
+	// ClusterFrame carries traffic between the nodes of a cluster
+	ClusterFrame
+	// MailFrame delivers a mailbox message, the receiver confirms it with a MailAck
+	MailFrame
+	// Auth carries the handshake credential, the server answers with the result code
+	Auth
+	// Close carries the close code and reason sent before hanging up
+	Close
+	// MailAck confirms a mail delivery, the application Ack is left to OnMessage
+	MailAck
+)
+
 func NewMessage(cmd CMD, data []byte) *Message {
 	msg := &Message{
 		cmd:  cmd,
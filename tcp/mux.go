@@ -0,0 +1,579 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMuxClosed occurs when the multiplexer or its connection is closed
+	ErrMuxClosed = errors.New("mux closed")
+	// ErrMuxBacklog occurs when the peer opens streams faster than they are accepted
+	ErrMuxBacklog = errors.New("mux accept backlog full")
+)
+
+const (
+	// DefaultMuxHalfCloseTimeout is how long a closed stream waits for the peer's Fin
+	DefaultMuxHalfCloseTimeout = 30 * time.Second
+
+	muxHeaderSize  = 5
+	muxBacklogSize = 64
+)
+
+const (
+	muxTypeSyn byte = iota
+	muxTypeData
+	muxTypeWindow
+	muxTypeFin
+	muxTypeRst
+)
+
+// Won't compile if Mux can't be used as a net.Listener or MuxStream as a net.Conn
+var (
+	_ net.Listener = (*Mux)(nil)
+	_ net.Conn     = (*MuxStream)(nil)
+)
+
+// muxFrame builds a MuxFrame message
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ StreamID  │ uint32 │ 4       ║
+// ║ Type      │ uint8  │ 1       ║
+// ║ Payload   │ []byte │ dynamic ║
+// ╚═══════════╧════════╧═════════╝
+func muxFrame(id uint32, typ byte, payload []byte) *Message {
+	b := make([]byte, muxHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(b, id)
+	b[4] = typ
+	copy(b[muxHeaderSize:], payload)
+	return NewMessage(MuxFrame, b)
+}
+
+// Mux multiplexes logical streams over a single connection, both sides may open streams.
+// It implements net.Listener so another protocol can be served on the accepted streams
+type Mux struct {
+	sync.Mutex
+	nextID    uint32
+	window    uint32
+	fragment  int
+	halfClose time.Duration
+	streams   map[uint32]*MuxStream
+	acceptCh  chan *MuxStream
+	ctrlCh    chan<- *Message
+	dataCh    chan<- *Message
+	raw       func() net.Conn
+	done      chan struct{}
+	err       error
+}
+
+// newMux the client side opens odd stream IDs and the server side even ones
+func newMux(opt *Options, client bool, ctrlCh, dataCh chan<- *Message, raw func() net.Conn) *Mux {
+	m := &Mux{
+		window:    opt.streamWindow,
+		fragment:  opt.streamFragment,
+		halfClose: opt.muxHalfClose,
+		streams:   make(map[uint32]*MuxStream),
+		acceptCh:  make(chan *MuxStream, muxBacklogSize),
+		ctrlCh:    ctrlCh,
+		dataCh:    dataCh,
+		raw:       raw,
+		done:      make(chan struct{}),
+	}
+	if client {
+		m.nextID = 1
+	} else {
+		m.nextID = 2
+	}
+	return m
+}
+
+// ctrl queues a control frame, it gives up once the mux is closed
+func (m *Mux) ctrl(msg *Message) {
+	select {
+	case m.ctrlCh <- msg:
+	case <-m.done:
+	}
+}
+
+// data queues a data frame, it gives up once the mux is closed
+func (m *Mux) data(msg *Message) error {
+	select {
+	case m.dataCh <- msg:
+		return nil
+	case <-m.done:
+		return ErrMuxClosed
+	}
+}
+
+// Open opens a new logical stream to the peer
+func (m *Mux) Open() (*MuxStream, error) {
+	m.Lock()
+	if m.err != nil {
+		m.Unlock()
+		return nil, m.err
+	}
+	id := m.nextID
+	m.nextID += 2
+	s := m.newStream(id)
+	m.streams[id] = s
+	m.Unlock()
+
+	// sent in the data lane so it can't be overtaken by the first write, it carries the window
+	// granted to the peer, which replies with its own
+	if err := m.data(muxFrame(id, muxTypeSyn, uint32Bytes(m.window))); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// AcceptStream waits for the next stream opened by the peer
+func (m *Mux) AcceptStream() (*MuxStream, error) {
+	select {
+	case s := <-m.acceptCh:
+		return s, nil
+	case <-m.done:
+		return nil, ErrMuxClosed
+	}
+}
+
+// Accept implements net.Listener
+func (m *Mux) Accept() (net.Conn, error) {
+	s, err := m.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Addr implements net.Listener
+func (m *Mux) Addr() net.Addr {
+	if conn := m.raw(); conn != nil {
+		return conn.LocalAddr()
+	}
+	return nil
+}
+
+// Close resets every stream and stops accepting, the underlying connection is left open
+func (m *Mux) Close() error {
+	m.close(ErrMuxClosed, true)
+	return nil
+}
+
+// NumStreams get the number of open streams
+func (m *Mux) NumStreams() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.streams)
+}
+
+func (m *Mux) close(err error, notify bool) {
+	m.Lock()
+	if m.err != nil {
+		m.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = make(map[uint32]*MuxStream)
+	m.Unlock()
+
+	for id, s := range streams {
+		s.abort(err)
+		if notify {
+			select {
+			case m.ctrlCh <- muxFrame(id, muxTypeRst, nil):
+			default:
+			}
+		}
+	}
+	close(m.done)
+}
+
+func (m *Mux) newStream(id uint32) *MuxStream {
+	return &MuxStream{
+		id:          id,
+		mux:         m,
+		recvWindow:  m.window,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func (m *Mux) remove(id uint32) {
+	m.Lock()
+	delete(m.streams, id)
+	m.Unlock()
+}
+
+// forget removes the stream if it is still registered under its ID
+func (m *Mux) forget(id uint32, s *MuxStream) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.streams[id] != s {
+		return false
+	}
+	delete(m.streams, id)
+	return true
+}
+
+// handle dispatches a mux frame read from the connection
+func (m *Mux) handle(msg *Message) {
+	data := msg.GetData()
+	if len(data) < muxHeaderSize {
+		return
+	}
+	id := binary.LittleEndian.Uint32(data)
+	typ := data[4]
+	payload := data[muxHeaderSize:]
+
+	m.Lock()
+	if m.err != nil {
+		m.Unlock()
+		return
+	}
+	s, ok := m.streams[id]
+	if typ == muxTypeSyn {
+		if ok || id%2 == m.nextID%2 {
+			m.Unlock()
+			m.ctrl(muxFrame(id, muxTypeRst, nil))
+			return
+		}
+		s = m.newStream(id)
+		if len(payload) >= 4 {
+			s.sendWindow = binary.LittleEndian.Uint32(payload)
+		}
+		select {
+		case m.acceptCh <- s:
+			m.streams[id] = s
+			m.Unlock()
+			m.ctrl(muxFrame(id, muxTypeWindow, uint32Bytes(m.window)))
+		default:
+			m.Unlock()
+			Flog.Errorf("mux stream %d refused: %v", id, ErrMuxBacklog)
+			m.ctrl(muxFrame(id, muxTypeRst, nil))
+		}
+		return
+	}
+	m.Unlock()
+	if !ok {
+		return
+	}
+
+	switch typ {
+	case muxTypeData:
+		s.push(payload)
+	case muxTypeWindow:
+		if len(payload) >= 4 {
+			s.grant(binary.LittleEndian.Uint32(payload))
+		}
+	case muxTypeFin:
+		s.remoteFin()
+	case muxTypeRst:
+		s.abort(ErrStreamReset)
+		m.remove(id)
+	}
+}
+
+// MuxStream is a logical stream of a Mux, it can be used as a net.Conn
+type MuxStream struct {
+	id            uint32
+	mux           *Mux
+	mu            sync.Mutex
+	buf           bytes.Buffer
+	recvWindow    uint32
+	consumed      uint32
+	sendWindow    uint32
+	readErr       error
+	writeErr      error
+	finSent       bool
+	finRecv       bool
+	closed        bool
+	readNotify    chan struct{}
+	writeNotify   chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// ID get the stream ID
+func (s *MuxStream) ID() uint32 {
+	return s.id
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes or the mux is closed
+func (s *MuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-s.mux.done:
+		return ErrMuxClosed
+	}
+}
+
+// Read implements net.Conn, it returns io.EOF once the peer closed its side
+func (s *MuxStream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if s.buf.Len() > 0 {
+			n, _ := s.buf.Read(p)
+			s.consumed += uint32(n)
+			var credit uint32
+			if s.readErr == nil && s.consumed >= s.mux.window/2 {
+				credit = s.consumed
+				s.recvWindow += credit
+				s.consumed = 0
+			}
+			s.mu.Unlock()
+			if credit > 0 {
+				s.mux.ctrl(muxFrame(s.id, muxTypeWindow, uint32Bytes(credit)))
+			}
+			return n, nil
+		}
+		if s.readErr != nil {
+			err := s.readErr
+			s.mu.Unlock()
+			return 0, err
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		if err := s.wait(s.readNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write implements net.Conn, it blocks while the peer's window is exhausted
+func (s *MuxStream) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		s.mu.Lock()
+		if s.closed || s.finSent {
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if s.writeErr != nil {
+			err := s.writeErr
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+			if err := s.wait(s.writeNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		n := len(p) - written
+		if n > s.mux.fragment {
+			n = s.mux.fragment
+		}
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.mux.data(muxFrame(s.id, muxTypeData, p[written:written+n])); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite half-closes the stream, the peer reads io.EOF while this side can still read
+func (s *MuxStream) CloseWrite() error {
+	s.mu.Lock()
+	if s.finSent || s.writeErr != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.finSent = true
+	done := s.finRecv
+	s.mu.Unlock()
+
+	// sent in the data lane so it can't overtake pending writes
+	err := s.mux.data(muxFrame(s.id, muxTypeFin, nil))
+	if done {
+		s.mux.remove(s.id)
+	}
+	return err
+}
+
+// Close implements net.Conn, it half-closes the stream and discards anything read afterwards.
+// The stream is reset if the peer does not close its side within the half-close timeout
+func (s *MuxStream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	credit := uint32(s.buf.Len()) + s.consumed
+	s.buf.Reset()
+	s.consumed = 0
+	s.mu.Unlock()
+	notify(s.readNotify)
+	notify(s.writeNotify)
+
+	if credit > 0 {
+		s.mux.ctrl(muxFrame(s.id, muxTypeWindow, uint32Bytes(credit)))
+	}
+	err := s.CloseWrite()
+	time.AfterFunc(s.mux.halfClose, s.expire)
+	return err
+}
+
+// expire resets a closed stream the peer never finished
+func (s *MuxStream) expire() {
+	s.mu.Lock()
+	finished := s.finRecv
+	s.mu.Unlock()
+	if finished || !s.mux.forget(s.id, s) {
+		return
+	}
+	s.abort(ErrStreamReset)
+	s.mux.ctrl(muxFrame(s.id, muxTypeRst, nil))
+}
+
+// push appends data received from the peer
+func (s *MuxStream) push(payload []byte) {
+	s.mu.Lock()
+	if s.readErr != nil {
+		s.mu.Unlock()
+		return
+	}
+	if uint32(len(payload)) > s.recvWindow {
+		s.readErr = ErrStreamWindow
+		s.writeErr = ErrStreamWindow
+		s.mu.Unlock()
+		notify(s.readNotify)
+		notify(s.writeNotify)
+		s.mux.remove(s.id)
+		go s.mux.ctrl(muxFrame(s.id, muxTypeRst, nil))
+		return
+	}
+	if s.closed {
+		// nobody reads anymore, hand the window straight back
+		s.mu.Unlock()
+		go s.mux.ctrl(muxFrame(s.id, muxTypeWindow, uint32Bytes(uint32(len(payload)))))
+		return
+	}
+	s.recvWindow -= uint32(len(payload))
+	s.buf.Write(payload)
+	s.mu.Unlock()
+	notify(s.readNotify)
+}
+
+// grant adds send window received from the peer
+func (s *MuxStream) grant(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	notify(s.writeNotify)
+}
+
+// remoteFin marks the peer side as finished
+func (s *MuxStream) remoteFin() {
+	s.mu.Lock()
+	s.finRecv = true
+	if s.readErr == nil {
+		s.readErr = io.EOF
+	}
+	done := s.finSent
+	s.mu.Unlock()
+	notify(s.readNotify)
+	if done {
+		s.mux.remove(s.id)
+	}
+}
+
+// abort fails pending and future reads and writes
+func (s *MuxStream) abort(err error) {
+	s.mu.Lock()
+	if s.readErr == nil || s.readErr == io.EOF {
+		s.readErr = err
+	}
+	if s.writeErr == nil {
+		s.writeErr = err
+	}
+	s.mu.Unlock()
+	notify(s.readNotify)
+	notify(s.writeNotify)
+}
+
+// LocalAddr implements net.Conn
+func (s *MuxStream) LocalAddr() net.Addr {
+	return s.mux.Addr()
+}
+
+// RemoteAddr implements net.Conn
+func (s *MuxStream) RemoteAddr() net.Addr {
+	if conn := s.mux.raw(); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// SetDeadline implements net.Conn
+func (s *MuxStream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn
+func (s *MuxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+	notify(s.readNotify)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn
+func (s *MuxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+	notify(s.writeNotify)
+	return nil
+}
+
+func uint32Bytes(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, n)
+	return b
+}
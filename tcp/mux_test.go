@@ -0,0 +1,161 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMuxEcho(t *testing.T) {
+	s := newTestServer(WithStreamWindow(32 << 10))
+	s.OnConnect(func(c *Conn) {
+		go func() {
+			for {
+				st, err := c.Mux().Accept()
+				if err != nil {
+					return
+				}
+				go func(st net.Conn) {
+					defer st.Close()
+					_, _ = io.Copy(st, st)
+				}(st)
+			}
+		}()
+	})
+
+	c := newTestClient(t, s, WithStreamWindow(32<<10))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			payload := make([]byte, 256<<10)
+			_, _ = rand.Read(payload)
+
+			st, err := c.Mux().Open()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer st.Close()
+			go func() {
+				_, _ = st.Write(payload)
+				_ = st.CloseWrite()
+			}()
+
+			b, err := io.ReadAll(st)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(payload, b))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMuxReadDeadline(t *testing.T) {
+	s := newTestServer()
+	accepted := make(chan *MuxStream, 1)
+	s.OnConnect(func(c *Conn) {
+		go func() {
+			st, err := c.Mux().AcceptStream()
+			if err == nil {
+				accepted <- st
+			}
+		}()
+	})
+
+	c := newTestClient(t, s)
+	defer c.Close()
+
+	st, err := c.Mux().Open()
+	assert.NoError(t, err)
+	_ = st.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = st.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	peer := <-accepted
+	assert.NoError(t, peer.Close())
+	_ = st.SetReadDeadline(time.Time{})
+	_, err = st.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMuxClosedWithConnection(t *testing.T) {
+	s := newTestServer()
+	c := newTestClient(t, s)
+
+	st, err := c.Mux().Open()
+	assert.NoError(t, err)
+	c.Close()
+
+	_, err = st.Read(make([]byte, 1))
+	assert.Equal(t, ErrMuxClosed, err)
+	_, err = c.Mux().Open()
+	assert.Equal(t, ErrMuxClosed, err)
+}
+
+func TestMuxDifferentWindows(t *testing.T) {
+	s := newTestServer(WithStreamWindow(16<<10), WithStreamFragment(4<<10))
+	s.OnConnect(func(c *Conn) {
+		go func() {
+			st, err := c.Mux().Accept()
+			if err != nil {
+				return
+			}
+			defer st.Close()
+			_, _ = io.Copy(st, st)
+		}()
+	})
+
+	// each side may only send what the other one buffers
+	c := newTestClient(t, s, WithStreamWindow(1<<20), WithStreamFragment(4<<10))
+	defer c.Close()
+
+	payload := make([]byte, 1<<20)
+	_, _ = rand.Read(payload)
+	st, err := c.Mux().Open()
+	assert.NoError(t, err)
+	defer st.Close()
+	go func() {
+		_, _ = st.Write(payload)
+		_ = st.CloseWrite()
+	}()
+
+	b, err := io.ReadAll(st)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(payload, b))
+}
+
+func TestMuxHalfCloseTimeout(t *testing.T) {
+	s := newTestServer()
+	accepted := make(chan *MuxStream, 1)
+	s.OnConnect(func(c *Conn) {
+		go func() {
+			st, err := c.Mux().AcceptStream()
+			if err == nil {
+				accepted <- st
+			}
+		}()
+	})
+
+	c := newTestClient(t, s, WithMuxHalfCloseTimeout(50*time.Millisecond))
+	defer c.Close()
+
+	st, err := c.Mux().Open()
+	assert.NoError(t, err)
+	peer := <-accepted
+	// the peer never closes its side
+	assert.NoError(t, st.Close())
+	assert.Eventually(t, func() bool { return c.Mux().NumStreams() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, err := peer.Write([]byte("x"))
+		return err == ErrStreamReset
+	}, time.Second, 10*time.Millisecond)
+}
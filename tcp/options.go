@@ -2,22 +2,47 @@ package network
 
 import (
 	"crypto/tls"
+	"net"
+	"runtime"
 	"time"
 )
 
 type Options struct {
-	logger    Logger
-	tlsConf   *tls.Config
-	heartbeat time.Duration
+	logger          Logger
+	tlsConf         *tls.Config
+	heartbeat       time.Duration
+	streamWindow    uint32
+	streamFragment  int
+	muxHalfClose    time.Duration
+	mailbox         *Mailbox
+	authTimeout     time.Duration
+	authFrames      int
+	proxyTrusted    []*net.IPNet
+	proxyTimeout    time.Duration
+	ipFilter        *IPFilter
+	recorder        *Recorder
+	dispatchMode    DispatchMode
+	dispatchWorkers int
+	dispatchQueue   int
+	reactorLoops    int
 }
 
 type Option func(o *Options)
 
 func defaultOptions() *Options {
 	return &Options{
-		logger:    newLogger(),
-		tlsConf:   nil,
-		heartbeat: 0,
+		logger:          newLogger(),
+		tlsConf:         nil,
+		heartbeat:       0,
+		streamWindow:    DefaultStreamWindow,
+		streamFragment:  DefaultStreamFragment,
+		muxHalfClose:    DefaultMuxHalfCloseTimeout,
+		authTimeout:     DefaultAuthTimeout,
+		authFrames:      DefaultAuthFrames,
+		proxyTimeout:    DefaultProxyHeaderTimeout,
+		dispatchMode:    DispatchSerial,
+		dispatchWorkers: DefaultDispatchWorkers,
+		dispatchQueue:   DefaultDispatchQueue,
 	}
 }
 
@@ -39,3 +64,116 @@ func WithLogger(log Logger) Option {
 		SetLogger(log)
 	}
 }
+
+// WithStreamWindow sets how many unread bytes a receiver buffers per stream
+func WithStreamWindow(n uint32) Option {
+	return func(o *Options) {
+		if n > 0 {
+			o.streamWindow = n
+		}
+	}
+}
+
+// WithStreamFragment sets the max payload size of a stream fragment frame
+func WithStreamFragment(n int) Option {
+	return func(o *Options) {
+		if n > 0 {
+			o.streamFragment = n
+		}
+	}
+}
+
+// WithMuxHalfCloseTimeout sets how long a closed mux stream waits for the peer to close its side
+// before it is reset and forgotten
+func WithMuxHalfCloseTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		if d > 0 {
+			o.muxHalfClose = d
+		}
+	}
+}
+
+// WithMailbox enables store-and-forward delivery for offline users on the server
+func WithMailbox(mb *Mailbox) Option {
+	return func(o *Options) {
+		o.mailbox = mb
+	}
+}
+
+// WithAuthTimeout sets how long a connection may take to pass the OnAuth handshake
+func WithAuthTimeout(t time.Duration) Option {
+	return func(o *Options) {
+		if t > 0 {
+			o.authTimeout = t
+		}
+	}
+}
+
+// WithAuthFrames sets how many handshake frames a connection may send before a rejection closes it
+func WithAuthFrames(n int) Option {
+	return func(o *Options) {
+		if n > 0 {
+			o.authFrames = n
+		}
+	}
+}
+
+// WithProxyProtocol makes the server read a PROXY protocol v1/v2 header from connections accepted
+// from the trusted upstreams, given as CIDRs or bare IPs. GetClientIP then reports the real client
+func WithProxyProtocol(trusted ...string) Option {
+	return func(o *Options) {
+		o.proxyTrusted = append(o.proxyTrusted, parseTrusted(trusted)...)
+	}
+}
+
+// WithProxyHeaderTimeout sets how long a trusted upstream may take to send the PROXY protocol header
+func WithProxyHeaderTimeout(t time.Duration) Option {
+	return func(o *Options) {
+		if t > 0 {
+			o.proxyTimeout = t
+		}
+	}
+}
+
+// WithIPFilter checks client IPs with the filter at accept time, the real client IP is used
+// behind a trusted proxy. The filter's file watch stops with the server
+func WithIPFilter(f *IPFilter) Option {
+	return func(o *Options) {
+		o.ipFilter = f
+	}
+}
+
+// WithRecorder captures every message the server receives and sends, Stop flushes the capture
+func WithRecorder(r *Recorder) Option {
+	return func(o *Options) {
+		o.recorder = r
+	}
+}
+
+// WithDispatch sets how messages are handed to OnMessage. workers is the pool size of DispatchPool and
+// the limit of handlers running at once of DispatchConcurrent, 0 leaves it unbounded. queue is the
+// per connection inbox of every mode and the per worker queue of DispatchPool. Zero values keep the defaults
+func WithDispatch(mode DispatchMode, workers, queue int) Option {
+	return func(o *Options) {
+		o.dispatchMode = mode
+		if workers > 0 || mode == DispatchConcurrent {
+			o.dispatchWorkers = workers
+		}
+		if queue > 0 {
+			o.dispatchQueue = queue
+		}
+	}
+}
+
+// WithReactor serves the connections with a few epoll event loops instead of three goroutines each,
+// loops <= 0 runs one per CPU. Frames are read only when the socket is readable and sends are written
+// straight to it, so a serial OnMessage runs in the event loop and must not block, use DispatchPool for
+// slow handlers. Streams and Mux are not available. It is linux only, other platforms keep the goroutines
+func WithReactor(loops int) Option {
+	return func(o *Options) {
+		if loops <= 0 {
+			loops = runtime.NumCPU()
+		}
+		o.reactorLoops = loops
+	}
+}
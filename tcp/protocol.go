@@ -10,6 +10,9 @@ import (
 // Won't compile if Protocol can't be realized by a DefaultProtocol
 var _ Protocol = &DefaultProtocol{}
 
+// ErrChecksum occurs when the checksum of a received message does not match its content
+var ErrChecksum = errors.New("checksum error")
+
 type Protocol interface {
 	// Pack packs Message into the packet to be written
 	Pack(msg *Message) ([]byte, error)
@@ -82,7 +85,7 @@ func (p *DefaultProtocol) Unpack(reader io.Reader) (msg *Message, err error) {
 	}
 
 	if !msg.Checksum() {
-		return nil, errors.New("checksum error")
+		return nil, ErrChecksum
 	}
 
 	return
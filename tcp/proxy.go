@@ -0,0 +1,174 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrProxyHeader occurs when a trusted upstream sends a missing or malformed PROXY protocol header
+	ErrProxyHeader = errors.New("invalid proxy protocol header")
+)
+
+const (
+	// DefaultProxyHeaderTimeout is how long a trusted upstream may take to send the PROXY protocol header
+	DefaultProxyHeaderTimeout = 5 * time.Second
+
+	// proxyV1MaxLen is the longest v1 header allowed by the spec, CRLF included
+	proxyV1MaxLen = 107
+)
+
+// proxyV2Sig starts every PROXY protocol v2 header
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection accepted from a trusted upstream, it reports the client address
+// of the PROXY protocol header and replays the bytes read past the header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// parseTrusted parses the trusted upstreams of WithProxyProtocol
+func parseTrusted(list []string) []*net.IPNet {
+	nets, err := parseNets(list)
+	if err != nil {
+		panic(fmt.Sprintf("invalid trusted proxy: %v", err))
+	}
+	return nets
+}
+
+// trustedProxy reports whether addr belongs to one of the trusted upstreams
+func (s *Server) trustedProxy(addr net.Addr) bool {
+	return containsIP(s.opt.proxyTrusted, addrIP(addr))
+}
+
+// acceptProxy reads the PROXY protocol header of a connection from a trusted upstream,
+// connections from anywhere else are returned untouched so they cannot spoof their address
+func (s *Server) acceptProxy(conn net.Conn) (net.Conn, error) {
+	if len(s.opt.proxyTrusted) == 0 || !s.trustedProxy(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(s.opt.proxyTimeout))
+	r := bufio.NewReader(conn)
+	remote, err := ParseProxyHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// ParseProxyHeader reads a PROXY protocol v1 or v2 header and returns the client address it carries,
+// the address is nil for health checks of the balancer itself (v1 UNKNOWN, v2 LOCAL or a non TCP family)
+func ParseProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Sig))
+	if err == nil && bytes.Equal(sig, proxyV2Sig) {
+		return parseProxyV2(r)
+	}
+	if b, err := r.Peek(6); err != nil || string(b) != "PROXY " {
+		return nil, ErrProxyHeader
+	}
+	return parseProxyV1(r)
+}
+
+// parseProxyV1 parses the text header
+// PROXY TCP4|TCP6 <src ip> <dst ip> <src port> <dst port>\r\n or PROXY UNKNOWN ...\r\n
+func parseProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrProxyHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 parses the binary header
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ Signature │ []byte │ 12      ║
+// ║ VerCmd    │ uint8  │ 1       ║
+// ║ Family    │ uint8  │ 1       ║
+// ║ Length    │ uint16 │ 2       ║
+// ║ Addresses │ []byte │ Length  ║
+// ╚═══════════╧════════╧═════════╝
+// the length and ports are big endian, TLVs following the addresses are skipped
+func parseProxyV2(r *bufio.Reader) (net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, ErrProxyHeader
+	}
+	if head[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, ErrProxyHeader
+	}
+
+	switch head[12] & 0x0f {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, ErrProxyHeader
+	}
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, ErrProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func proxyV2Header(src *net.TCPAddr) []byte {
+	var addrs []byte
+	family := byte(0x11)
+	if ip := src.IP.To4(); ip != nil {
+		addrs = append(addrs, ip...)
+		addrs = append(addrs, 127, 0, 0, 1)
+	} else {
+		family = 0x21
+		addrs = append(addrs, src.IP.To16()...)
+		addrs = append(addrs, net.IPv6loopback...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, 9000)
+
+	b := append([]byte{}, proxyV2Sig...)
+	b = append(b, 0x21, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+func TestParseProxyHeader(t *testing.T) {
+	cases := []struct {
+		header string
+		addr   string
+		err    error
+	}{
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234 9000\r\n", "203.0.113.7:51234", nil},
+		{"PROXY TCP6 2001:db8::1 ::1 443 9000\r\n", "[2001:db8::1]:443", nil},
+		{"PROXY UNKNOWN\r\n", "", nil},
+		{"PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n", "", ErrProxyHeader},
+		{"PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n", "", ErrProxyHeader},
+		{"GET / HTTP/1.1\r\n", "", ErrProxyHeader},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("198.51.100.9"), Port: 4000})), "198.51.100.9:4000", nil},
+		{string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4001})), "[2001:db8::2]:4001", nil},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(bytes.NewReader(append([]byte(c.header), "payload"...)))
+		addr, err := ParseProxyHeader(r)
+		assert.Equal(t, c.err, err, c.header)
+		if c.addr == "" {
+			assert.Nil(t, addr, c.header)
+			continue
+		}
+		if assert.NotNil(t, addr, c.header) {
+			assert.Equal(t, c.addr, addr.String())
+		}
+		rest, _ := r.ReadString(0)
+		assert.Equal(t, "payload", rest)
+	}
+}
+
+func dialProxy(t *testing.T, s *Server, header []byte) net.Conn {
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := NewDefaultProtocol().Pack(NewMessage(Single, []byte("hello")))
+	_, err = conn.Write(append(header, b...))
+	assert.NoError(t, err)
+	return conn
+}
+
+func TestProxyProtocol(t *testing.T) {
+	addrs := make(chan net.Addr, 1)
+	closed := make(chan error, 1)
+	s := newTestServer(WithProxyProtocol("127.0.0.0/8"), WithProxyHeaderTimeout(200*time.Millisecond))
+	s.OnMessage(func(c *Conn, msg *Message) {
+		addrs <- c.GetClientIP()
+	})
+	s.OnClose(func(c *Conn, err error) {
+		closed <- err
+	})
+	startTestServer(t, s)
+
+	conn := dialProxy(t, s, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 9000\r\n"))
+	defer conn.Close()
+	select {
+	case addr := <-addrs:
+		assert.Equal(t, "203.0.113.7:51234", addr.String())
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	conn = dialProxy(t, s, proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4001}))
+	defer conn.Close()
+	select {
+	case addr := <-addrs:
+		assert.Equal(t, "[2001:db8::2]:4001", addr.String())
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	// a trusted upstream must send the header
+	conn = dialProxy(t, s, nil)
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Empty(t, addrs)
+	assert.Empty(t, closed)
+}
+
+func TestProxyProtocolUntrusted(t *testing.T) {
+	addrs := make(chan net.Addr, 1)
+	s := newTestServer(WithProxyProtocol("10.0.0.0/8", "192.0.2.1"))
+	s.OnMessage(func(c *Conn, msg *Message) {
+		addrs <- c.GetClientIP()
+	})
+	startTestServer(t, s)
+
+	// without trust the header is not read, so it cannot spoof the address
+	conn := dialProxy(t, s, nil)
+	defer conn.Close()
+	select {
+	case addr := <-addrs:
+		assert.Equal(t, conn.LocalAddr().String(), addr.String())
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	assert.Panics(t, func() {
+		NewServer("127.0.0.1:0", WithProxyProtocol("not a network"))
+	})
+}
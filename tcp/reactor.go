@@ -0,0 +1,330 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// ErrReactorUnsupported occurs when the reactor mode is asked for on a platform without epoll
+	ErrReactorUnsupported = errors.New("reactor mode is only supported on linux")
+	// ErrReactorStream occurs when streams or mux frames are used on a connection served by the reactor
+	ErrReactorStream = errors.New("streams are not available in reactor mode")
+)
+
+const (
+	// DefaultReactorWriteTimeout is how long a send may block on a peer that stopped reading in reactor mode
+	DefaultReactorWriteTimeout = 5 * time.Second
+	// reactorReadSize is the read buffer shared by the connections of an event loop
+	reactorReadSize = 64 << 10
+	// frameHeaderSize and frameOverhead describe the DefaultProtocol framing: size and cmd ahead of the data,
+	// the checksum after it
+	frameHeaderSize = 6
+	frameOverhead   = 10
+)
+
+// reactor spreads the connections over a few event loops reading them only when the socket is readable,
+// instead of running a read, a write and a process goroutine per connection
+type reactor struct {
+	loops []*eventLoop
+	next  uint32
+}
+
+// eventLoop polls a share of the connections, every frame of a connection is handled by its loop goroutine
+type eventLoop struct {
+	poller *poller
+	buf    []byte
+
+	mu       sync.Mutex
+	conns    map[int]*Conn
+	fresh    []*Conn
+	detached []*Conn
+	refs     int
+	stopping bool
+}
+
+func newReactor(n int) (*reactor, error) {
+	r := &reactor{}
+	for i := 0; i < n; i++ {
+		p, err := newPoller()
+		if err != nil {
+			for _, l := range r.loops {
+				l.poller.close()
+			}
+			return nil, err
+		}
+		r.loops = append(r.loops, &eventLoop{poller: p, buf: make([]byte, reactorReadSize), conns: make(map[int]*Conn)})
+	}
+	for _, l := range r.loops {
+		go l.run()
+	}
+	return r, nil
+}
+
+// serve registers a connection to an event loop, it returns false when the connection cannot be polled
+func (r *reactor) serve(c *Conn) bool {
+	raw, pending, ok := pollable(c.conn)
+	if !ok {
+		return false
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return false
+	}
+	l := r.loops[atomic.AddUint32(&r.next, 1)%uint32(len(r.loops))]
+	if !l.acquire() {
+		return false
+	}
+
+	c.loop, c.raw, c.fd, c.pending = l, raw, fd, pending
+	c.open()
+	if c.srv.onAuth == nil {
+		c.setAuthed()
+	} else {
+		c.authTimer = time.AfterFunc(c.srv.opt.authTimeout, func() {
+			if !c.IsAuthed() {
+				c.CloseWithReason(CloseAuthTimeout, ErrAuthTimeout.Error())
+			}
+		})
+	}
+	c.srv.onConnect(c)
+	l.add(c)
+
+	// a connection accepted while the server stops may have missed Stop
+	select {
+	case <-c.srv.exitCh:
+		c.CloseWithReason(CloseShutdown, "server shutdown")
+	default:
+	}
+	return true
+}
+
+// stop ends the event loops once their connections are closed
+func (r *reactor) stop() {
+	for _, l := range r.loops {
+		l.mu.Lock()
+		l.stopping = true
+		l.mu.Unlock()
+		l.poller.wake()
+	}
+}
+
+// pollable gets the socket of a connection, the bytes a PROXY protocol reader buffered past the header
+// are handed back so they are not lost. TLS connections cannot be polled
+func pollable(conn net.Conn) (syscall.RawConn, []byte, bool) {
+	var pending []byte
+	if pc, ok := conn.(*proxyConn); ok {
+		if n := pc.r.Buffered(); n > 0 {
+			b, _ := pc.r.Peek(n)
+			pending = append(pending, b...)
+		}
+		conn = pc.Conn
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, nil, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, nil, false
+	}
+	return raw, pending, true
+}
+
+// acquire counts a connection of the loop, it returns false once the loop is stopping
+func (l *eventLoop) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopping {
+		return false
+	}
+	l.refs++
+	return true
+}
+
+// add starts polling a connection
+func (l *eventLoop) add(c *Conn) {
+	l.mu.Lock()
+	select {
+	case <-c.done:
+		// closed by OnConnect, it is already queued for reaping
+		l.mu.Unlock()
+		return
+	default:
+	}
+	l.conns[c.fd] = c
+	fresh := len(c.pending) > 0
+	if fresh {
+		l.fresh = append(l.fresh, c)
+	}
+	l.mu.Unlock()
+
+	var err error
+	if cerr := c.raw.Control(func(fd uintptr) { err = l.poller.add(int(fd)) }); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		c.shutdown(&CloseError{Code: CloseAbnormal, Err: err})
+		return
+	}
+	if fresh {
+		l.poller.wake()
+	}
+}
+
+// unwatch stops polling a connection, it runs before the socket is closed so its descriptor
+// cannot be reused in the meantime
+func (l *eventLoop) unwatch(c *Conn) {
+	_ = c.raw.Control(func(fd uintptr) { _ = l.poller.remove(int(fd)) })
+}
+
+// detach queues a closed connection for reaping
+func (l *eventLoop) detach(c *Conn) {
+	l.mu.Lock()
+	l.detached = append(l.detached, c)
+	l.mu.Unlock()
+	l.poller.wake()
+}
+
+// run reads the readable connections until the loop is stopped and every connection is reaped
+func (l *eventLoop) run() {
+	defer l.poller.close()
+	var ready []int
+	for {
+		var err error
+		ready, err = l.poller.wait(ready[:0])
+		if err != nil {
+			Flog.Errorf("reactor wait err: %v", err)
+			return
+		}
+
+		l.mu.Lock()
+		fresh := l.fresh
+		l.fresh = nil
+		l.mu.Unlock()
+		for _, c := range fresh {
+			c.feed(nil)
+		}
+
+		for _, fd := range ready {
+			l.mu.Lock()
+			c := l.conns[fd]
+			l.mu.Unlock()
+			if c != nil {
+				l.read(c)
+			}
+		}
+
+		if !l.reap() {
+			return
+		}
+	}
+}
+
+// read reads what the socket holds and handles the complete frames
+func (l *eventLoop) read(c *Conn) {
+	var n int
+	var again bool
+	var err error
+	if cerr := c.raw.Control(func(fd uintptr) { n, again, err = readFd(int(fd), l.buf) }); cerr != nil || again {
+		return
+	}
+	if err != nil {
+		c.readFailed(&net.OpError{Op: "read", Net: "tcp", Addr: c.clientIP, Err: os.NewSyscallError("read", err)})
+		return
+	}
+	if n == 0 {
+		c.readFailed(io.EOF)
+		return
+	}
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	c.feed(l.buf[:n])
+}
+
+// reap hands the connections closed since the last round over to finish. The loop no longer touches them,
+// so their handlers are all accounted for. It reports false once the loop is stopping and empty
+func (l *eventLoop) reap() bool {
+	l.mu.Lock()
+	list := l.detached
+	l.detached = nil
+	for _, c := range list {
+		if l.conns[c.fd] == c {
+			delete(l.conns, c.fd)
+		}
+	}
+	l.refs -= len(list)
+	done := l.stopping && l.refs == 0
+	l.mu.Unlock()
+
+	for _, c := range list {
+		go func(c *Conn) {
+			c.finish()
+			c.srv.dispatch.release()
+		}(c)
+	}
+	return !done
+}
+
+// feed handles the complete frames of data and keeps the partial one until the next read,
+// the buffer is only allocated while a frame is split across reads
+func (c *Conn) feed(data []byte) {
+	if len(c.pending) > 0 {
+		data = append(c.pending, data...)
+	}
+	for len(data) >= frameHeaderSize && !c.closing() {
+		size := frameOverhead + int(binary.LittleEndian.Uint32(data))
+		if len(data) < size {
+			break
+		}
+		msg, err := c.protocol.Unpack(bytes.NewReader(data[:size]))
+		data = data[size:]
+		if err != nil {
+			c.readFailed(err)
+			return
+		}
+		c.frame(msg)
+	}
+	if len(data) == 0 || c.closing() {
+		c.pending = nil
+		return
+	}
+	c.pending = append([]byte(nil), data...)
+}
+
+// frame routes a frame read by the event loop like readLoop does
+func (c *Conn) frame(msg *Message) {
+	c.record(Inbound, msg)
+	switch {
+	case msg.GetCmd() == Close:
+		c.Lock()
+		c.peerReason = unpackClose(msg)
+		c.Unlock()
+	case !c.IsAuthed():
+		c.authenticate(msg)
+	case isStreamCmd(msg.GetCmd()) || msg.GetCmd() == MuxFrame:
+		c.closeWith(&CloseError{Code: CloseProtocolError, Text: ErrReactorStream.Error(), Err: ErrReactorStream})
+		return
+	default:
+		c.srv.dispatch.submit(c, msg)
+	}
+	c.sess.UpdateTime()
+}
+
+// write sends a message straight to the socket in reactor mode
+func (c *Conn) write(msg *Message) {
+	if c.closing() {
+		return
+	}
+	_ = c.conn.SetWriteDeadline(time.Now().Add(DefaultReactorWriteTimeout))
+	if err := c.writeMessage(msg); err != nil {
+		Flog.Errorf("send message err: %v", err)
+	}
+}
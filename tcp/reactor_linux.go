@@ -0,0 +1,88 @@
+//go:build linux
+
+package network
+
+import "syscall"
+
+// poller waits for readable sockets with epoll, a pipe wakes it up
+type poller struct {
+	epfd   int
+	wakeR  int
+	wakeW  int
+	events []syscall.EpollEvent
+}
+
+func newPoller() (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	var pipe [2]int
+	if err = syscall.Pipe2(pipe[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	p := &poller{epfd: epfd, wakeR: pipe[0], wakeW: pipe[1], events: make([]syscall.EpollEvent, 256)}
+	if err = p.add(p.wakeR); err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *poller) add(fd int) error {
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)})
+}
+
+func (p *poller) remove(fd int) error {
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{})
+}
+
+// wait blocks until sockets are readable or the poller is woken up, the readable ones are appended to ready
+func (p *poller) wait(ready []int) ([]int, error) {
+	for {
+		n, err := syscall.EpollWait(p.epfd, p.events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return ready, err
+		}
+		for _, ev := range p.events[:n] {
+			fd := int(ev.Fd)
+			if fd != p.wakeR {
+				ready = append(ready, fd)
+				continue
+			}
+			var buf [64]byte
+			for {
+				if _, err := syscall.Read(p.wakeR, buf[:]); err != nil {
+					break
+				}
+			}
+		}
+		return ready, nil
+	}
+}
+
+func (p *poller) wake() {
+	_, _ = syscall.Write(p.wakeW, []byte{1})
+}
+
+func (p *poller) close() {
+	syscall.Close(p.wakeW)
+	syscall.Close(p.wakeR)
+	syscall.Close(p.epfd)
+}
+
+// readFd reads a non blocking socket, again reports there was nothing to read
+func readFd(fd int, b []byte) (n int, again bool, err error) {
+	n, err = syscall.Read(fd, b)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return 0, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return n, false, nil
+}
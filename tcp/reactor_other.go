@@ -0,0 +1,30 @@
+//go:build !linux
+
+package network
+
+// poller is only implemented with epoll
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, ErrReactorUnsupported
+}
+
+func (p *poller) add(fd int) error {
+	return ErrReactorUnsupported
+}
+
+func (p *poller) remove(fd int) error {
+	return ErrReactorUnsupported
+}
+
+func (p *poller) wait(ready []int) ([]int, error) {
+	return ready, ErrReactorUnsupported
+}
+
+func (p *poller) wake() {}
+
+func (p *poller) close() {}
+
+func readFd(fd int, b []byte) (n int, again bool, err error) {
+	return 0, false, ErrReactorUnsupported
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReactorEcho(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer(WithReactor(2))
+	s.OnMessage(func(c *Conn, msg *Message) {
+		c.SendMessage(msg)
+	})
+	cc := newCloseCounter(s)
+	startTestServer(t, s)
+
+	// frames larger than the read buffer are split across reads
+	large := make([]byte, 3*reactorReadSize+17)
+	_, _ = rand.Read(large)
+	const clients = 20
+	echoes := make(chan *Message, 4*clients)
+	list := make([]*Client, clients)
+	for i := range list {
+		list[i] = newTestClient(t, s)
+		list[i].OnMessage(func(c *Client, msg *Message) {
+			echoes <- msg
+		})
+		list[i].SendBytes(Single, []byte("a"))
+		list[i].SendBytes(Single, large)
+		list[i].SendBytes(Single, []byte("b"))
+	}
+	got := map[string]int{}
+	for i := 0; i < 3*clients; i++ {
+		select {
+		case msg := <-echoes:
+			if bytes.Equal(msg.GetData(), large) {
+				got["large"]++
+			} else {
+				got[string(msg.GetData())]++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("echo not received")
+		}
+	}
+	assert.Equal(t, map[string]int{"a": clients, "large": clients, "b": clients}, got)
+
+	// no goroutine per connection
+	for _, stack := range goroutines() {
+		assert.False(t, strings.Contains(stack, "readLoop") && strings.Contains(stack, "(*Conn)"))
+	}
+	for _, c := range list {
+		c.Close()
+		assert.Equal(t, CloseNormal, CloseCodeOf(cc.wait(t)))
+	}
+	cc.once(t)
+}
+
+func TestReactorAuthAndStop(t *testing.T) {
+	checkLeaks(t)
+	secret := []byte("secret")
+	s := newTestServer(WithReactor(1), WithAuthTimeout(200*time.Millisecond), WithDispatch(DispatchPool, 2, 0))
+	s.OnAuth(JWTAuth(secret, "sub"))
+	messages := make(chan string, 4)
+	s.OnMessage(func(c *Conn, msg *Message) {
+		messages <- c.GetSession().GetUserID()
+	})
+	cc := newCloseCounter(s)
+	startTestServer(t, s)
+
+	c := newTestClient(t, s)
+	token, _ := SignJWT(secret, map[string]interface{}{"sub": "alice"})
+	assert.NoError(t, c.Authenticate([]byte(token), time.Second))
+	c.SendBytes(Single, []byte("hello"))
+	select {
+	case uid := <-messages:
+		assert.Equal(t, "alice", uid)
+	case <-time.After(time.Second):
+		t.Fatal("message not routed")
+	}
+
+	silent := newTestClient(t, s)
+	defer silent.Close()
+	assert.ErrorIs(t, cc.wait(t), ErrAuthTimeout)
+
+	// streams need the goroutine mode
+	var conn *Conn
+	s.sessions.Range(func(key, value interface{}) bool {
+		conn = value.(*Session).GetConn()
+		return false
+	})
+	assert.Nil(t, conn.Mux())
+	assert.Equal(t, ErrReactorStream, conn.SendStream(bytes.NewReader(nil)))
+
+	s.Stop()
+	err := cc.wait(t)
+	assert.ErrorIs(t, err, ErrServerClosed)
+	assert.Equal(t, CloseShutdown, CloseCodeOf(err))
+}
+
+func TestReactorProxyProtocol(t *testing.T) {
+	checkLeaks(t)
+	addrs := make(chan string, 1)
+	s := newTestServer(WithReactor(1), WithProxyProtocol("127.0.0.0/8"))
+	s.OnMessage(func(c *Conn, msg *Message) {
+		addrs <- c.GetClientIP().String() + " " + string(msg.GetData())
+	})
+	startTestServer(t, s)
+
+	// the frame sent along with the header is buffered by the header reader
+	conn := dialProxy(t, s, []byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 9000\r\n"))
+	defer conn.Close()
+	select {
+	case got := <-addrs:
+		assert.Equal(t, "203.0.113.7:51234 hello", got)
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestReactorProtocolError(t *testing.T) {
+	checkLeaks(t)
+	s := newTestServer(WithReactor(1))
+	cc := newCloseCounter(s)
+	c := newTestClient(t, s)
+	defer c.Close()
+
+	msg := NewMessage(Single, []byte("hello"))
+	msg.checksum++
+	c.SendMessage(msg)
+	err := cc.wait(t)
+	assert.ErrorIs(t, err, ErrChecksum)
+	assert.Equal(t, CloseProtocolError, CloseCodeOf(err))
+}
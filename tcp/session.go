@@ -1,8 +1,11 @@
 package network
 
 import (
-	"github.com/google/uuid"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 // Session struct
@@ -12,6 +15,7 @@ type Session struct {
 	conn     *Conn
 	lastTime int64
 	extraMap map[string]interface{}
+	mu       sync.RWMutex
 }
 
 // NewSession create a new session
@@ -33,13 +37,26 @@ func (s *Session) GetSessionID() string {
 	return s.sid
 }
 
-// BindUserID bind a user ID to session
+// BindUserID bind a user ID to session, the session can then be reached with Server.SendUser
 func (s *Session) BindUserID(uid string) {
+	s.mu.Lock()
+	old := s.uid
 	s.uid = uid
+	s.mu.Unlock()
+
+	if old != uid && s.conn != nil && s.conn.srv != nil {
+		s.conn.srv.users.bind(s, old, uid)
+		s.conn.srv.sessionChanged(s)
+		if mb := s.conn.srv.opt.mailbox; mb != nil && uid != "" {
+			go mb.flush(uid)
+		}
+	}
 }
 
 // GetUserID get user ID
 func (s *Session) GetUserID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.uid
 }
 
@@ -55,11 +72,18 @@ func (s *Session) SetConn(conn *Conn) {
 
 // UpdateTime update the message last time
 func (s *Session) UpdateTime() {
-	s.lastTime = time.Now().Unix()
+	atomic.StoreInt64(&s.lastTime, time.Now().Unix())
+}
+
+// GetLastTime get the unix time of the last received message
+func (s *Session) GetLastTime() int64 {
+	return atomic.LoadInt64(&s.lastTime)
 }
 
 // GetExtraMap get the extra data
 func (s *Session) GetExtraMap(key string) interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if v, ok := s.extraMap[key]; ok {
 		return v
 	}
@@ -69,5 +93,49 @@ func (s *Session) GetExtraMap(key string) interface{} {
 
 // SetExtraMap set the extra data
 func (s *Session) SetExtraMap(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.extraMap[key] = value
 }
+
+// userIndex indexes the local sessions by bound user ID, a user may hold several sessions
+type userIndex struct {
+	sync.RWMutex
+	users map[string]map[string]*Session
+}
+
+func newUserIndex() *userIndex {
+	return &userIndex{users: make(map[string]map[string]*Session)}
+}
+
+// bind moves the session from the old user ID to the new one, an empty ID unbinds
+func (u *userIndex) bind(s *Session, old, uid string) {
+	u.Lock()
+	defer u.Unlock()
+	if sessions, ok := u.users[old]; ok && old != "" {
+		delete(sessions, s.sid)
+		if len(sessions) == 0 {
+			delete(u.users, old)
+		}
+	}
+	if uid == "" {
+		return
+	}
+	sessions, ok := u.users[uid]
+	if !ok {
+		sessions = make(map[string]*Session)
+		u.users[uid] = sessions
+	}
+	sessions[s.sid] = s
+}
+
+// sessions get the sessions bound to the user ID
+func (u *userIndex) sessions(uid string) []*Session {
+	u.RLock()
+	defer u.RUnlock()
+	list := make([]*Session, 0, len(u.users[uid]))
+	for _, s := range u.users[uid] {
+		list = append(list, s)
+	}
+	return list
+}
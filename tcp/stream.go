@@ -0,0 +1,392 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrStreamReset occurs when the peer aborts the stream
+	ErrStreamReset = errors.New("stream reset by peer")
+	// ErrStreamClosed occurs when the connection carrying the stream is closed
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrStreamWindow occurs when the peer sends more data than the stream window allows
+	ErrStreamWindow = errors.New("stream window exceeded")
+)
+
+const (
+	// DefaultStreamWindow is the number of unread bytes a receiver buffers per stream
+	DefaultStreamWindow = 256 << 10
+	// DefaultStreamFragment is the max payload size of a single fragment frame
+	DefaultStreamFragment = 16 << 10
+
+	streamHeaderSize = 5
+
+	streamFlagOpen  byte = 1 << 0
+	streamFlagFin   byte = 1 << 1
+	streamFlagReset byte = 1 << 2
+)
+
+// streamFrame builds a StreamData message
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ StreamID  │ uint32 │ 4       ║
+// ║ Flags     │ uint8  │ 1       ║
+// ║ Payload   │ []byte │ dynamic ║
+// ╚═══════════╧════════╧═════════╝
+func streamFrame(id uint32, flags byte, payload []byte) *Message {
+	b := make([]byte, streamHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(b, id)
+	b[4] = flags
+	copy(b[streamHeaderSize:], payload)
+	return NewMessage(StreamData, b)
+}
+
+// windowFrame builds a StreamWindow message granting n more bytes to the sender
+func windowFrame(id uint32, n uint32) *Message {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, id)
+	binary.LittleEndian.PutUint32(b[4:], n)
+	return NewMessage(StreamWindow, b)
+}
+
+// resetFrame builds a StreamReset message asking the sender to abort
+func resetFrame(id uint32) *Message {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, id)
+	return NewMessage(StreamReset, b)
+}
+
+// isStreamCmd reports whether the cmd belongs to the stream layer
+func isStreamCmd(cmd CMD) bool {
+	return cmd == StreamData || cmd == StreamWindow || cmd == StreamReset
+}
+
+// Stream is the receiving side of a chunked payload sent by the peer
+type Stream struct {
+	id       uint32
+	m        *streamManager
+	mu       sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	window   uint32
+	consumed uint32
+	err      error
+	closed   bool
+}
+
+// ID get the stream ID
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// Read reads the next payload bytes, it returns io.EOF once the sender finished the stream
+func (s *Stream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for s.buf.Len() == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.buf.Len() == 0 {
+		err := s.err
+		s.mu.Unlock()
+		return 0, err
+	}
+
+	n, _ := s.buf.Read(p)
+	s.consumed += uint32(n)
+	var credit uint32
+	if s.err == nil && s.consumed >= s.m.window/2 {
+		credit = s.consumed
+		s.window += credit
+		s.consumed = 0
+	}
+	s.mu.Unlock()
+
+	if credit > 0 {
+		s.m.ctrl(windowFrame(s.id, credit))
+	}
+	return n, nil
+}
+
+// Close stops receiving, the sender is asked to abort if the stream is not finished yet
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	finished := s.err != nil
+	s.err = ErrStreamClosed
+	s.buf.Reset()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.m.removeIncoming(s.id)
+	if !finished {
+		s.m.ctrl(resetFrame(s.id))
+	}
+	return nil
+}
+
+// push appends a fragment received from the peer
+func (s *Stream) push(flags byte, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.err != nil {
+		return
+	}
+
+	if uint32(len(payload)) > s.window {
+		s.err = ErrStreamWindow
+		s.cond.Broadcast()
+		go s.m.ctrl(resetFrame(s.id))
+		return
+	}
+	s.window -= uint32(len(payload))
+	s.buf.Write(payload)
+
+	switch {
+	case flags&streamFlagReset != 0:
+		s.err = ErrStreamReset
+		s.buf.Reset()
+	case flags&streamFlagFin != 0:
+		s.err = io.EOF
+	}
+	s.cond.Broadcast()
+}
+
+// abort terminates the stream when the connection goes away
+func (s *Stream) abort(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+// streamWriter tracks the send window of an outgoing stream
+type streamWriter struct {
+	id     uint32
+	window uint32
+	err    error
+	cond   *sync.Cond
+}
+
+// streamManager multiplexes the streams of one connection
+type streamManager struct {
+	sync.Mutex
+	nextID   uint32
+	window   uint32
+	fragment int
+	incoming map[uint32]*Stream
+	outgoing map[uint32]*streamWriter
+	ctrlCh   chan<- *Message
+	dataCh   chan<- *Message
+	done     chan struct{}
+	err      error
+	onStream func(s *Stream)
+}
+
+// newStreamManager control frames are queued on ctrlCh, fragments on dataCh,
+// so the write loop can give regular messages priority over stream data
+func newStreamManager(opt *Options, ctrlCh, dataCh chan<- *Message, onStream func(s *Stream)) *streamManager {
+	return &streamManager{
+		window:   opt.streamWindow,
+		fragment: opt.streamFragment,
+		incoming: make(map[uint32]*Stream),
+		outgoing: make(map[uint32]*streamWriter),
+		ctrlCh:   ctrlCh,
+		dataCh:   dataCh,
+		done:     make(chan struct{}),
+		onStream: onStream,
+	}
+}
+
+// ctrl queues a control frame, it gives up once the connection is closed
+func (m *streamManager) ctrl(msg *Message) {
+	select {
+	case m.ctrlCh <- msg:
+	case <-m.done:
+	}
+}
+
+// data queues a fragment frame, it gives up once the connection is closed
+func (m *streamManager) data(msg *Message) error {
+	select {
+	case m.dataCh <- msg:
+		return nil
+	case <-m.done:
+		return ErrStreamClosed
+	}
+}
+
+// handle dispatches a stream frame read from the connection
+func (m *streamManager) handle(msg *Message) {
+	data := msg.GetData()
+	if len(data) < 4 {
+		return
+	}
+	id := binary.LittleEndian.Uint32(data)
+
+	switch msg.GetCmd() {
+	case StreamData:
+		if len(data) < streamHeaderSize {
+			return
+		}
+		flags := data[4]
+		m.Lock()
+		s, ok := m.incoming[id]
+		opened := false
+		if !ok && flags&streamFlagOpen != 0 {
+			select {
+			case <-m.done:
+				m.Unlock()
+				return
+			default:
+			}
+			s = &Stream{id: id, m: m, window: m.window}
+			s.cond = sync.NewCond(&s.mu)
+			m.incoming[id] = s
+			opened = true
+			go m.onStream(s)
+		}
+		if s != nil && flags&(streamFlagFin|streamFlagReset) != 0 {
+			delete(m.incoming, id)
+		}
+		m.Unlock()
+		// the sender starts without credit, the receiver grants its own window
+		if opened && flags&(streamFlagFin|streamFlagReset) == 0 {
+			m.ctrl(windowFrame(id, m.window))
+		}
+		if s != nil {
+			s.push(flags, data[streamHeaderSize:])
+		}
+	case StreamWindow:
+		if len(data) < 8 {
+			return
+		}
+		m.Lock()
+		if w, ok := m.outgoing[id]; ok {
+			w.window += binary.LittleEndian.Uint32(data[4:])
+			w.cond.Broadcast()
+		}
+		m.Unlock()
+	case StreamReset:
+		m.Lock()
+		if w, ok := m.outgoing[id]; ok {
+			w.err = ErrStreamReset
+			w.cond.Broadcast()
+		}
+		m.Unlock()
+	}
+}
+
+// removeIncoming forgets a stream closed by the local reader
+func (m *streamManager) removeIncoming(id uint32) {
+	m.Lock()
+	delete(m.incoming, id)
+	m.Unlock()
+}
+
+// acquire waits until the writer may send at least one byte
+func (m *streamManager) acquire(w *streamWriter) (int, error) {
+	m.Lock()
+	defer m.Unlock()
+	for w.window == 0 && w.err == nil {
+		w.cond.Wait()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := m.fragment
+	if uint32(n) > w.window {
+		n = int(w.window)
+	}
+	return n, nil
+}
+
+// send reads r until EOF and emits it as fragment frames of a new stream
+func (m *streamManager) send(r io.Reader) error {
+	m.Lock()
+	if m.err != nil {
+		m.Unlock()
+		return m.err
+	}
+	m.nextID++
+	// no credit until the receiver grants its window in reply to the open frame
+	w := &streamWriter{id: m.nextID, cond: sync.NewCond(m)}
+	m.outgoing[w.id] = w
+	m.Unlock()
+
+	defer func() {
+		m.Lock()
+		delete(m.outgoing, w.id)
+		m.Unlock()
+	}()
+
+	if err := m.data(streamFrame(w.id, streamFlagOpen, nil)); err != nil {
+		return err
+	}
+	buf := make([]byte, m.fragment)
+	var flags byte
+	for {
+		size, err := m.acquire(w)
+		if err != nil {
+			if err != ErrStreamReset {
+				_ = m.data(streamFrame(w.id, streamFlagReset, nil))
+			}
+			return err
+		}
+
+		n, rerr := r.Read(buf[:size])
+		if rerr != nil && rerr != io.EOF {
+			_ = m.data(streamFrame(w.id, flags|streamFlagReset, nil))
+			return rerr
+		}
+		if rerr == io.EOF {
+			flags |= streamFlagFin
+		}
+		if n == 0 && flags&streamFlagFin == 0 {
+			continue
+		}
+
+		m.Lock()
+		w.window -= uint32(n)
+		m.Unlock()
+		if err = m.data(streamFrame(w.id, flags, buf[:n])); err != nil {
+			return err
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		flags = 0
+	}
+}
+
+// close aborts every stream of the connection
+func (m *streamManager) close(err error) {
+	m.Lock()
+	if m.err != nil {
+		m.Unlock()
+		return
+	}
+	m.err = err
+	close(m.done)
+	incoming := m.incoming
+	m.incoming = make(map[uint32]*Stream)
+	for _, w := range m.outgoing {
+		w.err = err
+		w.cond.Broadcast()
+	}
+	m.Unlock()
+
+	for _, s := range incoming {
+		s.abort(err)
+	}
+}
@@ -0,0 +1,173 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(opts ...Option) *Server {
+	return NewServer("127.0.0.1:0", opts...)
+}
+
+func startTestServer(t *testing.T, s *Server) {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.StartWithListener(l)
+	t.Cleanup(s.Stop)
+}
+
+func newTestClient(t *testing.T, s *Server, opts ...Option) *Client {
+	if s.Addr() == nil {
+		startTestServer(t, s)
+	}
+	c := NewClient(s.Addr().String(), opts...)
+	if err := c.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestStreamClientToServer(t *testing.T) {
+	payload := make([]byte, 3<<20)
+	_, _ = rand.Read(payload)
+
+	received := make(chan []byte, 1)
+	s := newTestServer(WithStreamWindow(64<<10), WithStreamFragment(8<<10))
+	s.OnStream(func(c *Conn, st *Stream) {
+		b, err := io.ReadAll(st)
+		assert.NoError(t, err)
+		received <- b
+	})
+
+	c := newTestClient(t, s, WithStreamWindow(64<<10), WithStreamFragment(8<<10))
+	defer c.Close()
+
+	assert.NoError(t, c.SendStream(bytes.NewReader(payload)))
+	select {
+	case b := <-received:
+		assert.True(t, bytes.Equal(payload, b))
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not received")
+	}
+}
+
+func TestStreamDifferentWindows(t *testing.T) {
+	payload := make([]byte, 1<<20)
+	_, _ = rand.Read(payload)
+
+	received := make(chan []byte, 1)
+	// the sender's own window is far larger than what the receiver buffers
+	s := newTestServer(WithStreamWindow(16<<10), WithStreamFragment(4<<10))
+	s.OnStream(func(c *Conn, st *Stream) {
+		b, err := io.ReadAll(st)
+		assert.NoError(t, err)
+		received <- b
+	})
+
+	c := newTestClient(t, s, WithStreamWindow(1<<20), WithStreamFragment(4<<10))
+	defer c.Close()
+
+	assert.NoError(t, c.SendStream(bytes.NewReader(payload)))
+	select {
+	case b := <-received:
+		assert.True(t, bytes.Equal(payload, b))
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not received")
+	}
+}
+
+func TestStreamInterleavesMessages(t *testing.T) {
+	release := make(chan struct{})
+	s := newTestServer(WithStreamWindow(32 << 10))
+	s.OnStream(func(c *Conn, st *Stream) {
+		// hold the window closed until the small message got through
+		<-release
+		_, _ = io.Copy(io.Discard, st)
+	})
+	s.OnMessage(func(c *Conn, msg *Message) {
+		c.SendMessage(msg)
+	})
+
+	c := newTestClient(t, s, WithStreamWindow(32<<10))
+	defer c.Close()
+	echo := make(chan *Message, 1)
+	c.OnMessage(func(c *Client, msg *Message) {
+		echo <- msg
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SendStream(bytes.NewReader(make([]byte, 1<<20)))
+	}()
+
+	c.SendBytes(Single, []byte("ping"))
+	select {
+	case msg := <-echo:
+		assert.Equal(t, "ping", string(msg.GetData()))
+	case <-time.After(5 * time.Second):
+		t.Fatal("message blocked by stream")
+	}
+
+	close(release)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not finished")
+	}
+}
+
+func TestStreamReaderClose(t *testing.T) {
+	s := newTestServer()
+	s.OnStream(func(c *Conn, st *Stream) {
+		buf := make([]byte, 10)
+		_, _ = io.ReadFull(st, buf)
+		st.Close()
+	})
+
+	c := newTestClient(t, s)
+	defer c.Close()
+
+	err := c.SendStream(io.LimitReader(zeroReader{}, 64<<20))
+	assert.Equal(t, ErrStreamReset, err)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestApplicationCMDsReachOnMessage(t *testing.T) {
+	got := make(chan CMD, 16)
+	s := newTestServer()
+	s.OnMessage(func(c *Conn, msg *Message) {
+		got <- msg.GetCmd()
+	})
+
+	c := newTestClient(t, s)
+	defer c.Close()
+	// the commands an application numbers right after All are its own
+	for cmd := All + 1; cmd <= All+12; cmd++ {
+		c.SendBytes(cmd, []byte("x"))
+	}
+	for cmd := All + 1; cmd <= All+12; cmd++ {
+		select {
+		case v := <-got:
+			assert.Equal(t, cmd, v)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("command %d not received", cmd)
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -29,11 +30,20 @@ const (
 type Server struct {
 	addr      string
 	opt       *Options
+	listener  net.Listener
 	exitCh    chan struct{}
+	stopOnce  sync.Once
+	dispatch  *dispatcher
+	reactor   *reactor
 	sessions  *sync.Map
+	users     *userIndex
+	topics    *topicTree
+	cluster   *Cluster
 	onConnect func(c *Conn)
 	onMessage func(c *Conn, msg *Message)
+	onStream  func(c *Conn, s *Stream)
 	onClose   func(c *Conn, err error)
+	onAuth    AuthFunc
 }
 
 // NewServer creates a new tcp network connection using the given net connection.
@@ -42,8 +52,11 @@ func NewServer(addr string, opts ...Option) *Server {
 		addr:      addr,
 		exitCh:    make(chan struct{}),
 		sessions:  &sync.Map{},
+		users:     newUserIndex(),
+		topics:    newTopicTree(),
 		onConnect: func(c *Conn) {},
 		onMessage: func(c *Conn, msg *Message) {},
+		onStream:  func(c *Conn, s *Stream) { s.Close() },
 		onClose:   func(c *Conn, err error) {},
 	}
 
@@ -52,6 +65,16 @@ func NewServer(addr string, opts ...Option) *Server {
 		opt(d)
 	}
 	serv.opt = d
+	if d.ipFilter == nil {
+		d.ipFilter = NewIPFilter()
+	}
+	if d.dispatchMode == DispatchPool && d.dispatchWorkers <= 0 {
+		d.dispatchWorkers = DefaultDispatchWorkers
+	}
+	serv.dispatch = newDispatcher(d)
+	if d.mailbox != nil {
+		d.mailbox.srv = serv
+	}
 	return serv
 }
 
@@ -61,15 +84,9 @@ func (s *Server) Start() {
 	if err != nil {
 		panic(err)
 	}
-	defer listener.Close()
 
 	Flog.Infof("TCP server start successfully! %v", s.addr)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go s.Heartbeat()
-	go s.Accept(ctx, listener)
+	s.StartWithListener(listener)
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
@@ -82,51 +99,119 @@ func (s *Server) Start() {
 	}
 }
 
-func (s *Server) Accept(ctx context.Context, listener net.Listener) {
-	for {
-		select {
-		case <-s.exitCh:
-			return
-		default:
+// StartWithListener serves client connections accepted by the given listener without blocking,
+// the listener is closed by Stop
+func (s *Server) StartWithListener(listener net.Listener) {
+	s.listener = listener
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-s.exitCh
+		cancel()
+	}()
+
+	if s.opt.reactorLoops > 0 {
+		r, err := newReactor(s.opt.reactorLoops)
+		if err != nil {
+			Flog.Errorf("start reactor err: %v, serving connections with goroutines", err)
+		} else {
+			s.reactor = r
 		}
+	}
+
+	s.dispatch.start()
+	go s.Heartbeat()
+	go s.Accept(ctx, listener)
+	if s.opt.mailbox != nil {
+		go s.opt.mailbox.run()
+	}
+}
+
+// Addr get the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
 
+func (s *Server) Accept(ctx context.Context, listener net.Listener) {
+	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-s.exitCh:
+				return
+			default:
+			}
 			Flog.Errorf("accept connection err: %v", err)
 			continue
 		}
-		c := Conn{
-			srv:      s,
-			conn:     conn,
-			timer:    time.NewTimer(2 * time.Second),
-			clientIP: conn.RemoteAddr(),
-			protocol: NewDefaultProtocol(),
-			msgCh:    make(chan *Message, 1024),
-			sendCh:   make(chan *Message, 1024),
-			errDone:  make(chan error, 1),
-			extraMap: map[string]interface{}{},
-		}
-		go c.process(ctx)
+		go s.serve(ctx, conn)
 	}
 }
 
+// serve wraps an accepted connection and runs it until it is closed
+func (s *Server) serve(ctx context.Context, raw net.Conn) {
+	conn, err := s.acceptProxy(raw)
+	if err != nil {
+		Flog.Errorf("proxy header from %v err: %v", raw.RemoteAddr(), err)
+		raw.Close()
+		return
+	}
+	if !s.opt.ipFilter.Allowed(addrIP(conn.RemoteAddr())) {
+		Flog.Debugf("reject connection from %v", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if !s.dispatch.acquire() {
+		conn.Close()
+		return
+	}
+	c := &Conn{
+		srv:       s,
+		conn:      conn,
+		connected: time.Now(),
+		clientIP:  conn.RemoteAddr(),
+		protocol:  NewDefaultProtocol(),
+		done:      make(chan struct{}),
+		extraMap:  map[string]interface{}{},
+		topics:    map[string]struct{}{},
+	}
+	// connections that cannot be polled, e.g. TLS, keep their own goroutines in reactor mode
+	if s.reactor != nil && s.reactor.serve(c) {
+		return
+	}
+	defer s.dispatch.release()
+
+	c.timer = time.NewTimer(2 * time.Second)
+	c.msgCh = make(chan *Message, s.opt.dispatchQueue)
+	c.authStep = make(chan struct{}, 1)
+	c.sendCh = make(chan *Message, 1024)
+	c.streamCh = make(chan *Message, 16)
+	c.streams = newStreamManager(s.opt, c.sendCh, c.streamCh, func(st *Stream) {
+		s.onStream(c, st)
+	})
+	c.mux = newMux(s.opt, false, c.sendCh, c.streamCh, c.GetRawConn)
+	c.process(ctx)
+}
+
 // Heartbeat heartbeat detection
 func (s *Server) Heartbeat() {
 	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
 	for {
 		select {
+		case <-s.exitCh:
+			return
 		case <-tick.C:
 			s.sessions.Range(func(key, value interface{}) bool {
 				sess, ok := value.(*Session)
 				if !ok {
 					return true
 				}
-				if time.Now().Unix()-sess.lastTime > IdleTime {
-					sess.GetConn().Close()
-					s.sessions.Delete(key)
-					//close(sess.GetConn().sendCh)
-					//close(sess.GetConn().msgCh)
-					//close(sess.GetConn().errDone)
+				if time.Now().Unix()-sess.GetLastTime() > IdleTime {
+					// the Close frame may wait on a peer that stopped reading, it must not hold up the others
+					go sess.GetConn().CloseWithReason(CloseIdleTimeout, "idle timeout")
 				}
 				return true
 			})
@@ -134,13 +219,35 @@ func (s *Server) Heartbeat() {
 	}
 }
 
-// Stop Close server
+// Stop Close server, every connection is closed with CloseShutdown. It is safe to call more than once
 func (s *Server) Stop() {
-	close(s.exitCh)
-	s.sessions.Range(func(key, value interface{}) bool {
-		sess := value.(*Session)
-		sess.GetConn().Close()
-		return true
+	s.stopOnce.Do(func() {
+		close(s.exitCh)
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.opt.ipFilter.Close()
+		s.dispatch.shutdown()
+		// close the connections at once, each may wait closeWriteTimeout on a peer that stopped reading
+		var wg sync.WaitGroup
+		s.sessions.Range(func(key, value interface{}) bool {
+			conn := value.(*Session).GetConn()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn.CloseWithReason(CloseShutdown, "server shutdown")
+			}()
+			return true
+		})
+		wg.Wait()
+		if s.reactor != nil {
+			s.reactor.stop()
+		}
+		if s.opt.recorder != nil {
+			if err := s.opt.recorder.Flush(); err != nil {
+				Flog.Errorf("flush capture err: %v", err)
+			}
+		}
 	})
 }
 
@@ -154,97 +261,246 @@ func (s *Server) OnMessage(callback func(c *Conn, msg *Message)) {
 	s.onMessage = callback
 }
 
-// OnClose close callbacks on a connection, it will be called before closing
+// OnStream stream callbacks on a connection, it runs in its own goroutine and should read s until io.EOF,
+// streams are reset when no callback is set
+func (s *Server) OnStream(callback func(c *Conn, s *Stream)) {
+	s.onStream = callback
+}
+
+// OnClose close callbacks on a connection, it is called exactly once per connection before its
+// session is released. err is a *CloseError carrying the first cause that closed the connection
 func (s *Server) OnClose(callback func(c *Conn, err error)) {
 	s.onClose = callback
 }
 
 // Conn defines parameters for accept an client
 type Conn struct {
-	srv      *Server
-	conn     net.Conn
-	clientIP net.Addr
-	protocol Protocol
-	sessId   string
-	timer    *time.Timer
-	timeout  time.Duration
-	interval time.Duration
-	sendCh   chan *Message
-	msgCh    chan *Message
-	errDone  chan error
-	extraMap map[string]interface{}
+	srv        *Server
+	conn       net.Conn
+	clientIP   net.Addr
+	protocol   Protocol
+	sessId     string
+	sess       *Session
+	authed     int32
+	authFrames int
+	connected  time.Time
+	bytesIn    uint64
+	bytesOut   uint64
+	reason     *CloseError
+	peerReason *CloseError
+	timer      *time.Timer
+	timeout    time.Duration
+	interval   time.Duration
+	sendCh     chan *Message
+	streamCh   chan *Message
+	msgCh      chan *Message
+	authStep   chan struct{}
+	streams    *streamManager
+	mux        *Mux
+	closeOnce  sync.Once
+	done       chan struct{}
+	shard      uint32
+	handlers   sync.WaitGroup
+	loop       *eventLoop
+	raw        syscall.RawConn
+	fd         int
+	pending    []byte
+	authTimer  *time.Timer
+	extraMap   map[string]interface{}
+	topics     map[string]struct{}
 	sync.RWMutex
 }
 
 // process client connection
 func (c *Conn) process(ctx context.Context) {
-	sess := NewSession(c)
-	c.sessId = sess.GetSessionID()
-	c.srv.sessions.Store(c.sessId, sess)
+	c.open()
 	ctx, cancel := context.WithCancel(ctx)
-	defer func() {
-		cancel()
-		c.conn.Close()
-		c.srv.sessions.Delete(sess.GetSessionID())
-	}()
+	defer cancel()
+
+	var authTimeout <-chan time.Time
+	if c.srv.onAuth == nil {
+		c.setAuthed()
+	} else {
+		timer := time.NewTimer(c.srv.opt.authTimeout)
+		defer timer.Stop()
+		authTimeout = timer.C
+	}
 
 	go c.readLoop(ctx)
 	go c.writeLoop(ctx)
 
 	c.srv.onConnect(c)
+	exitCh := c.srv.exitCh
 	for {
 		select {
-		case <-c.srv.exitCh:
-			return
-		case err := <-c.errDone:
-			c.srv.onClose(c, err)
+		case <-exitCh:
+			// a connection accepted while the server stops may have missed Stop
+			exitCh = nil
+			c.CloseWithReason(CloseShutdown, "server shutdown")
+		case <-c.done:
+			c.drain()
+			c.finish()
 			return
+		case <-authTimeout:
+			if !c.IsAuthed() {
+				c.CloseWithReason(CloseAuthTimeout, ErrAuthTimeout.Error())
+			}
+		case msg := <-c.msgCh:
+			if c.IsAuthed() {
+				c.srv.dispatch.submit(c, msg)
+				continue
+			}
+			if !c.closing() {
+				c.authenticate(msg)
+			}
+			c.authStep <- struct{}{}
+		}
+	}
+}
+
+// open registers the session of a new connection
+func (c *Conn) open() {
+	sess := NewSession(c)
+	c.sess = sess
+	c.sessId = sess.GetSessionID()
+	c.shard = shardOf(c.sessId)
+	c.srv.sessions.Store(c.sessId, sess)
+	c.srv.sessionChanged(sess)
+}
+
+// finish calls OnClose once the handlers of the connection returned and releases the session
+func (c *Conn) finish() {
+	c.handlers.Wait()
+	reason := c.closeReason()
+	c.srv.onClose(c, reason)
+	if reason.Code == CloseProtocolError {
+		c.srv.strike(c)
+	}
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+	if c.streams != nil {
+		c.streams.close(ErrStreamClosed)
+		c.mux.close(ErrMuxClosed, false)
+	}
+	c.unsubscribeAll()
+	c.srv.users.bind(c.sess, c.sess.GetUserID(), "")
+	c.srv.sessions.Delete(c.sessId)
+	c.srv.sessionClosed(c.sess)
+}
+
+// drain dispatches the messages read before the connection was closed, a client may send and hang up at once
+func (c *Conn) drain() {
+	for c.IsAuthed() {
+		select {
 		case msg := <-c.msgCh:
-			c.srv.onMessage(c, msg)
+			c.srv.dispatch.submit(c, msg)
+		default:
+			return
+		}
+	}
+}
+
+// setAuthed lets the connection's frames through to the router
+func (c *Conn) setAuthed() {
+	atomic.StoreInt32(&c.authed, 1)
+}
+
+// IsAuthed reports whether the connection passed the OnAuth handshake
+func (c *Conn) IsAuthed() bool {
+	return atomic.LoadInt32(&c.authed) == 1
+}
+
+// dispatch handles the built-in control commands and passes everything else to OnMessage
+func (c *Conn) dispatch(msg *Message) {
+	switch msg.GetCmd() {
+	case Subscribe:
+		if err := c.Subscribe(string(msg.GetData())); err != nil {
+			Flog.Errorf("subscribe %q err: %v", msg.GetData(), err)
 		}
+	case Unsubscribe:
+		c.Unsubscribe(string(msg.GetData()))
+	case MailAck:
+		if mb := c.srv.opt.mailbox; mb != nil {
+			mb.ack(c.sess.GetUserID(), msg.GetData())
+		}
+	default:
+		c.srv.onMessage(c, msg)
 	}
 }
 
 // readLoop read goroutine
 func (c *Conn) readLoop(ctx context.Context) {
+	reader := bufio.NewReader(&countingReader{r: c.conn, n: &c.bytesIn})
 	for {
 		select {
-		case <-c.srv.exitCh:
-			return
 		case <-ctx.Done():
 			return
 		default:
-			reader := bufio.NewReader(c.conn)
 			msg, err := c.protocol.Unpack(reader)
 			if err != nil {
-				if err == io.EOF {
-					err = ErrClientClosed
-				} else {
-					netOpError, ok := err.(*net.OpError)
-					if ok && netOpError.Err.Error() == "use of closed network connection" {
-						err = ErrServerClosed
-					}
-				}
-				c.errDone <- err
+				c.readFailed(err)
 				return
 			}
-			c.msgCh <- msg
-
-			v, ok := c.srv.sessions.Load(c.sessId)
-			if !ok {
-				return
+			c.record(Inbound, msg)
+			// nothing bypasses the handshake, so stream frames wait for authentication too
+			switch {
+			case msg.GetCmd() == Close:
+				c.Lock()
+				c.peerReason = unpackClose(msg)
+				c.Unlock()
+			case !c.IsAuthed():
+				// the next frame is read once the handshake has handled this one, so the frames
+				// following a successful handshake are routed by their command
+				c.push(msg)
+				select {
+				case <-c.authStep:
+				case <-ctx.Done():
+					return
+				}
+			case isStreamCmd(msg.GetCmd()):
+				c.streams.handle(msg)
+			case msg.GetCmd() == MuxFrame:
+				c.mux.handle(msg)
+			default:
+				c.push(msg)
 			}
-			sess := v.(*Session)
-			sess.UpdateTime()
+
+			c.sess.UpdateTime()
 		}
 	}
 }
 
-// writeLoop write goroutine
+// readFailed closes the connection on a read error, the peer is told about a malformed frame
+func (c *Conn) readFailed(err error) {
+	ce := c.closeError(err)
+	if ce.Code == CloseProtocolError {
+		c.closeWith(ce)
+	}
+	c.shutdown(ce)
+}
+
+// writeLoop write goroutine, queued messages are written before stream fragments
+// so they are never stuck behind a large stream
 func (c *Conn) writeLoop(ctx context.Context) {
 	for {
 		select {
-		case <-c.srv.exitCh:
+		case <-c.done:
+			return
+		case msg := <-c.sendCh:
+			if err := c.writeMessage(msg); err != nil {
+				Flog.Errorf("send message err: %v", err)
+			}
+			continue
+		default:
+		}
+
+		select {
+		case <-c.done:
 			return
 		case <-ctx.Done():
 			return
@@ -252,6 +508,10 @@ func (c *Conn) writeLoop(ctx context.Context) {
 			if err := c.writeMessage(msg); err != nil {
 				Flog.Errorf("send message err: %v", err)
 			}
+		case msg := <-c.streamCh:
+			if err := c.writeMessage(msg); err != nil {
+				Flog.Errorf("send stream err: %v", err)
+			}
 		case <-c.timer.C:
 			//c.SendBytes(Heartbeat, []byte("ping"))
 			if c.interval > 0 {
@@ -263,6 +523,7 @@ func (c *Conn) writeLoop(ctx context.Context) {
 
 // write Message to client connection
 func (c *Conn) writeMessage(msg *Message) error {
+	c.record(Outbound, msg)
 	m, err := c.protocol.Pack(msg)
 	if err != nil {
 		return err
@@ -272,10 +533,10 @@ func (c *Conn) writeMessage(msg *Message) error {
 
 // writeBytes send bytes message to client connection
 func (c *Conn) writeBytes(b []byte) error {
-	_, err := c.conn.Write(b)
+	n, err := c.conn.Write(b)
+	atomic.AddUint64(&c.bytesOut, uint64(n))
 	if err != nil {
-		c.conn.Close()
-		c.srv.onClose(c, err)
+		c.shutdown(&CloseError{Code: CloseWriteFailed, Err: err})
 	}
 	return err
 }
@@ -306,7 +567,14 @@ func (c *Conn) GetClientIP() net.Addr {
 
 // SendMessage send message into channel
 func (c *Conn) SendMessage(msg *Message) {
-	c.sendCh <- msg
+	if c.loop != nil {
+		c.write(msg)
+		return
+	}
+	select {
+	case c.sendCh <- msg:
+	case <-c.done:
+	}
 }
 
 // SendBytes send bytes
@@ -315,26 +583,93 @@ func (c *Conn) SendBytes(cmd CMD, b []byte) {
 	c.SendMessage(msg)
 }
 
+// SendStream sends everything read from r to the client as a stream of fragment frames,
+// it blocks until r is drained or the stream is aborted
+func (c *Conn) SendStream(r io.Reader) error {
+	if c.streams == nil {
+		return ErrReactorStream
+	}
+	return c.streams.send(r)
+}
+
+// Mux get the stream multiplexer of the connection, it is nil in reactor mode
+func (c *Conn) Mux() *Mux {
+	return c.mux
+}
+
+// GetSession get the session of the connection
+func (c *Conn) GetSession() *Session {
+	return c.sess
+}
+
 // SendSingle send message to single
 func (c *Conn) SendSingle(sid string, msg *Message) {
-	v, ok := c.srv.sessions.Load(sid)
+	c.srv.SendSingle(sid, msg)
+}
+
+// SendAll send message to all
+func (c *Conn) SendAll(msg *Message) {
+	c.srv.SendAll(msg)
+}
+
+// SendSingle send message to the session, it is forwarded to the owning node in cluster mode
+func (s *Server) SendSingle(sid string, msg *Message) {
+	if s.sendSingleLocal(sid, msg) {
+		return
+	}
+	if s.cluster != nil {
+		s.cluster.forwardSingle(sid, msg)
+	}
+}
+
+// SendUser send message to every session bound to the user ID, including those on other nodes in cluster mode.
+// With a mailbox the message is stored when the user is offline everywhere
+func (s *Server) SendUser(uid string, msg *Message) {
+	delivered := s.sendUserLocal(uid, msg)
+	if s.cluster != nil && s.cluster.forwardUser(uid, msg) {
+		delivered = true
+	}
+	if !delivered && s.opt.mailbox != nil {
+		if err := s.opt.mailbox.put(uid, msg); err != nil {
+			Flog.Errorf("mailbox put %s err: %v", uid, err)
+		}
+	}
+}
+
+// SendAll send message to all sessions, including those on other nodes in cluster mode
+func (s *Server) SendAll(msg *Message) {
+	s.sendAllLocal(msg)
+	if s.cluster != nil {
+		s.cluster.forwardAll(msg)
+	}
+}
+
+func (s *Server) sendSingleLocal(sid string, msg *Message) bool {
+	v, ok := s.sessions.Load(sid)
 	if ok {
 		sess := v.(*Session)
 		sess.GetConn().SendMessage(msg)
 	}
+	return ok
 }
 
-// SendAll send message to all
-func (c *Conn) SendAll(msg *Message) {
-	c.srv.sessions.Range(func(key, value interface{}) bool {
+func (s *Server) sendUserLocal(uid string, msg *Message) bool {
+	sessions := s.users.sessions(uid)
+	for _, sess := range sessions {
+		sess.GetConn().SendMessage(msg)
+	}
+	return len(sessions) > 0
+}
+
+func (s *Server) sendAllLocal(msg *Message) {
+	s.sessions.Range(func(key, value interface{}) bool {
 		sess := value.(*Session)
 		sess.GetConn().SendMessage(msg)
 		return true
 	})
 }
 
-// Close the client connection
+// Close the client connection, the client is told it was kicked
 func (c *Conn) Close() {
-	c.conn.Close()
-	c.errDone <- ErrServerClosed
+	c.CloseWithReason(CloseKicked, "")
 }
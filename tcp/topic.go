@@ -0,0 +1,315 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrInvalidTopic occurs when a topic or topic filter is malformed
+	ErrInvalidTopic = errors.New("invalid topic")
+)
+
+const (
+	// TopicSeparator separates the levels of a topic, e.g. market.btc.ticker
+	TopicSeparator = "."
+	// WildcardOne matches exactly one level, "*" is accepted as an alias
+	WildcardOne = "+"
+	// WildcardMulti matches any number of trailing levels, it must be the last level
+	WildcardMulti = "#"
+	// MaxTopicLength is the longest topic a Publish message can carry
+	MaxTopicLength = 0xFFFF
+
+	wildcardStar = "*"
+)
+
+// ValidateTopic checks a topic used for publishing, it must not contain wildcards nor empty levels
+func ValidateTopic(topic string) error {
+	if topic == "" || len(topic) > MaxTopicLength {
+		return ErrInvalidTopic
+	}
+	for _, level := range strings.Split(topic, TopicSeparator) {
+		if level == "" || level == WildcardOne || level == WildcardMulti || level == wildcardStar {
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// ValidateFilter checks a topic filter used for subscribing, it must not contain empty levels like a..b
+func ValidateFilter(filter string) error {
+	if filter == "" || len(filter) > MaxTopicLength {
+		return ErrInvalidTopic
+	}
+	levels := strings.Split(filter, TopicSeparator)
+	for i, level := range levels {
+		if level == "" {
+			return ErrInvalidTopic
+		}
+		if strings.ContainsAny(level, WildcardOne+WildcardMulti+wildcardStar) && len(level) > 1 {
+			return ErrInvalidTopic
+		}
+		if level == WildcardMulti && i != len(levels)-1 {
+			return ErrInvalidTopic
+		}
+	}
+	return nil
+}
+
+// MatchTopic reports whether the topic matches the filter
+func MatchTopic(filter, topic string) bool {
+	f := strings.Split(filter, TopicSeparator)
+	t := strings.Split(topic, TopicSeparator)
+	for i, level := range f {
+		if level == WildcardMulti {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != WildcardOne && level != wildcardStar && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// PackPublish encodes a published message
+// ╔═══════════╤════════╤═════════╗
+// ║ FIELD     │ TYPE   │  SIZE   ║
+// ╠═══════════╪════════╪═════════╣
+// ║ TopicLen  │ uint16 │ 2       ║
+// ║ Topic     │ string │ dynamic ║
+// ║ Payload   │ []byte │ dynamic ║
+// ╚═══════════╧════════╧═════════╝
+func PackPublish(topic string, payload []byte) (*Message, error) {
+	if len(topic) > MaxTopicLength {
+		return nil, ErrInvalidTopic
+	}
+	b := make([]byte, 2+len(topic)+len(payload))
+	binary.LittleEndian.PutUint16(b, uint16(len(topic)))
+	copy(b[2:], topic)
+	copy(b[2+len(topic):], payload)
+	return NewMessage(Publish, b), nil
+}
+
+// UnpackPublish decodes the topic and payload of a Publish message
+func UnpackPublish(msg *Message) (topic string, payload []byte, err error) {
+	data := msg.GetData()
+	if msg.GetCmd() != Publish || len(data) < 2 {
+		return "", nil, ErrInvalidTopic
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+n {
+		return "", nil, ErrInvalidTopic
+	}
+	return string(data[2 : 2+n]), data[2+n:], nil
+}
+
+// topicNode is a level of the subscription tree
+type topicNode struct {
+	children map[string]*topicNode
+	subs     map[*Conn]struct{}
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+		subs:     make(map[*Conn]struct{}),
+	}
+}
+
+// topicTree indexes subscriptions by filter level and keeps the retained message of each topic
+type topicTree struct {
+	sync.RWMutex
+	root     *topicNode
+	retained map[string]*Message
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{
+		root:     newTopicNode(),
+		retained: make(map[string]*Message),
+	}
+}
+
+// normalize turns the "*" alias into "+" so both spellings share a node
+func normalize(filter string) []string {
+	levels := strings.Split(filter, TopicSeparator)
+	for i, level := range levels {
+		if level == wildcardStar {
+			levels[i] = WildcardOne
+		}
+	}
+	return levels
+}
+
+// normalizeFilter spells a filter with "+", the key of the filters of a connection
+func normalizeFilter(filter string) string {
+	return strings.Join(normalize(filter), TopicSeparator)
+}
+
+// subscribe adds c to the filter and returns the retained messages it matches
+func (t *topicTree) subscribe(c *Conn, filter string) []*Message {
+	t.Lock()
+	defer t.Unlock()
+	node := t.root
+	for _, level := range normalize(filter) {
+		next, ok := node.children[level]
+		if !ok {
+			next = newTopicNode()
+			node.children[level] = next
+		}
+		node = next
+	}
+	node.subs[c] = struct{}{}
+
+	var retained []*Message
+	for topic, msg := range t.retained {
+		if MatchTopic(filter, topic) {
+			retained = append(retained, msg)
+		}
+	}
+	return retained
+}
+
+// unsubscribe removes c from the filter and prunes empty nodes
+func (t *topicTree) unsubscribe(c *Conn, filter string) {
+	t.Lock()
+	defer t.Unlock()
+	t.remove(t.root, normalize(filter), c)
+}
+
+func (t *topicTree) remove(node *topicNode, levels []string, c *Conn) bool {
+	if len(levels) == 0 {
+		delete(node.subs, c)
+	} else if next, ok := node.children[levels[0]]; ok && t.remove(next, levels[1:], c) {
+		delete(node.children, levels[0])
+	}
+	return len(node.subs) == 0 && len(node.children) == 0
+}
+
+// match collects the subscribers of a topic, each connection once
+func (t *topicTree) match(topic string) []*Conn {
+	t.RLock()
+	defer t.RUnlock()
+	seen := make(map[*Conn]struct{})
+	t.collect(t.root, strings.Split(topic, TopicSeparator), seen)
+
+	conns := make([]*Conn, 0, len(seen))
+	for c := range seen {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (t *topicTree) collect(node *topicNode, levels []string, seen map[*Conn]struct{}) {
+	if next, ok := node.children[WildcardMulti]; ok {
+		for c := range next.subs {
+			seen[c] = struct{}{}
+		}
+	}
+	if len(levels) == 0 {
+		for c := range node.subs {
+			seen[c] = struct{}{}
+		}
+		return
+	}
+	if next, ok := node.children[levels[0]]; ok {
+		t.collect(next, levels[1:], seen)
+	}
+	if next, ok := node.children[WildcardOne]; ok {
+		t.collect(next, levels[1:], seen)
+	}
+}
+
+// retain stores msg as the last value of topic, an empty payload clears it
+func (t *topicTree) retain(topic string, msg *Message, empty bool) {
+	t.Lock()
+	defer t.Unlock()
+	if empty {
+		delete(t.retained, topic)
+		return
+	}
+	t.retained[topic] = msg
+}
+
+// Publish sends data to every session subscribed to a filter matching topic, on every node in cluster mode.
+// A retained message is kept as the last value of the topic and delivered to later subscribers,
+// publishing an empty retained payload clears it
+func (s *Server) Publish(topic string, data []byte, retain bool) error {
+	if err := ValidateTopic(topic); err != nil {
+		return err
+	}
+	s.publishLocal(topic, data, retain)
+	if s.cluster != nil {
+		s.cluster.forwardPublish(topic, data, retain)
+	}
+	return nil
+}
+
+func (s *Server) publishLocal(topic string, data []byte, retain bool) {
+	msg, err := PackPublish(topic, data)
+	if err != nil {
+		Flog.Errorf("publish err: %v", err)
+		return
+	}
+	if retain {
+		s.topics.retain(topic, msg, len(data) == 0)
+	}
+	for _, c := range s.topics.match(topic) {
+		c.SendMessage(msg)
+	}
+}
+
+// Subscribe subscribes the connection to a topic filter and delivers the retained messages it matches
+func (c *Conn) Subscribe(filter string) error {
+	if err := ValidateFilter(filter); err != nil {
+		return err
+	}
+	filter = normalizeFilter(filter)
+	c.Lock()
+	c.topics[filter] = struct{}{}
+	c.Unlock()
+
+	for _, msg := range c.srv.topics.subscribe(c, filter) {
+		c.SendMessage(msg)
+	}
+	return nil
+}
+
+// Unsubscribe removes a topic filter of the connection
+func (c *Conn) Unsubscribe(filter string) {
+	filter = normalizeFilter(filter)
+	c.Lock()
+	delete(c.topics, filter)
+	c.Unlock()
+	c.srv.topics.unsubscribe(c, filter)
+}
+
+// unsubscribeAll removes every topic filter of the connection
+func (c *Conn) unsubscribeAll() {
+	c.Lock()
+	filters := c.topics
+	c.topics = make(map[string]struct{})
+	c.Unlock()
+	for filter := range filters {
+		c.srv.topics.unsubscribe(c, filter)
+	}
+}
+
+// Subscribe asks the server to deliver Publish messages matching the topic filter
+func (c *Client) Subscribe(filter string) error {
+	if err := ValidateFilter(filter); err != nil {
+		return err
+	}
+	c.SendBytes(Subscribe, []byte(filter))
+	return nil
+}
+
+// Unsubscribe asks the server to stop delivering a topic filter
+func (c *Client) Unsubscribe(filter string) {
+	c.SendBytes(Unsubscribe, []byte(filter))
+}
@@ -0,0 +1,114 @@
+package network
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"market.btc.ticker", "market.btc.ticker", true},
+		{"market.*.ticker", "market.btc.ticker", true},
+		{"market.+.ticker", "market.eth.ticker", true},
+		{"market.+.ticker", "market.btc.depth", false},
+		{"market.#", "market.btc.ticker", true},
+		{"market.#", "market", true},
+		{"#", "market.btc", true},
+		{"market.+", "market.btc.ticker", false},
+		{"market.btc", "market", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, MatchTopic(c.filter, c.topic), "%s ~ %s", c.filter, c.topic)
+	}
+
+	assert.NoError(t, ValidateFilter("market.*.ticker"))
+	assert.Error(t, ValidateFilter("market.#.ticker"))
+	assert.Error(t, ValidateFilter("market.b*"))
+	assert.Error(t, ValidateFilter("market..ticker"))
+	assert.Error(t, ValidateFilter("market."))
+	assert.Error(t, ValidateTopic("market.+"))
+	assert.Error(t, ValidateTopic("market..ticker"))
+
+	_, err := PackPublish(strings.Repeat("a", MaxTopicLength+1), nil)
+	assert.ErrorIs(t, err, ErrInvalidTopic)
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	s := newTestServer()
+	subscribed := make(chan *Conn, 1)
+	s.OnConnect(func(c *Conn) {
+		subscribed <- c
+	})
+	c := newTestClient(t, s)
+	defer c.Close()
+	conn := <-subscribed
+
+	received := make(chan *Message, 4)
+	c.OnMessage(func(c *Client, msg *Message) {
+		received <- msg
+	})
+
+	assert.NoError(t, s.Publish("market.btc.ticker", []byte("100"), true))
+	assert.NoError(t, c.Subscribe("market.*.ticker"))
+
+	// the retained value is delivered on subscribe
+	topic, payload := recvPublish(t, received)
+	assert.Equal(t, "market.btc.ticker", topic)
+	assert.Equal(t, "100", string(payload))
+
+	assert.NoError(t, s.Publish("market.eth.ticker", []byte("5"), false))
+	topic, payload = recvPublish(t, received)
+	assert.Equal(t, "market.eth.ticker", topic)
+	assert.Equal(t, "5", string(payload))
+
+	c.Unsubscribe("market.*.ticker")
+	assert.Eventually(t, func() bool {
+		return len(s.topics.match("market.eth.ticker")) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, conn.Subscribe("market.#"))
+	c.Close()
+	assert.Eventually(t, func() bool {
+		return len(s.topics.match("market.eth.ticker")) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSubscribeWildcardSpellings(t *testing.T) {
+	s := newTestServer()
+	connected := make(chan *Conn, 1)
+	s.OnConnect(func(c *Conn) {
+		connected <- c
+	})
+	c := newTestClient(t, s)
+	defer c.Close()
+	conn := <-connected
+
+	// "*" and "+" are the same filter, either spelling removes it
+	assert.NoError(t, conn.Subscribe("market.*.ticker"))
+	conn.Unsubscribe("market.+.ticker")
+	assert.NoError(t, conn.Subscribe("market.+.depth"))
+	conn.Unsubscribe("market.*.depth")
+	conn.Lock()
+	assert.Empty(t, conn.topics)
+	conn.Unlock()
+	assert.Empty(t, s.topics.match("market.btc.ticker"))
+	assert.Empty(t, s.topics.match("market.btc.depth"))
+}
+
+func recvPublish(t *testing.T, ch chan *Message) (string, []byte) {
+	select {
+	case msg := <-ch:
+		topic, payload, err := UnpackPublish(msg)
+		assert.NoError(t, err)
+		return topic, payload
+	case <-time.After(2 * time.Second):
+		t.Fatal("publish not received")
+	}
+	return "", nil
+}